@@ -0,0 +1,621 @@
+// Package client is a Go client for a leveldbraft cluster. It discovers the
+// leader among a list of node addresses, routes writes to it and retries
+// idempotent operations across leader changes.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/store"
+	"github.com/hashicorp/raft"
+)
+
+// ErrNoEndpoints is returned by New when no node address is given.
+var ErrNoEndpoints = errors.New("no endpoints")
+
+// Client talks to a leveldbraft cluster over HTTP.
+type Client struct {
+	endpoints []string
+	opts      options
+
+	mtx     sync.Mutex
+	leader  string
+	current int
+}
+
+// New returns a client for the nodes at endpoints, given as host:port or
+// as URLs.
+func New(endpoints []string, opts ...Option) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	conf := defaultOptions()
+	for _, opt := range opts {
+		opt(&conf)
+	}
+
+	scheme := "http://"
+	if conf.tlsConfig != nil {
+		scheme = "https://"
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = conf.tlsConfig
+		httpClient := *conf.httpClient
+		httpClient.Transport = transport
+		conf.httpClient = &httpClient
+	}
+
+	c := &Client{opts: conf}
+	for _, endpoint := range endpoints {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = scheme + endpoint
+		}
+		c.endpoints = append(c.endpoints, strings.TrimRight(endpoint, "/"))
+	}
+	return c, nil
+}
+
+// Endpoints returns the node URLs known to the client.
+func (c *Client) Endpoints() []string {
+	return append([]string(nil), c.endpoints...)
+}
+
+// Get returns the value of key, read according to the client consistency.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	query := url.Values{"consistency": {string(c.opts.consistency)}}
+	toLeader := c.opts.consistency != cluster.ConsistencyStale
+	err := c.call(ctx, toLeader, true, func(endpoint string) error {
+		msg := cluster.Msg{}
+		if err := c.do(ctx, http.MethodGet, endpoint, "/raft/kv/"+url.PathEscape(key), query, nil, &msg); err != nil {
+			return err
+		}
+		value = msg.Data
+		return nil
+	})
+	return value, err
+}
+
+// Set stores value under key.
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	return c.call(ctx, true, true, func(endpoint string) error {
+		return c.do(ctx, http.MethodPut, endpoint, "/raft/kv", nil, &cluster.KV{Key: key, Value: value}, nil)
+	})
+}
+
+// CompareAndSwap sets key to value if it holds prev, cluster.ErrConflict if
+// the key is absent or holds another value. It is not retried once the
+// request reached the leader, as a retry could see its own write.
+func (c *Client) CompareAndSwap(ctx context.Context, key, prev, value string) error {
+	return c.call(ctx, true, false, func(endpoint string) error {
+		return c.do(ctx, http.MethodPost, endpoint, "/raft/kv/cas", nil, &cluster.CAS{Key: key, Prev: prev, Value: value}, nil)
+	})
+}
+
+// Delete removes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.call(ctx, true, true, func(endpoint string) error {
+		return c.do(ctx, http.MethodDelete, endpoint, "/raft/kv/"+url.PathEscape(key), nil, nil, nil)
+	})
+}
+
+// Members returns the raft configuration of the cluster.
+func (c *Client) Members(ctx context.Context) (raft.Configuration, error) {
+	var configuration raft.Configuration
+	err := c.call(ctx, true, true, func(endpoint string) error {
+		return c.do(ctx, http.MethodGet, endpoint, "/raft/members", nil, nil, &configuration)
+	})
+	return configuration, err
+}
+
+// AddMember adds m to the cluster.
+func (c *Client) AddMember(ctx context.Context, m cluster.Member) error {
+	return c.call(ctx, true, true, func(endpoint string) error {
+		return c.do(ctx, http.MethodPut, endpoint, "/raft/members", nil, &m, nil)
+	})
+}
+
+// RemoveMember removes the server id from the cluster.
+func (c *Client) RemoveMember(ctx context.Context, id string) error {
+	return c.call(ctx, true, true, func(endpoint string) error {
+		return c.do(ctx, http.MethodDelete, endpoint, "/raft/members/"+url.PathEscape(id), nil, nil, nil)
+	})
+}
+
+// PromoteMember turns the nonvoter id into a voter.
+func (c *Client) PromoteMember(ctx context.Context, id string) error {
+	return c.call(ctx, true, true, func(endpoint string) error {
+		return c.do(ctx, http.MethodPost, endpoint, "/raft/members/"+url.PathEscape(id)+"/promote", nil, nil, nil)
+	})
+}
+
+// TransferLeadership hands leadership to id, or to any up to date follower
+// if id is empty. It is not retried.
+func (c *Client) TransferLeadership(ctx context.Context, id string) error {
+	query := url.Values{}
+	if id != "" {
+		query.Set("id", id)
+	}
+	err := c.call(ctx, true, false, func(endpoint string) error {
+		return c.do(ctx, http.MethodPost, endpoint, "/raft/leader/transfer", query, nil, nil)
+	})
+	c.resetLeader("")
+	return err
+}
+
+// List returns the pairs whose key starts with prefix, read according to
+// the client consistency.
+func (c *Client) List(ctx context.Context, prefix string) ([]cluster.KV, error) {
+	var kvs []cluster.KV
+	query := url.Values{"prefix": {prefix}, "consistency": {string(c.opts.consistency)}}
+	toLeader := c.opts.consistency != cluster.ConsistencyStale
+	err := c.call(ctx, toLeader, true, func(endpoint string) error {
+		return c.do(ctx, http.MethodGet, endpoint, "/raft/kv", query, nil, &kvs)
+	})
+	return kvs, err
+}
+
+// Status returns the raft status of the node at endpoint.
+func (c *Client) Status(ctx context.Context, endpoint string) (*cluster.Status, error) {
+	status := &cluster.Status{}
+	if err := c.do(ctx, http.MethodGet, endpoint, "/raft/status", nil, nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// ScrubLogs verifies the raft log entries stored by the node at endpoint.
+func (c *Client) ScrubLogs(ctx context.Context, endpoint string) (*store.ScrubReport, error) {
+	report := &store.ScrubReport{}
+	if err := c.do(ctx, http.MethodPost, endpoint, "/raft/scrub", nil, nil, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// CompactLogs compacts the raft log store of the node at endpoint.
+func (c *Client) CompactLogs(ctx context.Context, endpoint string) (*store.CompactionReport, error) {
+	report := &store.CompactionReport{}
+	if err := c.do(ctx, http.MethodPost, endpoint, "/raft/compact", nil, nil, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// TakeSnapshot snapshots the FSM of the node at endpoint now.
+func (c *Client) TakeSnapshot(ctx context.Context, endpoint string) (*cluster.SnapshotInfo, error) {
+	info := &cluster.SnapshotInfo{}
+	if err := c.do(ctx, http.MethodPost, endpoint, "/raft/snapshot", nil, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Snapshots lists the snapshots of the node at endpoint, newest first.
+func (c *Client) Snapshots(ctx context.Context, endpoint string) ([]cluster.SnapshotInfo, error) {
+	var infos []cluster.SnapshotInfo
+	if err := c.do(ctx, http.MethodGet, endpoint, "/raft/snapshots", nil, nil, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// SaveSnapshot writes the archive of the latest snapshot of the node at
+// endpoint to w. The archive is verified by RestoreSnapshot.
+func (c *Client) SaveSnapshot(ctx context.Context, endpoint string, w io.Writer) error {
+	resp, err := c.stream(ctx, http.MethodGet, endpoint, "/raft/snapshots/latest", nil, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// RestoreSnapshot restores the cluster from a snapshot archive, replacing
+// its data. It is sent to the leader and not retried, as the archive is
+// read once.
+func (c *Client) RestoreSnapshot(ctx context.Context, archive io.Reader) (*cluster.SnapshotInfo, error) {
+	endpoint, err := c.Leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.stream(ctx, http.MethodPost, endpoint, "/raft/snapshots/restore", nil, "application/octet-stream", archive)
+	if err != nil {
+		if unavailable(err) {
+			c.failover(endpoint)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	info := &cluster.SnapshotInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Export writes the pairs whose key starts with prefix to w as NDJSON, one
+// consistent view read with the consistency of the client. Failures once
+// pairs were written are not retried.
+func (c *Client) Export(ctx context.Context, prefix string, w io.Writer) error {
+	query := url.Values{"prefix": {prefix}, "consistency": {string(c.opts.consistency)}}
+	toLeader := c.opts.consistency != cluster.ConsistencyStale
+	return c.call(ctx, toLeader, false, func(endpoint string) error {
+		resp, err := c.stream(ctx, http.MethodGet, endpoint, "/raft/export", query, "", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(w, resp.Body)
+		return err
+	})
+}
+
+// Import loads an NDJSON stream of pairs through raft. The stream is read
+// here and sent to the leader one batch per request, calling progress
+// once each batch is applied. Each request is bound by the timeout of the
+// http client, the import by ctx only. Batches are retried as writes, unless the
+// import skips existing keys. On error the counts so far are returned,
+// the batches applied stay applied.
+func (c *Client) Import(ctx context.Context, r io.Reader, opts cluster.ImportOptions, progress func(cluster.ImportProgress)) (*cluster.ImportProgress, error) {
+	batchSize := opts.BatchSize
+	if batchSize == 0 {
+		batchSize = cluster.DefaultImportBatch
+	}
+	if batchSize < 0 || batchSize > cluster.MaxImportBatch {
+		return nil, badRequest(fmt.Errorf("batch size %d out of 1-%d", batchSize, cluster.MaxImportBatch))
+	}
+	query := url.Values{
+		"mode":    {string(opts.Mode)},
+		"dry_run": {strconv.FormatBool(opts.DryRun)},
+		"batch":   {strconv.Itoa(batchSize)},
+	}
+	idempotent := opts.DryRun || opts.Mode != cluster.ImportSkip
+
+	p := &cluster.ImportProgress{DryRun: opts.DryRun}
+	// keys sent by a dry run, which skips the keys it would have added: the
+	// leader only knows those of the batch it counts
+	var seen map[string]bool
+	if opts.DryRun && opts.Mode == cluster.ImportSkip {
+		seen = map[string]bool{}
+	}
+	var batch bytes.Buffer
+	enc := json.NewEncoder(&batch)
+	pairs, size := 0, 0
+	send := func() error {
+		if pairs == 0 {
+			return nil
+		}
+		report := &cluster.ImportProgress{}
+		err := c.call(ctx, true, idempotent, func(endpoint string) error {
+			ctx := ctx
+			if timeout := c.opts.httpClient.Timeout; timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			*report = cluster.ImportProgress{}
+			resp, err := c.send(ctx, http.MethodPost, endpoint, "/raft/import", query, "application/x-ndjson", bytes.NewReader(batch.Bytes()))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return json.NewDecoder(resp.Body).Decode(report)
+			}
+			// an import failing after batches were applied answers their
+			// counts with the error
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+			if json.Unmarshal(b, report) == nil && report.Error != nil {
+				return &cluster.Error{Code: report.Error.Error, Message: report.Error.Data}
+			}
+			resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+			return decodeError(resp)
+		})
+		p.Applied += report.Applied
+		p.Skipped += report.Skipped
+		p.Batches += report.Batches
+		if err != nil {
+			return err
+		}
+		batch.Reset()
+		pairs, size = 0, 0
+		if progress != nil {
+			progress(*p)
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var kv cluster.KV
+		err := dec.Decode(&kv)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && kv.Key == "" {
+			err = errors.New("empty key")
+		}
+		if err != nil {
+			return p, badRequest(fmt.Errorf("pair %d: %v", p.Read+1, err))
+		}
+		p.Read++
+		if seen != nil {
+			if seen[kv.Key] {
+				p.Skipped++
+				continue
+			}
+			seen[kv.Key] = true
+		}
+		if pairs > 0 && size+len(kv.Key)+len(kv.Value) > cluster.MaxImportBatchBytes {
+			if err := send(); err != nil {
+				return p, err
+			}
+		}
+		if err := enc.Encode(kv); err != nil {
+			return p, err
+		}
+		pairs++
+		size += len(kv.Key) + len(kv.Value)
+		if pairs == batchSize {
+			if err := send(); err != nil {
+				return p, err
+			}
+		}
+	}
+	if err := send(); err != nil {
+		return p, err
+	}
+	p.Done = true
+	return p, nil
+}
+
+// Health returns nil if the node at endpoint reports ready.
+func (c *Client) Health(ctx context.Context, endpoint string) error {
+	return c.do(ctx, http.MethodGet, endpoint, "/health/ready", nil, nil, nil)
+}
+
+// Leader returns the endpoint of the current leader, asking every node for
+// its status if the leader is not known yet. If no node answers, the last
+// error is returned.
+func (c *Client) Leader(ctx context.Context) (string, error) {
+	c.mtx.Lock()
+	leader := c.leader
+	c.mtx.Unlock()
+	if leader != "" {
+		return leader, nil
+	}
+
+	var lastErr error
+	answered := false
+	for _, endpoint := range c.endpoints {
+		status, err := c.Status(ctx, endpoint)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		answered = true
+		if !status.IsLeader {
+			continue
+		}
+		c.mtx.Lock()
+		c.leader = endpoint
+		c.mtx.Unlock()
+		return endpoint, nil
+	}
+	if !answered && lastErr != nil {
+		return "", lastErr
+	}
+	return "", &cluster.Error{Code: cluster.CodeNotLeader, Message: "no leader found"}
+}
+
+// resetLeader forgets the cached leader if it is endpoint, or in any case
+// if endpoint is empty.
+func (c *Client) resetLeader(endpoint string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if endpoint == "" || c.leader == endpoint {
+		c.leader = ""
+	}
+}
+
+// pick returns the leader, or the current endpoint for requests any node
+// can serve.
+func (c *Client) pick(ctx context.Context, toLeader bool) (string, error) {
+	if toLeader {
+		return c.Leader(ctx)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.endpoints[c.current], nil
+}
+
+// failover moves requests any node can serve away from endpoint.
+func (c *Client) failover(endpoint string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.endpoints[c.current] == endpoint {
+		c.current = (c.current + 1) % len(c.endpoints)
+	}
+	if c.leader == endpoint {
+		c.leader = ""
+	}
+}
+
+// call runs fn against the leader or any endpoint, retrying with
+// exponential backoff on errors caused by leader changes and unreachable
+// nodes. Operations that are not idempotent are only retried when the
+// cluster rejected them before they were applied.
+func (c *Client) call(ctx context.Context, toLeader, idempotent bool, fn func(endpoint string) error) error {
+	backoff := c.opts.backoff
+	for attempt := 0; ; attempt++ {
+		endpoint, err := c.pick(ctx, toLeader)
+		if err == nil {
+			if err = fn(endpoint); err == nil {
+				return nil
+			}
+			if unavailable(err) {
+				c.failover(endpoint)
+			}
+		}
+		if attempt >= c.opts.retries || !retryable(err, idempotent) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > c.opts.maxBackoff {
+			backoff = c.opts.maxBackoff
+		}
+	}
+}
+
+// unavailable reports whether err means the node cannot serve the request.
+func unavailable(err error) bool {
+	var e *cluster.Error
+	if !errors.As(err, &e) {
+		return true
+	}
+	return e.Code == cluster.CodeNotLeader || e.Code == cluster.CodeShutdown
+}
+
+// retryable reports whether an operation failing with err may be retried.
+func retryable(err error, idempotent bool) bool {
+	var e *cluster.Error
+	if !errors.As(err, &e) {
+		// the node could not be reached
+		return idempotent
+	}
+	switch e.Code {
+	case cluster.CodeNotLeader:
+		return true
+	case cluster.CodeShutdown, cluster.CodeTimeout, cluster.CodeOutcomeUnknown:
+		return idempotent
+	}
+	return false
+}
+
+// do sends a JSON request to endpoint and decodes the answer into out.
+// Error answers are returned as *cluster.Error.
+func (c *Client) do(ctx context.Context, method, endpoint, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	u := endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if c.opts.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.token)
+	}
+
+	resp, err := c.opts.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stream sends body as a binary request to endpoint and returns the
+// answer, whose body the caller closes. It is bound by ctx only, not by
+// the timeout of the http client, as snapshots take their time.
+func (c *Client) stream(ctx context.Context, method, endpoint, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	resp, err := c.send(ctx, method, endpoint, path, query, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp, nil
+}
+
+// send is stream returning answers of any status.
+func (c *Client) send(ctx context.Context, method, endpoint, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	u := endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, application/octet-stream, application/x-ndjson")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.opts.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.token)
+	}
+
+	httpClient := *c.opts.httpClient
+	httpClient.Timeout = 0
+	return httpClient.Do(req)
+}
+
+// badRequest returns a bad request error caused by err, as a node would.
+func badRequest(err error) error {
+	return &cluster.Error{Code: cluster.CodeBadRequest, Message: cluster.ErrBadRequest.Message, Err: err}
+}
+
+// decodeError turns an error answer into a *cluster.Error.
+func decodeError(resp *http.Response) error {
+	msg := cluster.Msg{}
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return &cluster.Error{
+			Code:    cluster.CodeInternal,
+			Message: fmt.Sprintf("unexpected status %s", resp.Status),
+		}
+	}
+	e := &cluster.Error{Code: msg.Error, Message: msg.Data}
+	if e.Code == "" {
+		e.Code = cluster.CodeInternal
+	}
+	if e.Message == "" {
+		e.Message = resp.Status
+	}
+	return e
+}
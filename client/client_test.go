@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/cluster/clustertest"
+)
+
+func TestClientKV(t *testing.T) {
+	c := clustertest.New(t, 3)
+	endpoints := c.HTTPEndpoints()
+	cl, err := New(endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clustertest.DefaultTimeout)
+	defer cancel()
+
+	leader, err := cl.Leader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := endpoints[c.Leader().Index]; leader != want {
+		t.Fatalf("Leader returned %s, want %s", leader, want)
+	}
+
+	if err := cl.Set(ctx, "key", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cl.Get(ctx, "key"); err != nil || v != "a" {
+		t.Fatalf("Get returned %q, %v, want a", v, err)
+	}
+	if err := cl.CompareAndSwap(ctx, "key", "other", "b"); !errors.Is(err, cluster.ErrConflict) {
+		t.Fatalf("CompareAndSwap of a stale value returned %v, want ErrConflict", err)
+	}
+	if err := cl.CompareAndSwap(ctx, "key", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Set(ctx, "other", "c"); err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := cl.List(ctx, "k")
+	if err != nil || len(kvs) != 1 || kvs[0] != (cluster.KV{Key: "key", Value: "b"}) {
+		t.Fatalf("List returned %v, %v, want key=b", kvs, err)
+	}
+	if err := cl.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Get(ctx, "key"); !errors.Is(err, cluster.ErrKeyNotFound) {
+		t.Fatalf("Get of a deleted key returned %v, want ErrKeyNotFound", err)
+	}
+
+	configuration, err := cl.Members(ctx)
+	if err != nil || len(configuration.Servers) != 3 {
+		t.Fatalf("Members returned %v, %v, want 3 servers", configuration.Servers, err)
+	}
+
+	// stale reads are served by any node
+	stale, err := New(endpoints, WithConsistency(cluster.ConsistencyStale))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WaitConverged()
+	if v, err := stale.Get(ctx, "other"); err != nil || v != "c" {
+		t.Fatalf("stale Get returned %q, %v, want c", v, err)
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	c := clustertest.New(t, 3)
+	endpoints := c.HTTPEndpoints()
+	cl, err := New(endpoints, WithRetries(20), WithBackoff(10*time.Millisecond, 200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clustertest.DefaultTimeout)
+	defer cancel()
+
+	if err := cl.Set(ctx, "key", "before"); err != nil {
+		t.Fatal(err)
+	}
+	old, err := cl.Leader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Kill(c.Leader().Index)
+
+	// the write is retried until a new leader is found
+	if err := cl.Set(ctx, "key", "after"); err != nil {
+		t.Fatal(err)
+	}
+	leader, err := cl.Leader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader == old {
+		t.Fatalf("client still routes to the killed leader %s", old)
+	}
+	if want := endpoints[c.WaitLeader().Index]; leader != want {
+		t.Fatalf("Leader returned %s, want %s", leader, want)
+	}
+	if v, err := cl.Get(ctx, "key"); err != nil || v != "after" {
+		t.Fatalf("Get returned %q, %v, want after", v, err)
+	}
+
+	// stale reads move away from an unreachable endpoint
+	stale, err := New([]string{old, leader}, WithConsistency(cluster.ConsistencyStale))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := stale.Get(ctx, "key"); err != nil || v != "after" {
+		t.Fatalf("stale Get returned %q, %v, want after", v, err)
+	}
+}
+
+// fakeNode answers every request with the error code, leading, and
+// records when it was called.
+type fakeNode struct {
+	code cluster.ErrorCode
+
+	mtx   sync.Mutex
+	calls []time.Time
+}
+
+func (f *fakeNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/raft/status" {
+		json.NewEncoder(w).Encode(&cluster.Status{IsLeader: true})
+		return
+	}
+	f.mtx.Lock()
+	f.calls = append(f.calls, time.Now())
+	f.mtx.Unlock()
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(&cluster.Msg{Error: f.code, Data: string(f.code)})
+}
+
+func TestClientRetries(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		code cluster.ErrorCode
+		// calls of Set, which is idempotent, and of CompareAndSwap
+		set, cas int
+	}{
+		{code: cluster.CodeNotLeader, set: 4, cas: 4},
+		{code: cluster.CodeTimeout, set: 4, cas: 1},
+		{code: cluster.CodeOutcomeUnknown, set: 4, cas: 1},
+		{code: cluster.CodeShutdown, set: 4, cas: 1},
+		{code: cluster.CodeConflict, set: 1, cas: 1},
+	} {
+		node := &fakeNode{code: tc.code}
+		server := httptest.NewServer(node)
+		cl, err := New([]string{server.URL}, WithRetries(3), WithBackoff(10*time.Millisecond, 25*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = cl.Set(ctx, "key", "value")
+		if e := (&cluster.Error{}); !errors.As(err, &e) || e.Code != tc.code {
+			t.Errorf("%s: Set returned %v", tc.code, err)
+		}
+		if len(node.calls) != tc.set {
+			t.Errorf("%s: Set was sent %d times, want %d", tc.code, len(node.calls), tc.set)
+		}
+		// backoff doubles up to its max: 10ms, 20ms, 25ms
+		if tc.set == 4 {
+			for i, want := range []time.Duration{10, 20, 25} {
+				if d := node.calls[i+1].Sub(node.calls[i]); d < want*time.Millisecond {
+					t.Errorf("%s: retry %d after %v, want %dms", tc.code, i+1, d, want)
+				}
+			}
+		}
+
+		node.calls = nil
+		cl.CompareAndSwap(ctx, "key", "prev", "value")
+		if len(node.calls) != tc.cas {
+			t.Errorf("%s: CompareAndSwap was sent %d times, want %d", tc.code, len(node.calls), tc.cas)
+		}
+		server.Close()
+	}
+
+	// unreachable nodes are only retried for idempotent operations
+	server := httptest.NewServer(&fakeNode{})
+	cl, err := New([]string{server.URL}, WithRetries(3), WithBackoff(time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Leader(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	calls := 0
+	cl.call(ctx, true, false, func(endpoint string) error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if calls != 1 {
+		t.Errorf("non-idempotent call to an unreachable node sent %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+)
+
+type options struct {
+	httpClient  *http.Client
+	consistency cluster.Consistency
+	retries     int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	token       string
+	tlsConfig   *tls.Config
+}
+
+func defaultOptions() options {
+	return options{
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		consistency: cluster.ConsistencyLeader,
+		retries:     5,
+		backoff:     50 * time.Millisecond,
+		maxBackoff:  2 * time.Second,
+	}
+}
+
+// Option configures a Client.
+type Option func(o *options)
+
+// WithHTTPClient sets the http client used to talk to the nodes.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// WithConsistency sets the consistency of reads, leader by default.
+func WithConsistency(c cluster.Consistency) Option {
+	return func(o *options) {
+		o.consistency = c
+	}
+}
+
+// WithRetries sets how many times idempotent operations are retried.
+func WithRetries(n int) Option {
+	return func(o *options) {
+		o.retries = n
+	}
+}
+
+// WithBackoff sets the initial and max delay between retries.
+func WithBackoff(initial, max time.Duration) Option {
+	return func(o *options) {
+		o.backoff = initial
+		o.maxBackoff = max
+	}
+}
+
+// WithToken sets the bearer token sent with every request.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// WithTLSConfig talks https to the nodes, endpoints given without scheme
+// default to https.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = c
+	}
+}
@@ -0,0 +1,27 @@
+package cluster
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+)
+
+// TokenFilter returns a go-restful filter rejecting requests that do not
+// carry token as a bearer token, /metrics included. Health probes and CORS
+// preflight requests are always allowed.
+func TokenFilter(token string) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		if strings.HasPrefix(req.Request.URL.Path, "/health/") || req.Request.Method == http.MethodOptions {
+			chain.ProcessFilter(req, resp)
+			return
+		}
+		given := strings.TrimPrefix(req.HeaderParameter("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(resp, ErrUnauthorized)
+			return
+		}
+		chain.ProcessFilter(req, resp)
+	}
+}
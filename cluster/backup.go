@@ -0,0 +1,387 @@
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/config"
+	"github.com/00arthur00/leveldbraft/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// backups are snapshot archives, described by a sidecar of the same
+	// name, and written under a temporary name until complete
+	backupPrefix     = "backup-"
+	backupSuffix     = ".snap"
+	backupMetaSuffix = ".json"
+	backupTmpSuffix  = ".tmp"
+	backupTimeFormat = "20060102T150405Z"
+
+	defaultBackupSchedule = "@hourly"
+)
+
+// BackupInfo describes a backup, as written in its sidecar file.
+type BackupInfo struct {
+	// File is the name of the snapshot archive in the backup dir.
+	File     string       `json:"file"`
+	Time     time.Time    `json:"time"`
+	Node     string       `json:"node"`
+	Snapshot SnapshotInfo `json:"snapshot"`
+	// Size and SHA256 are those of the archive.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupStatus is the state of the scheduled backups of a node.
+type BackupStatus struct {
+	Dir      string `json:"dir"`
+	Schedule string `json:"schedule"`
+	// Node is the node taking backups, the leader if empty.
+	Node string    `json:"node,omitempty"`
+	Next time.Time `json:"next"`
+	// Last is the latest backup taken by this node.
+	Last          *BackupInfo `json:"last,omitempty"`
+	LastError     string      `json:"last_error,omitempty"`
+	LastErrorTime *time.Time  `json:"last_error_time,omitempty"`
+	// Backups is the number of backups kept in Dir.
+	Backups int `json:"backups"`
+}
+
+// backups takes the scheduled backups of a node.
+type backups struct {
+	dir        string
+	spec       string
+	schedule   Schedule
+	node       string
+	keepHourly int
+	keepDaily  int
+	log        hclog.Logger
+
+	mtx    sync.Mutex
+	status BackupStatus
+	// run serializes backups
+	run sync.Mutex
+}
+
+// newBackups returns the backup scheduler of c, nil if c.BackupDir is
+// empty.
+func newBackups(c *config.Config, log hclog.Logger) (*backups, error) {
+	if c.BackupDir == "" {
+		return nil, nil
+	}
+	spec := c.BackupSchedule
+	if spec == "" {
+		spec = defaultBackupSchedule
+	}
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	if c.BackupKeepHourly < 0 || c.BackupKeepDaily < 0 {
+		return nil, fmt.Errorf("keep %d hourly and %d daily backups, want at least 0", c.BackupKeepHourly, c.BackupKeepDaily)
+	}
+	if err := os.MkdirAll(c.BackupDir, 0700); err != nil {
+		return nil, err
+	}
+	b := &backups{
+		dir:        c.BackupDir,
+		spec:       spec,
+		schedule:   schedule,
+		node:       c.BackupNode,
+		keepHourly: c.BackupKeepHourly,
+		keepDaily:  c.BackupKeepDaily,
+		log:        log.Named("backup"),
+	}
+	if err := b.removeUnfinished(); err != nil {
+		return nil, err
+	}
+	kept, err := b.list()
+	if err != nil {
+		return nil, err
+	}
+	b.status = BackupStatus{Dir: b.dir, Schedule: spec, Node: b.node, Backups: len(kept)}
+	return b, nil
+}
+
+// Status returns the state of the scheduled backups.
+func (b *backups) Status() BackupStatus {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.status
+}
+
+// loop takes the backups of node on schedule until the node shuts down.
+func (b *backups) loop(node *RaftNodeInfo, id string) {
+	for {
+		next := b.schedule.Next(time.Now())
+		b.mtx.Lock()
+		b.status.Next = next
+		b.mtx.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-node.shutdownCh:
+			timer.Stop()
+			return
+		}
+		if b.node == "" && !node.IsLeader() || b.node != "" && b.node != id {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-node.shutdownCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		b.backup(ctx, node, id)
+		cancel()
+	}
+}
+
+// backup takes a backup of node now, recording the outcome in the status.
+func (b *backups) backup(ctx context.Context, node *RaftNodeInfo, id string) (*BackupInfo, error) {
+	b.run.Lock()
+	defer b.run.Unlock()
+
+	now := time.Now().UTC()
+	info, err := b.write(ctx, node, id, now)
+	if err == nil {
+		err = b.prune()
+	}
+	kept, lerr := b.list()
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if lerr == nil {
+		b.status.Backups = len(kept)
+	}
+	if err != nil {
+		backupsTotal.WithLabelValues("error").Inc()
+		b.log.Error("backup failed", "error", err)
+		b.status.LastError, b.status.LastErrorTime = err.Error(), &now
+		return nil, err
+	}
+	backupsTotal.WithLabelValues("ok").Inc()
+	backupLastSuccess.Set(float64(now.Unix()))
+	b.log.Info("backup written", "file", info.File, "index", info.Snapshot.Index, "size", info.Size)
+	b.status.Last, b.status.LastError, b.status.LastErrorTime = info, "", nil
+	return info, nil
+}
+
+// write snapshots the FSM of node and writes the archive of the latest
+// snapshot and its sidecar to the backup dir.
+func (b *backups) write(ctx context.Context, node *RaftNodeInfo, id string, now time.Time) (*BackupInfo, error) {
+	// nothing applied since the last snapshot, back it up again
+	if _, err := node.TakeSnapshot(ctx); err != nil && !errors.Is(err, ErrConflict) {
+		return nil, err
+	}
+	meta, rc, err := node.OpenSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	name := fmt.Sprintf("%s%s-%d", backupPrefix, now.Format(backupTimeFormat), meta.Index)
+	f, err := ioutil.TempFile(b.dir, name+"-*"+backupTmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(f, h)}
+	if err := store.WriteSnapshotArchive(cw, meta, rc); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	info := &BackupInfo{
+		File:     name + backupSuffix,
+		Time:     now,
+		Node:     id,
+		Snapshot: NewSnapshotInfo(meta),
+		Size:     cw.n,
+		SHA256:   hex.EncodeToString(h.Sum(nil)),
+	}
+	if err := os.Rename(f.Name(), filepath.Join(b.dir, info.File)); err != nil {
+		return nil, err
+	}
+	// the sidecar lands last, a backup without one is unfinished
+	if err := b.writeMeta(name, info); err != nil {
+		return nil, err
+	}
+	return info, store.SyncDir(b.dir)
+}
+
+func (b *backups) writeMeta(name string, info *BackupInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(b.dir, name+backupMetaSuffix+backupTmpSuffix)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(b.dir, name+backupMetaSuffix))
+}
+
+// list returns the backups in the backup dir, newest first.
+func (b *backups) list() ([]*BackupInfo, error) {
+	entries, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []*BackupInfo
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupMetaSuffix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(b.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		info := &BackupInfo{}
+		if err := json.Unmarshal(data, info); err != nil {
+			b.log.Warn("skipping backup with unreadable metadata", "name", name, "error", err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Time.After(infos[j].Time)
+	})
+	return infos, nil
+}
+
+// prune removes the backups no longer retained.
+func (b *backups) prune() error {
+	infos, err := b.list()
+	if err != nil {
+		return err
+	}
+	keep := retainBackups(infos, b.keepHourly, b.keepDaily)
+	for i, info := range infos {
+		if keep[i] {
+			continue
+		}
+		b.log.Info("removing old backup", "file", info.File)
+		name := strings.TrimSuffix(info.File, backupSuffix)
+		if err := os.Remove(filepath.Join(b.dir, name+backupMetaSuffix)); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(b.dir, info.File)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// retainBackups tells which of infos, newest first, are kept: the newest
+// of each of the last hourly hours and daily days holding backups, and
+// always the newest backup.
+func retainBackups(infos []*BackupInfo, hourly, daily int) []bool {
+	keep := make([]bool, len(infos))
+	hours, days := map[string]bool{}, map[string]bool{}
+	for i, info := range infos {
+		t := info.Time.UTC()
+		if hour := t.Format("2006010215"); !hours[hour] && len(hours) < hourly {
+			hours[hour] = true
+			keep[i] = true
+		}
+		if day := t.Format("20060102"); !days[day] && len(days) < daily {
+			days[day] = true
+			keep[i] = true
+		}
+	}
+	if len(keep) > 0 {
+		keep[0] = true
+	}
+	return keep
+}
+
+// removeUnfinished removes the files of backups interrupted by a crash.
+func (b *backups) removeUnfinished() error {
+	entries, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	metas := map[string]bool{}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), backupMetaSuffix) {
+			metas[strings.TrimSuffix(e.Name(), backupMetaSuffix)] = true
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) {
+			continue
+		}
+		unfinished := strings.HasSuffix(name, backupTmpSuffix) ||
+			strings.HasSuffix(name, backupSuffix) && !metas[strings.TrimSuffix(name, backupSuffix)]
+		if !unfinished {
+			continue
+		}
+		b.log.Warn("removing unfinished backup", "name", name)
+		if err := os.Remove(filepath.Join(b.dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backup takes a backup of this node now, whether or not it is the node
+// taking scheduled backups. ErrBadRequest if backups are not configured.
+func (r *RaftNodeInfo) Backup(ctx context.Context) (*BackupInfo, error) {
+	if r.backups == nil {
+		return nil, wrapError(ErrBadRequest, errors.New("backups are not configured"))
+	}
+	info, err := r.backups.backup(ctx, r, r.id)
+	if err != nil {
+		return nil, toError(err)
+	}
+	return info, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
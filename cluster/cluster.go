@@ -1,6 +1,9 @@
 package cluster
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,12 +12,15 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/00arthur00/leveldbraft/config"
 	"github.com/00arthur00/leveldbraft/store"
-	"github.com/hashicorp/consul/agent/consul"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 )
@@ -24,24 +30,88 @@ const (
 	ENABLE_WRITE_FALSE = int32(0)
 )
 
+// Consistency selects how up to date a read has to be.
+type Consistency string
+
+const (
+	// ConsistencyStale reads the local FSM of any node.
+	ConsistencyStale Consistency = "stale"
+	// ConsistencyLeader reads the local FSM of the leader.
+	ConsistencyLeader Consistency = "leader"
+	// ConsistencyLinearizable reads on the leader after a barrier has been
+	// applied and leadership has been verified with a quorum.
+	ConsistencyLinearizable Consistency = "linearizable"
+)
+
 type Node interface {
 	// Set key/value pair to the cluster.
-	Set(key, value string) error
+	Set(ctx context.Context, key, value string) error
 
 	// Delete key from the distributed storage.
-	Delete(key string) error
+	Delete(ctx context.Context, key string) error
 
-	// Get Key related value.
-	Get(key string) (string, bool)
+	// CompareAndSwap sets key to value if it holds prev, ErrConflict if the
+	// key is absent or holds another value.
+	CompareAndSwap(ctx context.Context, key, prev, value string) error
+
+	// Get Key related value, ErrKeyNotFound if key is absent.
+	Get(ctx context.Context, key string, consistency Consistency) (string, error)
+
+	// List returns the pairs whose key starts with prefix, sorted by key.
+	List(ctx context.Context, prefix string, consistency Consistency) ([]KV, error)
 
 	// Join remote peer to this cluster.
-	Join(peer string) error
+	Join(ctx context.Context, peer string) error
+
+	// AddMember adds a voter, or a nonvoter if voter is false.
+	AddMember(ctx context.Context, id, address string, voter bool) error
+
+	// RemoveMember removes a server from the cluster.
+	RemoveMember(ctx context.Context, id string) error
+
+	// PromoteMember turns a nonvoter into a voter.
+	PromoteMember(ctx context.Context, id string) error
+
+	// TransferLeadership hands leadership to id, or to the most
+	// up to date follower if id is empty.
+	TransferLeadership(ctx context.Context, id string) error
 
 	// IsLeader returns whether this node is leader.
 	IsLeader() bool
 
 	// Members get members of the cluster
-	Members() raft.Configuration
+	Members(ctx context.Context) (raft.Configuration, error)
+
+	// Status returns raft state of this node.
+	Status(ctx context.Context) Status
+
+	// Ready returns nil if this node is able to serve requests.
+	Ready(ctx context.Context) error
+
+	// ScrubLogs verifies every raft log entry stored by this node.
+	ScrubLogs(ctx context.Context) (*store.ScrubReport, error)
+
+	// CompactLogs compacts the raft log store of this node.
+	CompactLogs(ctx context.Context) (*store.CompactionReport, error)
+
+	// TakeSnapshot snapshots the FSM of this node now.
+	TakeSnapshot(ctx context.Context) (*raft.SnapshotMeta, error)
+
+	// Snapshots lists the snapshots of this node, newest first.
+	Snapshots(ctx context.Context) ([]*raft.SnapshotMeta, error)
+
+	// OpenSnapshot opens the latest snapshot of this node that verifies.
+	OpenSnapshot(ctx context.Context) (*raft.SnapshotMeta, io.ReadCloser, error)
+
+	// RestoreSnapshot restores the cluster from a snapshot archive, on the
+	// leader.
+	RestoreSnapshot(ctx context.Context, archive io.Reader) (*raft.SnapshotMeta, error)
+
+	// Import loads a stream of NDJSON pairs through raft, on the leader.
+	Import(ctx context.Context, r io.Reader, opts ImportOptions, progress func(ImportProgress)) (*ImportProgress, error)
+
+	// Imports returns the progress of the imports running on this node.
+	Imports() []ImportStatus
 }
 
 type RaftNodeInfo struct {
@@ -51,70 +121,326 @@ type RaftNodeInfo struct {
 	log            hclog.Logger
 	cache          store.Cacher
 	enableWrite    int32
+	logStore       *store.LevelDBStore
+	stableStore    *store.LevelDBStore
+	readyMaxLag    uint64
+	shutdownCh     chan struct{}
+	shutdownOnce   sync.Once
+	shutdownErr    error
+	faults         *FaultTransport
+	snapshots      raft.SnapshotStore
+	dataDir        string
+	// id is the raft server id of this node
+	id string
+	// backups takes the scheduled backups, nil if not configured
+	backups    *backups
+	background sync.WaitGroup
+	// commandFormat encodes FSM commands, 0 for bare JSON
+	commandFormat store.Format
+	imports       importTracker
 }
 
 // Set key/value pair to the cluster.
-func (r *RaftNodeInfo) Set(key string, value string) error {
-	logEntry := store.LogEntryData{
+func (r *RaftNodeInfo) Set(ctx context.Context, key string, value string) error {
+	return r.applyCommand(ctx, &store.LogEntryData{
 		Op:    store.OPSet,
 		Key:   key,
 		Value: value,
+	})
+}
+
+// Delete key from the distributed storage
+func (r *RaftNodeInfo) Delete(ctx context.Context, key string) error {
+	return r.applyCommand(ctx, &store.LogEntryData{
+		Op:  store.OPDel,
+		Key: key,
+	})
+}
+
+// CompareAndSwap sets key to value if it holds prev.
+func (r *RaftNodeInfo) CompareAndSwap(ctx context.Context, key, prev, value string) error {
+	return r.applyCommand(ctx, &store.LogEntryData{
+		Op:    store.OPCAS,
+		Key:   key,
+		Value: value,
+		Prev:  prev,
+	})
+}
+
+// applyCommand encodes cmd and applies it.
+func (r *RaftNodeInfo) applyCommand(ctx context.Context, cmd *store.LogEntryData) error {
+	b, err := r.encodeCommand(cmd)
+	if err != nil {
+		return err
 	}
+	_, err = r.apply(ctx, cmd.Op, b)
+	return err
+}
 
-	encodeBytes, err := json.Marshal(&logEntry)
+// encodeCommand encodes cmd in the command format of this node, bare JSON
+// if none is set.
+func (r *RaftNodeInfo) encodeCommand(cmd *store.LogEntryData) ([]byte, error) {
+	var b []byte
+	var err error
+	if r.commandFormat == 0 {
+		b, err = json.Marshal(cmd)
+	} else {
+		b, err = store.EncodeCommand(r.commandFormat, cmd)
+	}
+	if err != nil {
+		r.log.Error("encode command", "op", cmd.Op, "error", err)
+		return nil, err
+	}
+	return b, nil
+}
+
+// apply commits cmd through raft, records its latency and returns the
+// response of the FSM.
+func (r *RaftNodeInfo) apply(ctx context.Context, op store.OP, cmd []byte) (interface{}, error) {
+	timeout, err := timeoutFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	begin := time.Now()
+	applyFuture := r.raft.Apply(cmd, timeout)
+	err = wait(ctx, applyFuture)
+	raftApplyDuration.WithLabelValues(op.String()).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		raftApplyErrors.WithLabelValues(op.String()).Inc()
+		r.log.Error("raft apply", "op", op, "error", err)
+		return nil, err
+	}
+	response := applyFuture.Response()
+	if err, ok := response.(error); ok {
+		if err == store.ErrCompareFailed {
+			return nil, wrapError(ErrConflict, err)
+		}
+		return nil, toError(err)
+	}
+	return response, nil
+}
+
+// Get Key related value
+func (r *RaftNodeInfo) Get(ctx context.Context, key string, consistency Consistency) (string, error) {
+	if err := r.checkRead(ctx, consistency); err != nil {
+		return "", err
+	}
+	value, ok := r.cache.Get(key)
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// List returns the pairs whose key starts with prefix, sorted by key.
+func (r *RaftNodeInfo) List(ctx context.Context, prefix string, consistency Consistency) ([]KV, error) {
+	if err := r.checkRead(ctx, consistency); err != nil {
+		return nil, err
+	}
+	kvs := []KV{}
+	r.cache.Range(func(k, v string) bool {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, KV{Key: k, Value: v})
+		}
+		return true
+	})
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, nil
+}
+
+// checkRead returns nil once this node may serve a read of the given
+// consistency.
+func (r *RaftNodeInfo) checkRead(ctx context.Context, consistency Consistency) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(ErrTimeout, err)
+	}
+	switch consistency {
+	case ConsistencyLeader:
+		if !r.IsLeader() {
+			return ErrNotLeader
+		}
+	case ConsistencyLinearizable:
+		return r.verifyRead(ctx)
+	}
+	return nil
+}
+
+// verifyRead waits until all entries committed before the call are applied
+// and checks that this node is still leader.
+func (r *RaftNodeInfo) verifyRead(ctx context.Context) error {
+	timeout, err := timeoutFromContext(ctx)
 	if err != nil {
-		r.log.Error("marshal error:", err)
 		return err
 	}
-	applyFuture := r.raft.Apply(encodeBytes, 5*time.Second)
-	if err := applyFuture.Error(); err != nil {
-		r.log.Error("raft.apply: %#v", err)
+	if err := wait(ctx, r.raft.Barrier(timeout)); err != nil {
 		return err
 	}
-	return nil
+	return wait(ctx, r.raft.VerifyLeader())
 }
 
-// Delete key from the distributed storage
-func (r *RaftNodeInfo) Delete(key string) error {
-	kv := &store.LogEntryData{
-		Op:  store.OPDel,
-		Key: key,
+func (r *RaftNodeInfo) Members(ctx context.Context) (raft.Configuration, error) {
+	confFutrue := r.raft.GetConfiguration()
+	if err := wait(ctx, confFutrue); err != nil {
+		return raft.Configuration{}, err
 	}
+	return confFutrue.Configuration(), nil
+}
 
-	encodeBytes, err := json.Marshal(&kv)
+// join cluster with leader and local addr,this runs on server side.
+func (r *RaftNodeInfo) Join(ctx context.Context, peer string) error {
+	return r.AddMember(ctx, peer, peer, true)
+}
+
+// AddMember adds a voter, or a nonvoter if voter is false.
+func (r *RaftNodeInfo) AddMember(ctx context.Context, id, address string, voter bool) error {
+	timeout, err := timeoutFromContext(ctx)
 	if err != nil {
-		r.log.Error("marshal error:%#v", err)
 		return err
 	}
-	applyFuture := r.raft.Apply(encodeBytes, 5*time.Second)
-	if err := applyFuture.Error(); err != nil {
-		r.log.Error("raft.apply: %#v", err)
+	var future raft.IndexFuture
+	if voter {
+		future = r.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(address), 0, timeout)
+	} else {
+		future = r.raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(address), 0, timeout)
+	}
+	if err := wait(ctx, future); err != nil {
+		r.log.Error("add member", "id", id, "error", err)
 		return err
 	}
 	return nil
 }
 
-// Get Key related value
-func (r *RaftNodeInfo) Get(key string) (string, bool) {
-	value, ok := r.cache.Get(key)
-	return value, ok
+// RemoveMember removes a server from the cluster.
+func (r *RaftNodeInfo) RemoveMember(ctx context.Context, id string) error {
+	timeout, err := timeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err := wait(ctx, r.raft.RemoveServer(raft.ServerID(id), 0, timeout)); err != nil {
+		r.log.Error("remove member", "id", id, "error", err)
+		return err
+	}
+	return nil
 }
 
-func (r *RaftNodeInfo) Members() raft.Configuration {
-	confFutrue := r.raft.GetConfiguration()
-	return confFutrue.Configuration()
+// PromoteMember turns a nonvoter into a voter.
+func (r *RaftNodeInfo) PromoteMember(ctx context.Context, id string) error {
+	configuration, err := r.Members(ctx)
+	if err != nil {
+		return err
+	}
+	for _, server := range configuration.Servers {
+		if server.ID == raft.ServerID(id) {
+			return r.AddMember(ctx, id, string(server.Address), true)
+		}
+	}
+	return wrapError(ErrBadRequest, fmt.Errorf("unknown member %s", id))
 }
 
-// join cluster with leader and local addr,this runs on server side.
-func (r *RaftNodeInfo) Join(peer string) error {
-	future := r.raft.AddVoter(raft.ServerID(peer), raft.ServerAddress(peer), 0, 0)
-	if err := future.Error(); err != nil {
-		r.log.Error("err", err)
+// TransferLeadership hands leadership to id, or to the most up to date
+// follower if id is empty.
+func (r *RaftNodeInfo) TransferLeadership(ctx context.Context, id string) error {
+	if id == "" {
+		return wait(ctx, r.raft.LeadershipTransfer())
+	}
+	configuration, err := r.Members(ctx)
+	if err != nil {
 		return err
 	}
+	for _, server := range configuration.Servers {
+		if server.ID == raft.ServerID(id) {
+			return wait(ctx, r.raft.LeadershipTransferToServer(server.ID, server.Address))
+		}
+	}
+	return wrapError(ErrBadRequest, fmt.Errorf("unknown member %s", id))
+}
+
+// Status returns raft state of this node.
+func (r *RaftNodeInfo) Status(ctx context.Context) Status {
+	stats := r.raft.Stats()
+	return Status{
+		State:    stats["state"],
+		Leader:   string(r.raft.Leader()),
+		IsLeader: r.IsLeader(),
+		Term:     parseStat(stats, "term"),
+		LastSnapshot: SnapshotInfo{
+			Index: parseStat(stats, "last_snapshot_index"),
+			Term:  parseStat(stats, "last_snapshot_term"),
+		},
+		ConfigurationIndex: parseStat(stats, "latest_configuration_index"),
+		Stats:              stats,
+		Store:              r.logStore.Stats(),
+		Backup:             r.backupStatus(),
+	}
+}
+
+func (r *RaftNodeInfo) backupStatus() *BackupStatus {
+	if r.backups == nil {
+		return nil
+	}
+	status := r.backups.Status()
+	return &status
+}
+
+// ScrubLogs verifies every raft log entry stored by this node, while raft
+// keeps running.
+func (r *RaftNodeInfo) ScrubLogs(ctx context.Context) (*store.ScrubReport, error) {
+	report, err := r.logStore.Scrub(ctx)
+	if err != nil {
+		return nil, toError(err)
+	}
+	if !report.OK() {
+		r.log.Error("raft log damaged", "corrupted", report.Corrupted, "missing", report.Missing, "damaged", report.Damaged)
+	}
+	return report, nil
+}
+
+// CompactLogs compacts the raft log store of this node, reclaiming the
+// space of truncated logs, while raft keeps running.
+func (r *RaftNodeInfo) CompactLogs(ctx context.Context) (*store.CompactionReport, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	report, err := r.logStore.Compact()
+	if err != nil {
+		return nil, toError(err)
+	}
+	r.log.Info("compacted raft logs", "bytes_before", report.BytesBefore, "bytes_after", report.BytesAfter, "seconds", report.Seconds)
+	return report, nil
+}
+
+// Ready returns nil if this node knows the leader, has applied the log
+// up to readyMaxLag entries behind the commit index and has its stores open.
+func (r *RaftNodeInfo) Ready(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if r.raft.State() == raft.Shutdown {
+		return errors.New("raft is shutdown")
+	}
+	if r.raft.Leader() == "" {
+		return errors.New("no known leader")
+	}
+	stats := r.raft.Stats()
+	commit, applied := parseStat(stats, "commit_index"), parseStat(stats, "applied_index")
+	if commit > applied && commit-applied > r.readyMaxLag {
+		return fmt.Errorf("applied index %d lags commit index %d", applied, commit)
+	}
+	if err := r.logStore.Ping(); err != nil {
+		return fmt.Errorf("log store: %w", err)
+	}
+	if err := r.stableStore.Ping(); err != nil {
+		return fmt.Errorf("stable store: %w", err)
+	}
 	return nil
 }
 
+// Faults returns the transport injecting network faults into raft, nil
+// unless Config.DebugFaults is set.
+func (r *RaftNodeInfo) Faults() *FaultTransport {
+	return r.faults
+}
+
 func (r *RaftNodeInfo) IsLeader() bool {
 	return ENABLE_WRITE_TRUE == atomic.LoadInt32(&r.enableWrite)
 }
@@ -123,13 +449,18 @@ func (r *RaftNodeInfo) MonitorLeadship() {
 	for {
 		select {
 		case leader := <-r.leaderNotifyCh:
+			leadershipChanges.Inc()
 			if leader {
+				isLeader.Set(1)
 				atomic.StoreInt32(&r.enableWrite, ENABLE_WRITE_TRUE)
 				r.log.Info("ms", "become leader enable write api")
 			} else {
+				isLeader.Set(0)
 				atomic.StoreInt32(&r.enableWrite, ENABLE_WRITE_FALSE)
 				r.log.Info("ms", "become follower disable write api")
 			}
+		case <-r.shutdownCh:
+			return
 		}
 	}
 }
@@ -138,25 +469,52 @@ func newTransport(raftTCPADDR string) (*raft.NetworkTransport, error) {
 	if err != nil {
 		return nil, err
 	}
-	transLayer := consul.NewRaftLayer(addr, addr, nil, nil)
+	transLayer, err := newStreamLayer(addr)
+	if err != nil {
+		return nil, err
+	}
 	return raft.NewNetworkTransport(transLayer, 3, 10*time.Second, os.Stderr), nil
 }
 
-func NewRaftNode(c *config.Config) (*RaftNodeInfo, error) {
+// snapshotsDir is the snapshot directory in the data dir, where
+// raft.FileSnapshotStore kept them too.
+const snapshotsDir = "snapshots"
+
+// defaultSnapshotRetain keeps a snapshot to fall back to.
+const defaultSnapshotRetain = 2
+
+func NewRaftNode(c *config.Config, opts ...NodeOption) (*RaftNodeInfo, error) {
+
+	o := defaultNodeOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
 
 	//raft配置
 	raftConfig := raft.DefaultConfig()
 	raftConfig.LocalID = raft.ServerID(c.RaftTCPAddr)
-	raftConfig.Logger = hclog.Default()
+	raftConfig.Logger = o.logger
 	raftConfig.SnapshotInterval = 20 * time.Second
 	raftConfig.SnapshotThreshold = 2
 	leaderNotifyCh := make(chan bool, 1)
 	raftConfig.NotifyCh = leaderNotifyCh
+	if o.raftConfig != nil {
+		o.raftConfig(raftConfig)
+	}
 
 	//transport
-	transport, err := newTransport(c.RaftTCPAddr)
-	if err != nil {
-		return nil, err
+	transport := o.transport
+	if transport == nil {
+		t, err := newTransport(c.RaftTCPAddr)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	}
+	var faults *FaultTransport
+	if c.DebugFaults {
+		faults = NewFaultTransport(transport)
+		transport = faults
 	}
 
 	//目录创建
@@ -164,27 +522,57 @@ func NewRaftNode(c *config.Config) (*RaftNodeInfo, error) {
 		return nil, err
 	}
 
+	// commands stay bare JSON, readable by nodes predating formats, unless
+	// a format is set
+	var commandFormat store.Format
+	if c.CommandFormat != "" {
+		var err error
+		if commandFormat, err = store.ParseFormat(c.CommandFormat); err != nil {
+			return nil, err
+		}
+	}
+
+	backups, err := newBackups(c, o.logger)
+	if err != nil {
+		return nil, err
+	}
+
 	//fsm
 	cache := store.NewCache()
-	fsm := store.NewFSM(cache, hclog.Default())
+	fsm := store.NewFSM(cache, o.logger, store.WithKeyProvider(o.keys))
 
 	//snapshotstore & logstore & stablestore
-	snapshotStore, err := raft.NewFileSnapshotStore(c.DataDir, 1, os.Stderr)
+	retain := c.SnapshotRetain
+	if retain == 0 {
+		retain = defaultSnapshotRetain
+	}
+	snapshotStore, err := store.NewSnapshotStore(filepath.Join(c.DataDir, snapshotsDir), retain, o.logger)
 	if err != nil {
 		return nil, err
 	}
-	logstore, err := store.NewLevelDBCommitLogStore(store.WithPath(c.DataDir))
+	logstore, stablestore, err := openStores(c, o.keys, o.logger)
 	if err != nil {
-		return nil, fmt.Errorf("new commit log %w", err)
+		return nil, err
 	}
-	stablestore, err := store.NewLevelDBStableLogStore(store.WithPath(c.DataDir))
-	if err != nil {
-		return nil, fmt.Errorf("new stable log %w", err)
+
+	closeStores := func() {
+		logstore.Close()
+		if stablestore != logstore {
+			stablestore.Close()
+		}
+	}
+
+	// recovery replays the log into an FSM the node must not use after
+	recoveryFSM := store.NewFSM(store.NewCache(), o.logger, store.WithKeyProvider(o.keys))
+	if err := recoverCluster(c.DataDir, raftConfig, recoveryFSM, logstore, stablestore, snapshotStore, transport, o.logger); err != nil {
+		closeStores()
+		return nil, err
 	}
 
 	//raftnode
 	raftNode, err := raft.NewRaft(raftConfig, fsm, logstore, stablestore, snapshotStore, transport)
 	if err != nil {
+		closeStores()
 		return nil, err
 	}
 
@@ -200,7 +588,10 @@ func NewRaftNode(c *config.Config) (*RaftNodeInfo, error) {
 		}
 		// if err := raft.BootstrapCluster(raftConfig, logstore, stablestore, snapshotStore, transport, configuration); err != nil {
 		future := raftNode.BootstrapCluster(configuration)
-		if err := future.Error(); err != nil {
+		// a restarted node already holds its configuration
+		if err := future.Error(); err != nil && err != raft.ErrCantBootstrap {
+			raftNode.Shutdown()
+			closeStores()
 			return nil, err
 		}
 	}
@@ -210,17 +601,134 @@ func NewRaftNode(c *config.Config) (*RaftNodeInfo, error) {
 		fsm:            fsm,
 		leaderNotifyCh: leaderNotifyCh,
 		cache:          cache,
-		log:            hclog.Default(),
+		log:            o.logger,
+		logStore:       logstore,
+		stableStore:    stablestore,
+		readyMaxLag:    c.ReadyMaxLag,
+		shutdownCh:     make(chan struct{}),
+		faults:         faults,
+		snapshots:      snapshotStore,
+		dataDir:        c.DataDir,
+		id:             string(raftConfig.LocalID),
+		backups:        backups,
+		commandFormat:  commandFormat,
 	}
 	go node.MonitorLeadship()
+	if backups != nil {
+		node.background.Add(1)
+		go func() {
+			defer node.background.Done()
+			backups.loop(node, node.id)
+		}()
+	}
 	return node, nil
 }
 
-func JoinCluster(c *config.Config) error {
+// openStores opens the log and stable stores of c, a single store serving
+// both in single db mode. Data dirs of the two db layout are migrated to
+// single db mode.
+func openStores(c *config.Config, keys store.KeyProvider, log hclog.Logger) (*store.LevelDBStore, *store.LevelDBStore, error) {
+	if c.RelaxedSync {
+		log.Warn("raft logs and stable keys are not fsynced, a power loss can lose acknowledged writes")
+	}
+	compression := store.CompressionNone
+	if c.LogCompression != "" {
+		var err error
+		if compression, err = store.ParseCompression(c.LogCompression); err != nil {
+			return nil, nil, err
+		}
+	}
+	format := store.FormatMsgpack
+	if c.LogFormat != "" {
+		var err error
+		if format, err = store.ParseFormat(c.LogFormat); err != nil {
+			return nil, nil, err
+		}
+	}
+	codec, err := store.CodecOf(format)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.SingleDB {
+		migrated, err := store.MigrateToSingleDB(store.WithPath(c.DataDir))
+		if err != nil {
+			return nil, nil, fmt.Errorf("migrate to single db %w", err)
+		}
+		if migrated {
+			log.Info("migrated logs and stable keys to a single db", "dir", c.DataDir)
+		}
+		db, err := store.NewLevelDBStore(store.WithPath(c.DataDir), store.WithSync(!c.RelaxedSync),
+			store.WithLogCache(c.LogCacheSize), store.WithCodec(codec), store.WithCompression(compression),
+			store.WithKeyProvider(keys), store.WithCompaction(c.LogCompactTombstones, c.LogCompactInterval))
+		if err != nil {
+			return nil, nil, fmt.Errorf("new store %w", err)
+		}
+		return db, db, nil
+	}
 
-	url := fmt.Sprintf("http://%s/join?peer=%s", c.JoinAddr, c.RaftTCPAddr)
+	logstore, err := store.NewLevelDBCommitLogStore(store.WithPath(c.DataDir), store.WithSync(!c.RelaxedSync),
+		store.WithLogCache(c.LogCacheSize), store.WithCodec(codec), store.WithCompression(compression),
+		store.WithKeyProvider(keys), store.WithCompaction(c.LogCompactTombstones, c.LogCompactInterval))
+	if err != nil {
+		return nil, nil, fmt.Errorf("new commit log %w", err)
+	}
+	stablestore, err := store.NewLevelDBStableLogStore(store.WithPath(c.DataDir), store.WithSync(!c.RelaxedSync),
+		store.WithKeyProvider(keys))
+	if err != nil {
+		logstore.Close()
+		return nil, nil, fmt.Errorf("new stable log %w", err)
+	}
+	return logstore, stablestore, nil
+}
 
-	resp, err := http.Get(url)
+// Shutdown stops raft and closes the stores of this node. Later calls
+// return the result of the first.
+func (r *RaftNodeInfo) Shutdown() error {
+	r.shutdownOnce.Do(func() {
+		r.shutdownErr = r.shutdown()
+	})
+	return r.shutdownErr
+}
+
+func (r *RaftNodeInfo) shutdown() error {
+	err := r.raft.Shutdown().Error()
+	close(r.shutdownCh)
+	r.background.Wait()
+	if cerr := r.logStore.Close(); err == nil {
+		err = cerr
+	}
+	if r.stableStore == r.logStore {
+		return err
+	}
+	if cerr := r.stableStore.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func JoinCluster(ctx context.Context, c *config.Config) error {
+
+	httpClient := http.DefaultClient
+	scheme := "http"
+	if c.TLSCertFile != "" {
+		tlsConfig, err := clientTLSConfig(c.TLSCAFile)
+		if err != nil {
+			return err
+		}
+		httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%s://%s/raft/join?peer=%s", scheme, c.JoinAddr, c.RaftTCPAddr)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if c.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AuthToken)
+	}
+	resp, err := httpClient.Do(req)
 	if resp != nil {
 		defer func() {
 			io.Copy(ioutil.Discard, resp.Body)
@@ -231,13 +739,30 @@ func JoinCluster(c *config.Config) error {
 		return err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	msg := Msg{}
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return fmt.Errorf("Error joining cluster: %w", err)
 	}
-	if string(body) != "ok" {
-		return errors.New(fmt.Sprintf("Error joining cluster %s", body))
+	if resp.StatusCode != http.StatusOK {
+		return &Error{Code: msg.Error, Message: "Error joining cluster", Err: errors.New(msg.Data)}
 	}
 
 	return nil
 }
+
+// clientTLSConfig trusts the PEM certificates in caFile, or the system roots
+// if caFile is empty.
+func clientTLSConfig(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return &tls.Config{}, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
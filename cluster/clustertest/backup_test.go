@@ -0,0 +1,88 @@
+package clustertest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/cluster/clustertest"
+	"github.com/00arthur00/leveldbraft/store"
+)
+
+func TestScheduledBackups(t *testing.T) {
+	c := clustertest.New(t, 3)
+	dir, err := ioutil.TempDir("", "leveldbraft-backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), clustertest.DefaultTimeout)
+	defer cancel()
+
+	leader := c.Leader()
+	if _, err := leader.Backup(ctx); !errors.Is(err, cluster.ErrBadRequest) {
+		t.Fatalf("Backup without a backup dir returned %v, want ErrBadRequest", err)
+	}
+
+	// a follower designated to take the backups, keeping only the newest
+	follower := c.Node((leader.Index + 1) % 3)
+	follower.Config.BackupDir = dir
+	follower.Config.BackupSchedule = "@every 1s"
+	follower.Config.BackupNode = string(follower.Addr)
+	c.Restart(follower.Index)
+	for i := 0; i < 10; i++ {
+		if err := c.Leader().Set(ctx, "key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a second backup prunes the first
+	var first string
+	var status *cluster.BackupStatus
+	for deadline := time.Now().Add(clustertest.DefaultTimeout); ; time.Sleep(100 * time.Millisecond) {
+		status = follower.Status(ctx).Backup
+		if status == nil {
+			t.Fatal("no backup status")
+		}
+		if status.Last != nil && first == "" {
+			first = status.Last.File
+		}
+		if status.Last != nil && status.Last.File != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backups did not run twice: %+v", status)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Backups != 1 || len(entries) != 2 {
+		t.Fatalf("%d backups and %d files kept, want an archive and its sidecar", status.Backups, len(entries))
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, status.Last.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != status.Last.SHA256 {
+		t.Fatalf("backup sha256 %x, sidecar says %s", sum, status.Last.SHA256)
+	}
+	meta, err := store.ReadSnapshotArchive(bytes.NewReader(b), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID != status.Last.Snapshot.ID || status.Last.Node != string(follower.Addr) {
+		t.Fatalf("backup of %s by %s, sidecar says %+v", meta.ID, follower.Addr, status.Last)
+	}
+}
@@ -0,0 +1,207 @@
+package clustertest
+
+import (
+	"sort"
+)
+
+// Operation is a call recorded in a history. Call and Return are the times
+// it was invoked and returned at, on a clock shared by all clients.
+type Operation struct {
+	ClientID int
+	Input    interface{}
+	Call     int64
+	Output   interface{}
+	Return   int64
+}
+
+// Model is the sequential specification a history is checked against.
+type Model struct {
+	// Partition splits a history into histories checked independently, for
+	// instance one per key. The whole history is checked if nil.
+	Partition func(history []Operation) [][]Operation
+	// Init returns the initial state.
+	Init func() interface{}
+	// Step reports whether output is a valid result of applying input to
+	// state, and the state after it.
+	Step func(state, input, output interface{}) (bool, interface{})
+	// Equal reports whether two states are the same.
+	Equal func(a, b interface{}) bool
+}
+
+// CheckOperations reports whether history is linearizable with respect to
+// model. If it is not, the partition that failed is returned.
+//
+// It searches for a valid linearization the way Wing & Gong's algorithm
+// does, pruning states already visited as Lowe suggests, like porcupine.
+func CheckOperations(model Model, history []Operation) (bool, []Operation) {
+	partitions := [][]Operation{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+	for _, p := range partitions {
+		if !checkSingle(model, p) {
+			return false, p
+		}
+	}
+	return true, nil
+}
+
+// entry is a call or return event of an operation. Calls point to their
+// return with match.
+type entry struct {
+	id    int
+	time  int64
+	value interface{}
+	match *entry
+
+	prev, next *entry
+}
+
+// makeEntries links the events of history ordered by time, behind a
+// sentinel head. Calls sort before returns happening at the same time.
+func makeEntries(history []Operation) *entry {
+	var entries []*entry
+	for i, op := range history {
+		ret := &entry{id: i, time: op.Return, value: op.Output}
+		call := &entry{id: i, time: op.Call, value: op.Input, match: ret}
+		entries = append(entries, call, ret)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		return entries[i].match != nil && entries[j].match == nil
+	})
+
+	head := &entry{id: -1}
+	last := head
+	for _, e := range entries {
+		last.next = e
+		e.prev = last
+		last = e
+	}
+	return head
+}
+
+// lift unlinks the call e and its return.
+func lift(e *entry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	match := e.match
+	match.prev.next = match.next
+	if match.next != nil {
+		match.next.prev = match.prev
+	}
+}
+
+// unlift links back the call e and its return removed by lift.
+func unlift(e *entry) {
+	match := e.match
+	match.prev.next = match
+	if match.next != nil {
+		match.next.prev = match
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+// bitset records the operations linearized so far.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) clone() bitset {
+	c := make(bitset, len(b))
+	copy(c, b)
+	return c
+}
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clear(i int) bitset {
+	b[i/64] &^= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(len(b))
+	for _, w := range b {
+		h = h*1099511628211 ^ w
+	}
+	return h
+}
+
+func (b bitset) equals(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+type frame struct {
+	call  *entry
+	state interface{}
+}
+
+// checkSingle searches for a linearization of history, backtracking when
+// the next event is a return whose call could not be linearized.
+func checkSingle(model Model, history []Operation) bool {
+	head := makeEntries(history)
+	linearized := newBitset(len(history))
+	cache := map[uint64][]cacheEntry{}
+	// seen adds the linearized set and state to the cache, false if they
+	// were already explored.
+	seen := func(linearized bitset, state interface{}) bool {
+		h := linearized.hash()
+		for _, c := range cache[h] {
+			if c.linearized.equals(linearized) && model.Equal(c.state, state) {
+				return true
+			}
+		}
+		cache[h] = append(cache[h], cacheEntry{linearized, state})
+		return false
+	}
+
+	var calls []frame
+	state := model.Init()
+	e := head.next
+	for head.next != nil {
+		if e.match == nil {
+			// a return: its call could not be linearized, backtrack
+			if len(calls) == 0 {
+				return false
+			}
+			top := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+			e, state = top.call, top.state
+			linearized.clear(e.id)
+			unlift(e)
+			e = e.next
+			continue
+		}
+
+		ok, next := model.Step(state, e.value, e.match.value)
+		if ok && !seen(linearized.clone().set(e.id), next) {
+			calls = append(calls, frame{e, state})
+			state = next
+			linearized.set(e.id)
+			lift(e)
+			e = head.next
+			continue
+		}
+		e = e.next
+	}
+	return true
+}
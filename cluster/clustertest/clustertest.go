@@ -0,0 +1,354 @@
+// Package clustertest runs several raft nodes in one process for
+// integration tests. Nodes talk over raft.InmemTransport and keep their
+// stores in temporary data directories, so they can be partitioned, killed
+// and restarted from disk. Every node injects the network faults set on
+// Node.Faults into its raft rpcs. Nodes encrypt their data with the shared
+// Cluster.Keys.
+package clustertest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/config"
+	"github.com/00arthur00/leveldbraft/store"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// DefaultTimeout bounds the waits of the helpers.
+var DefaultTimeout = 10 * time.Second
+
+// Node is a member of a test cluster.
+type Node struct {
+	// Index of the node in the cluster.
+	Index int
+	// Addr is both the raft server id and address of the node.
+	Addr raft.ServerAddress
+	// Config the node was started with.
+	Config config.Config
+
+	*cluster.RaftNodeInfo
+	transport *raft.InmemTransport
+	alive     bool
+}
+
+// Cluster is a set of raft nodes running in this process.
+type Cluster struct {
+	// Keys encrypt the data of every node, rotate them to test rotation.
+	Keys *store.MemKeyProvider
+
+	t     testing.TB
+	dir   string
+	log   hclog.Logger
+	nodes []*Node
+
+	mtx sync.Mutex
+	// partition group of each node, nodes only reach nodes of their group
+	groups map[int]int
+	// nextGroup is the group of the next partition, never reused
+	nextGroup int
+	// http api of the nodes, started by HTTPEndpoints
+	servers   []*httptest.Server
+	endpoints []string
+}
+
+// New starts a cluster of n voters and waits for it to elect a leader. The
+// cluster is shut down and its data removed when the test ends.
+func New(t testing.TB, n int) *Cluster {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "leveldbraft-clustertest")
+	if err != nil {
+		t.Fatalf("create data dir: %v", err)
+	}
+
+	// raft logs are discarded unless LEVELDBRAFT_TEST_LOG sets a level
+	logOpts := &hclog.LoggerOptions{Name: "clustertest", Output: ioutil.Discard}
+	if level := hclog.LevelFromString(os.Getenv("LEVELDBRAFT_TEST_LOG")); level != hclog.NoLevel {
+		logOpts.Level, logOpts.Output = level, os.Stderr
+	}
+	c := &Cluster{
+		Keys:   store.NewMemKeyProvider(),
+		t:      t,
+		dir:    dir,
+		log:    hclog.New(logOpts),
+		groups: map[int]int{},
+	}
+	t.Cleanup(c.Close)
+
+	for i := 0; i < n; i++ {
+		addr := raft.ServerAddress(fmt.Sprintf("node%d", i))
+		c.nodes = append(c.nodes, &Node{
+			Index: i,
+			Addr:  addr,
+			Config: config.Config{
+				DataDir:      filepath.Join(dir, string(addr)),
+				RaftTCPAddr:  string(addr),
+				Bootstrap:    i == 0,
+				ReadyMaxLag:  100,
+				LogCacheSize: 64,
+				DebugFaults:  true,
+				// nodes mix formats, as during a rolling upgrade
+				LogFormat:     formats[i%len(formats)],
+				CommandFormat: formats[(i+1)%len(formats)],
+			},
+		})
+	}
+
+	for _, node := range c.nodes {
+		c.start(node)
+	}
+	leader := c.WaitLeader()
+	for _, node := range c.nodes[1:] {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		err := leader.Join(ctx, string(node.Addr))
+		cancel()
+		if err != nil {
+			t.Fatalf("join %s: %v", node.Addr, err)
+		}
+	}
+	return c
+}
+
+// formats are the log and command formats given to nodes in turn, empty
+// for the default.
+var formats = []string{"", "msgpack", "json", "binary"}
+
+// start runs node from its data dir over a fresh transport.
+func (c *Cluster) start(node *Node) {
+	c.t.Helper()
+	// a peer answering an rpc after the caller timed out blocks forever on
+	// the unbuffered response channel of InmemTransport, keep the timeout
+	// far from raft's own
+	_, transport := raft.NewInmemTransportWithTimeout(node.Addr, DefaultTimeout)
+	info, err := cluster.NewRaftNode(&node.Config,
+		cluster.WithTransport(transport),
+		cluster.WithLogger(c.log.Named(string(node.Addr))),
+		cluster.WithRaftConfig(fastRaftConfig),
+		cluster.WithKeyProvider(c.Keys),
+	)
+	if err != nil {
+		c.t.Fatalf("start %s: %v", node.Addr, err)
+	}
+
+	c.mtx.Lock()
+	node.RaftNodeInfo = info
+	node.transport = transport
+	node.alive = true
+	c.mtx.Unlock()
+	c.connect()
+}
+
+// fastRaftConfig shortens raft timeouts so tests elect leaders quickly.
+func fastRaftConfig(conf *raft.Config) {
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+}
+
+// connect wires the transports of live nodes in the same partition group
+// and disconnects all others.
+func (c *Cluster) connect() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, a := range c.nodes {
+		if !a.alive {
+			continue
+		}
+		for _, b := range c.nodes {
+			if a == b {
+				continue
+			}
+			if b.alive && c.groups[a.Index] == c.groups[b.Index] {
+				a.transport.Connect(b.Addr, b.transport)
+			} else {
+				a.transport.Disconnect(b.Addr)
+			}
+		}
+	}
+}
+
+// Nodes returns all nodes, dead or alive.
+func (c *Cluster) Nodes() []*Node {
+	return c.nodes
+}
+
+// Node returns the i-th node.
+func (c *Cluster) Node(i int) *Node {
+	return c.nodes[i]
+}
+
+// Alive returns the running nodes.
+func (c *Cluster) Alive() []*Node {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var alive []*Node
+	for _, node := range c.nodes {
+		if node.alive {
+			alive = append(alive, node)
+		}
+	}
+	return alive
+}
+
+// Leader returns the live node in the leader state, nil if there is none.
+func (c *Cluster) Leader() *Node {
+	for _, node := range c.Alive() {
+		if node.Status(context.Background()).State == raft.Leader.String() {
+			return node
+		}
+	}
+	return nil
+}
+
+// WaitLeader waits until a live node is leader and returns it.
+func (c *Cluster) WaitLeader() *Node {
+	c.t.Helper()
+	var leader *Node
+	c.waitFor("a leader", func() bool {
+		leader = c.Leader()
+		return leader != nil && leader.IsLeader()
+	})
+	return leader
+}
+
+// Partition isolates the given nodes from the rest of the cluster. Nodes
+// partitioned together can still reach each other.
+func (c *Cluster) Partition(indexes ...int) {
+	c.mtx.Lock()
+	c.nextGroup++
+	group := c.nextGroup
+	for _, i := range indexes {
+		c.groups[i] = group
+	}
+	c.mtx.Unlock()
+	c.connect()
+}
+
+// Heal removes all partitions.
+func (c *Cluster) Heal() {
+	c.mtx.Lock()
+	c.groups = map[int]int{}
+	c.mtx.Unlock()
+	c.connect()
+}
+
+// Kill shuts down the i-th node, keeping its data dir.
+func (c *Cluster) Kill(i int) {
+	c.t.Helper()
+	node := c.nodes[i]
+	c.mtx.Lock()
+	if !node.alive {
+		c.mtx.Unlock()
+		return
+	}
+	node.alive = false
+	c.mtx.Unlock()
+	c.connect()
+
+	if err := node.Shutdown(); err != nil {
+		c.t.Fatalf("kill %s: %v", node.Addr, err)
+	}
+}
+
+// Restart starts the i-th node again from its data dir.
+func (c *Cluster) Restart(i int) {
+	c.t.Helper()
+	c.Kill(i)
+	node := c.nodes[i]
+	node.Config.Bootstrap = false
+	c.start(node)
+}
+
+// WaitConverged waits until all live nodes applied the same index and
+// hold the same data.
+func (c *Cluster) WaitConverged() {
+	c.t.Helper()
+	c.waitFor("converged FSMs", func() bool {
+		return c.diverged() == ""
+	})
+}
+
+// AssertConverged fails the test if the FSMs of live nodes do not converge
+// in time, reporting the first difference.
+func (c *Cluster) AssertConverged() {
+	c.t.Helper()
+	deadline := time.Now().Add(DefaultTimeout)
+	for {
+		diff := c.diverged()
+		if diff == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("FSMs did not converge: %s", diff)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// diverged describes the first difference between live nodes, empty if
+// they all applied the same index and hold the same data.
+func (c *Cluster) diverged() string {
+	ctx := context.Background()
+	alive := c.Alive()
+	if len(alive) == 0 {
+		return ""
+	}
+	first := alive[0]
+	firstStatus := first.Status(ctx)
+	firstData, err := first.List(ctx, "", cluster.ConsistencyStale)
+	if err != nil {
+		return err.Error()
+	}
+	for _, node := range alive[1:] {
+		status := node.Status(ctx)
+		if status.Stats["applied_index"] != firstStatus.Stats["applied_index"] {
+			return fmt.Sprintf("%s applied %s, %s applied %s", first.Addr, firstStatus.Stats["applied_index"],
+				node.Addr, status.Stats["applied_index"])
+		}
+		data, err := node.List(ctx, "", cluster.ConsistencyStale)
+		if err != nil {
+			return err.Error()
+		}
+		if !reflect.DeepEqual(data, firstData) {
+			return fmt.Sprintf("%s holds %v, %s holds %v", first.Addr, firstData, node.Addr, data)
+		}
+	}
+	return ""
+}
+
+// waitFor polls cond until it holds or DefaultTimeout elapses.
+func (c *Cluster) waitFor(what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(DefaultTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Close shuts down all live nodes and removes their data.
+func (c *Cluster) Close() {
+	for _, server := range c.servers {
+		server.Close()
+	}
+	for _, node := range c.Alive() {
+		c.mtx.Lock()
+		node.alive = false
+		c.mtx.Unlock()
+		node.Shutdown()
+	}
+	os.RemoveAll(c.dir)
+}
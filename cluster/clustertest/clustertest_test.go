@@ -0,0 +1,37 @@
+package clustertest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster/clustertest"
+)
+
+func TestPartitionGroups(t *testing.T) {
+	c := clustertest.New(t, 3)
+
+	// every node ends up alone, none may win an election
+	c.Partition(0, 1)
+	c.Partition(1)
+	c.Partition(2)
+	time.Sleep(300 * time.Millisecond)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		for _, node := range c.Nodes() {
+			if node.IsLeader() {
+				t.Fatalf("%s leads while every node is partitioned alone", node.Addr)
+			}
+		}
+	}
+
+	c.Heal()
+	c.WaitLeader()
+}
+
+func TestShutdownTwice(t *testing.T) {
+	c := clustertest.New(t, 1)
+	node := c.Node(0)
+	c.Kill(0)
+	if err := node.Shutdown(); err != nil {
+		t.Fatalf("second Shutdown returned %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package clustertest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/client"
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/cluster/clustertest"
+)
+
+func TestExportImport(t *testing.T) {
+	src := clustertest.New(t, 3)
+	dst := clustertest.New(t, 3)
+	from, err := client.New(src.HTTPEndpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := client.New(dst.HTTPEndpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clustertest.DefaultTimeout)
+	defer cancel()
+
+	for i := 0; i < 50; i++ {
+		if err := from.Set(ctx, "key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := from.Set(ctx, "other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	var export bytes.Buffer
+	if err := from.Export(ctx, "key", &export); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(export.String(), "\n"); lines != 50 {
+		t.Fatalf("export of prefix key holds %d lines, want 50", lines)
+	}
+
+	if err := to.Set(ctx, "key0", "existing"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a dry run counts without applying
+	p, err := to.Import(ctx, bytes.NewReader(export.Bytes()), cluster.ImportOptions{Mode: cluster.ImportSkip, DryRun: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Read != 50 || p.Applied != 49 || p.Skipped != 1 || !p.DryRun || !p.Done {
+		t.Fatalf("dry run reported %+v, want 49 applied and 1 skipped", p)
+	}
+	if _, err := to.Get(ctx, "key1"); !errors.Is(err, cluster.ErrKeyNotFound) {
+		t.Fatalf("dry run applied key1: %v", err)
+	}
+	// keys repeated in a later batch would be skipped too
+	twice := bytes.NewReader(append(export.Bytes(), export.Bytes()...))
+	p, err = to.Import(ctx, twice, cluster.ImportOptions{Mode: cluster.ImportSkip, DryRun: true, BatchSize: 16}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Read != 100 || p.Applied != 49 || p.Skipped != 51 {
+		t.Fatalf("dry run of repeated keys reported %+v, want 49 applied and 51 skipped", p)
+	}
+
+	// skip keeps existing keys
+	var reports []cluster.ImportProgress
+	opts := cluster.ImportOptions{Mode: cluster.ImportSkip, BatchSize: 16}
+	p, err = to.Import(ctx, bytes.NewReader(export.Bytes()), opts, func(p cluster.ImportProgress) {
+		reports = append(reports, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Applied != 49 || p.Skipped != 1 || p.Batches != 4 || len(reports) != 4 {
+		t.Fatalf("import reported %+v after %d reports, want 49 applied in 4 batches", p, len(reports))
+	}
+	if reports[0].Read != 16 || reports[3].Read != 50 {
+		t.Fatalf("progress reported %+v", reports)
+	}
+	if v, err := to.Get(ctx, "key0"); err != nil || v != "existing" {
+		t.Fatalf("Get key0 returned %q, %v, want existing", v, err)
+	}
+
+	// overwrite replaces them
+	p, err = to.Import(ctx, bytes.NewReader(export.Bytes()), cluster.ImportOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Applied != 50 || p.Skipped != 0 {
+		t.Fatalf("overwrite reported %+v, want 50 applied", p)
+	}
+	dst.WaitConverged()
+	kvs, err := to.List(ctx, "")
+	if err != nil || len(kvs) != 50 {
+		t.Fatalf("imported cluster holds %d keys, %v, want 50", len(kvs), err)
+	}
+	for _, kv := range kvs {
+		if want := strings.Replace(kv.Key, "key", "value", 1); kv.Value != want {
+			t.Fatalf("imported %s = %q, want %q", kv.Key, kv.Value, want)
+		}
+	}
+
+	// a bad line stops the import, keeping the batches before it, the pairs
+	// read since the last batch are not applied
+	var bad bytes.Buffer
+	enc := json.NewEncoder(&bad)
+	for i := 0; i < 2000; i++ {
+		enc.Encode(cluster.KV{Key: "bad" + strconv.Itoa(i), Value: strings.Repeat("v", 100)})
+	}
+	bad.WriteString("{not json\n")
+	p, err = to.Import(ctx, &bad, cluster.ImportOptions{BatchSize: 300}, nil)
+	if !errors.Is(err, cluster.ErrBadRequest) {
+		t.Fatalf("import of a bad line returned %v, want ErrBadRequest", err)
+	}
+	if p == nil || p.Read != 2000 || p.Applied != 1800 || p.Batches != 6 {
+		t.Fatalf("import of a bad line reported %+v, want 1800 applied", p)
+	}
+	if _, err := to.Import(ctx, strings.NewReader(`{"key":"a"}`), cluster.ImportOptions{Mode: "merge"}, nil); !errors.Is(err, cluster.ErrBadRequest) {
+		t.Fatalf("import with an unknown mode returned %v, want ErrBadRequest", err)
+	}
+	dst.WaitConverged()
+}
+
+// TestImportProgress checks progress is reported while the stream is read.
+func TestImportProgress(t *testing.T) {
+	c := clustertest.New(t, 3)
+	cl, err := client.New(c.HTTPEndpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clustertest.DefaultTimeout)
+	defer cancel()
+
+	r, w := io.Pipe()
+	reports := make(chan cluster.ImportProgress, 2)
+	done := make(chan error, 1)
+	go func() {
+		_, err := cl.Import(ctx, r, cluster.ImportOptions{BatchSize: 10}, func(p cluster.ImportProgress) {
+			reports <- p
+		})
+		done <- err
+	}()
+
+	enc := json.NewEncoder(w)
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 10; j++ {
+			enc.Encode(cluster.KV{Key: "key" + strconv.Itoa(10*i+j), Value: "value"})
+		}
+		select {
+		case p := <-reports:
+			if p.Read != 10*(i+1) || p.Applied != 10*(i+1) || p.Batches != i+1 {
+				t.Fatalf("batch %d reported %+v", i, p)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no progress reported for batch %d before the stream ends", i)
+		}
+		if v, err := cl.Get(ctx, "key"+strconv.Itoa(10*i)); err != nil || v != "value" {
+			t.Fatalf("Get of batch %d returned %q, %v", i, v, err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestImportHTTP imports through the http api as curl would: progress is
+// read from the imports of the node and a failure after batches were
+// applied answers an error status with their counts.
+func TestImportHTTP(t *testing.T) {
+	c := clustertest.New(t, 3)
+	endpoint := c.HTTPEndpoints()[c.Leader().Index]
+
+	r, w := io.Pipe()
+	type answer struct {
+		code   int
+		report cluster.ImportProgress
+		err    error
+	}
+	done := make(chan answer, 1)
+	go func() {
+		resp, err := http.Post(endpoint+"/raft/import?batch=10", "application/x-ndjson", r)
+		if err != nil {
+			done <- answer{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		a := answer{code: resp.StatusCode}
+		a.err = json.NewDecoder(resp.Body).Decode(&a.report)
+		done <- a
+	}()
+
+	imports := func() []cluster.ImportStatus {
+		resp, err := http.Get(endpoint + "/raft/imports")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var running []cluster.ImportStatus
+		if err := json.NewDecoder(resp.Body).Decode(&running); err != nil {
+			t.Fatal(err)
+		}
+		return running
+	}
+
+	enc := json.NewEncoder(w)
+	for i := 0; i < 15; i++ {
+		enc.Encode(cluster.KV{Key: "key" + strconv.Itoa(i), Value: "value"})
+	}
+	for deadline := time.Now().Add(clustertest.DefaultTimeout); ; time.Sleep(10 * time.Millisecond) {
+		running := imports()
+		if len(running) == 1 && running[0].Batches == 1 {
+			if running[0].Read != 10 || running[0].Applied != 10 {
+				t.Fatalf("import running reported %+v, want 10 read and applied", running[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("imports running %+v, want one with a batch applied", running)
+		}
+	}
+
+	w.Write([]byte("{not json\n"))
+	w.Close()
+	a := <-done
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	if a.code != http.StatusBadRequest {
+		t.Fatalf("import failing after a batch answered %d, want 400", a.code)
+	}
+	if a.report.Applied != 10 || a.report.Batches != 1 || a.report.Error == nil || a.report.Error.Error != cluster.CodeBadRequest {
+		t.Fatalf("import failing after a batch reported %+v, want 10 applied and a bad request", a.report)
+	}
+	if running := imports(); len(running) != 0 {
+		t.Fatalf("imports %+v still running", running)
+	}
+}
@@ -0,0 +1,160 @@
+package clustertest_test
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/hashicorp/raft"
+)
+
+// faultPair connects fault transports a and b over raft.InmemTransport.
+// Each answers the rpcs it receives and sends their term on its channel.
+func faultPair(t *testing.T) (a, b *cluster.FaultTransport, receivedA, receivedB chan uint64) {
+	_, innerA := raft.NewInmemTransportWithTimeout("a", time.Second)
+	_, innerB := raft.NewInmemTransportWithTimeout("b", time.Second)
+	innerA.Connect("b", innerB)
+	innerB.Connect("a", innerA)
+	a, b = cluster.NewFaultTransport(innerA), cluster.NewFaultTransport(innerB)
+	receivedA, receivedB = make(chan uint64, 1000), make(chan uint64, 1000)
+	for _, peer := range []struct {
+		transport *cluster.FaultTransport
+		received  chan uint64
+	}{{a, receivedA}, {b, receivedB}} {
+		peer := peer
+		go func() {
+			for rpc := range peer.transport.Consumer() {
+				peer.received <- rpc.Command.(*raft.AppendEntriesRequest).Term
+				rpc.Respond(&raft.AppendEntriesResponse{Success: true}, nil)
+			}
+		}()
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b, receivedA, receivedB
+}
+
+// appendEntries sends an AppendEntries carrying term from src to target.
+func appendEntries(src *cluster.FaultTransport, from, target raft.ServerAddress, term uint64) error {
+	args := &raft.AppendEntriesRequest{Term: term, Leader: src.EncodePeer(raft.ServerID(from), from)}
+	return src.AppendEntries(raft.ServerID(target), target, args, &raft.AppendEntriesResponse{})
+}
+
+func TestFaultTransportDrop(t *testing.T) {
+	a, _, _, received := faultPair(t)
+	a.SetFaults(cluster.Faults{DropRate: 1})
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := appendEntries(a, "a", "b", uint64(i)); err != cluster.ErrRPCDropped {
+			t.Fatalf("rpc %d returned %v, want ErrRPCDropped", i, err)
+		}
+	}
+	// half of the rpcs are lost after the peer handled them
+	if delivered := len(received); delivered < n/4 || delivered > 3*n/4 {
+		t.Fatalf("%d of %d dropped rpcs reached the peer, want about half", delivered, n)
+	}
+
+	a.SetFaults(cluster.Faults{})
+	if err := appendEntries(a, "a", "b", n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFaultTransportDuplicate(t *testing.T) {
+	a, _, _, received := faultPair(t)
+	a.SetFaults(cluster.Faults{DuplicateRate: 1})
+	for i := 0; i < 10; i++ {
+		if err := appendEntries(a, "a", "b", uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if first, second := <-received, <-received; first != uint64(i) || second != uint64(i) {
+			t.Fatalf("rpc %d delivered as %d and %d, want twice", i, first, second)
+		}
+	}
+	if len(received) != 0 {
+		t.Fatalf("%d extra rpcs delivered", len(received))
+	}
+}
+
+func TestFaultTransportDelay(t *testing.T) {
+	a, _, _, _ := faultPair(t)
+	delay, jitter := 20*time.Millisecond, 30*time.Millisecond
+	a.SetFaults(cluster.Faults{Delay: cluster.Duration(delay), Jitter: cluster.Duration(jitter)})
+	var durations []time.Duration
+	for i := 0; i < 10; i++ {
+		begin := time.Now()
+		if err := appendEntries(a, "a", "b", uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+		d := time.Since(begin)
+		if d < delay {
+			t.Fatalf("rpc %d took %v, want at least %v", i, d, delay)
+		}
+		durations = append(durations, d)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	if spread := durations[len(durations)-1] - durations[0]; spread < time.Millisecond {
+		t.Fatalf("rpc durations %v spread over %v, want jitter", durations, spread)
+	}
+}
+
+func TestFaultTransportReorder(t *testing.T) {
+	a, _, _, received := faultPair(t)
+	a.SetFaults(cluster.Faults{ReorderRate: 1, ReorderWindow: cluster.Duration(50 * time.Millisecond)})
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(term uint64) {
+			defer wg.Done()
+			if err := appendEntries(a, "a", "b", term); err != nil {
+				t.Error(err)
+			}
+		}(uint64(i))
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	var order []uint64
+	for i := 0; i < n; i++ {
+		order = append(order, <-received)
+	}
+	if sort.SliceIsSorted(order, func(i, j int) bool { return order[i] < order[j] }) {
+		t.Fatalf("rpcs delivered in the order sent %v, want reordered", order)
+	}
+}
+
+func TestFaultTransportPartition(t *testing.T) {
+	a, b, receivedA, receivedB := faultPair(t)
+	a.Partition("b")
+	if got := a.Faults().Partitioned; len(got) != 1 || got[0] != "b" {
+		t.Fatalf("Faults().Partitioned = %v, want [b]", got)
+	}
+	// cut in both directions: b sets no faults, a refuses its rpcs
+	if err := appendEntries(a, "a", "b", 1); err != cluster.ErrPartitioned {
+		t.Fatalf("rpc to a partitioned peer returned %v, want ErrPartitioned", err)
+	}
+	if err := appendEntries(b, "b", "a", 2); err == nil {
+		t.Fatal("rpc from a partitioned peer succeeded")
+	}
+	if len(receivedA) != 0 || len(receivedB) != 0 {
+		t.Fatalf("partitioned peers received %d and %d rpcs", len(receivedA), len(receivedB))
+	}
+
+	a.Heal()
+	if err := appendEntries(a, "a", "b", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendEntries(b, "b", "a", 4); err != nil {
+		t.Fatal(err)
+	}
+	if term := <-receivedB; term != 3 {
+		t.Fatalf("b received term %d, want 3", term)
+	}
+	if term := <-receivedA; term != 4 {
+		t.Fatalf("a received term %d, want 4", term)
+	}
+}
@@ -0,0 +1,45 @@
+package clustertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/emicklei/go-restful"
+)
+
+// HTTPEndpoints serves the http api of every node on loopback and returns
+// their URLs, in node order. Requests to a killed node have their
+// connection closed, as if the node was unreachable.
+func (c *Cluster) HTTPEndpoints() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.endpoints != nil {
+		return c.endpoints
+	}
+	for _, node := range c.nodes {
+		node := node
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			c.mtx.Lock()
+			alive, info := node.alive, node.RaftNodeInfo
+			c.mtx.Unlock()
+			if !alive {
+				if hj, ok := w.(http.Hijacker); ok {
+					if conn, _, err := hj.Hijack(); err == nil {
+						conn.Close()
+						return
+					}
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			container := restful.NewContainer()
+			container.Add(cluster.NewWebService(info, c.log))
+			container.Add(cluster.NewHealthService(info, c.log))
+			container.ServeHTTP(w, req)
+		}))
+		c.servers = append(c.servers, server)
+		c.endpoints = append(c.endpoints, server.URL)
+	}
+	return c.endpoints
+}
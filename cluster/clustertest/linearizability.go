@@ -0,0 +1,356 @@
+package clustertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/store"
+)
+
+// KVInput is the input of an operation of KVModel.
+type KVInput struct {
+	Op    store.OP
+	Key   string
+	Value string
+	Prev  string
+}
+
+// KVOutput is the output of an operation of KVModel.
+type KVOutput struct {
+	// Value and Exists are the result of a get.
+	Value  string
+	Exists bool
+	// Swapped is the result of a cas.
+	Swapped bool
+	// Unknown marks a write whose outcome is unknown, it may or may not
+	// have been applied.
+	Unknown bool
+}
+
+// kvState is the value of a single key.
+type kvState struct {
+	value  string
+	exists bool
+}
+
+// KVModel specifies the key/value store: gets, sets, deletes and cas on
+// independent keys.
+var KVModel = Model{
+	Partition: func(history []Operation) [][]Operation {
+		byKey := map[string][]Operation{}
+		var keys []string
+		for _, op := range history {
+			key := op.Input.(KVInput).Key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		partitions := make([][]Operation, 0, len(keys))
+		for _, key := range keys {
+			partitions = append(partitions, byKey[key])
+		}
+		return partitions
+	},
+	Init: func() interface{} {
+		return kvState{}
+	},
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		s, in, out := state.(kvState), input.(KVInput), output.(KVOutput)
+		switch in.Op {
+		case opGet:
+			return out.Exists == s.exists && out.Value == s.value, s
+		case store.OPSet:
+			return true, kvState{in.Value, true}
+		case store.OPDel:
+			return true, kvState{}
+		case store.OPCAS:
+			swap := s.exists && s.value == in.Prev
+			if !out.Unknown && out.Swapped != swap {
+				return false, s
+			}
+			if swap {
+				return true, kvState{in.Value, true}
+			}
+			return true, s
+		}
+		return false, s
+	},
+	Equal: func(a, b interface{}) bool {
+		return a == b
+	},
+}
+
+// opGet is the read of KVModel, reads are not raft log operations.
+const opGet store.OP = "get"
+
+// LinearizabilityOptions tunes CheckLinearizability.
+type LinearizabilityOptions struct {
+	// Nodes in the cluster, 3 if zero.
+	Nodes int
+	// Clients issuing operations concurrently, 5 if zero.
+	Clients int
+	// Keys the clients operate on, 3 if zero. Fewer keys make more
+	// conflicting operations.
+	Keys int
+	// Duration of the workload, 5s if zero.
+	Duration time.Duration
+	// FaultInterval is how long each fault lasts and the pause between
+	// faults, 300ms if zero.
+	FaultInterval time.Duration
+	// Seed of the operation and fault picks, random if zero.
+	Seed int64
+}
+
+func (o *LinearizabilityOptions) setDefaults() {
+	if o.Nodes == 0 {
+		o.Nodes = 3
+	}
+	if o.Clients == 0 {
+		o.Clients = 5
+	}
+	if o.Keys == 0 {
+		o.Keys = 3
+	}
+	if o.Duration == 0 {
+		o.Duration = 5 * time.Second
+	}
+	if o.FaultInterval == 0 {
+		o.FaultInterval = 300 * time.Millisecond
+	}
+	if o.Seed == 0 {
+		o.Seed = time.Now().UnixNano()
+	}
+}
+
+// CheckLinearizability starts a cluster and drives concurrent clients
+// issuing linearizable gets, sets, deletes and cas against random nodes,
+// while the leader is killed, partitioned away, nodes restart and rpcs are
+// dropped, duplicated and reordered. The recorded history is then checked
+// against KVModel.
+func CheckLinearizability(t testing.TB, opts LinearizabilityOptions) {
+	t.Helper()
+	opts.setDefaults()
+	t.Logf("seed %d, %d nodes, %d clients, %d keys, for %s", opts.Seed, opts.Nodes, opts.Clients, opts.Keys, opts.Duration)
+
+	c := New(t, opts.Nodes)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	histories := make([][]Operation, opts.Clients)
+	for i := 0; i < opts.Clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			w := &worker{
+				id:      id,
+				cluster: c,
+				rng:     rand.New(rand.NewSource(opts.Seed + int64(id) + 1)),
+				keys:    opts.Keys,
+				start:   start,
+			}
+			histories[id] = w.run(ctx)
+		}(i)
+	}
+	c.injectFaults(ctx, rand.New(rand.NewSource(opts.Seed)), opts.FaultInterval)
+	wg.Wait()
+
+	c.Heal()
+	for _, node := range c.Nodes() {
+		if _, alive := c.instance(node.Index); !alive {
+			c.Restart(node.Index)
+		}
+	}
+	c.AssertConverged()
+
+	var history []Operation
+	for _, h := range histories {
+		history = append(history, h...)
+	}
+	t.Logf("checking %d operations", len(history))
+	if ok, ops := CheckOperations(KVModel, history); !ok {
+		t.Fatalf("history is not linearizable:\n%s", formatHistory(ops))
+	}
+}
+
+// injectFaults kills, partitions and restarts nodes and makes the network
+// flaky until ctx is done, healing each fault before the next one.
+func (c *Cluster) injectFaults(ctx context.Context, rng *rand.Rand, interval time.Duration) {
+	c.t.Helper()
+	sleep := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(interval):
+			return true
+		}
+	}
+	for sleep() {
+		leader := c.Leader()
+		if leader == nil {
+			continue
+		}
+		switch rng.Intn(4) {
+		case 0:
+			c.t.Logf("kill leader %s", leader.Addr)
+			c.Kill(leader.Index)
+			sleep()
+			c.Restart(leader.Index)
+		case 1:
+			c.t.Logf("partition leader %s", leader.Addr)
+			c.Partition(leader.Index)
+			sleep()
+			c.Heal()
+		case 2:
+			i := rng.Intn(len(c.nodes))
+			c.t.Logf("restart %s", c.nodes[i].Addr)
+			c.Restart(i)
+		case 3:
+			c.t.Logf("flaky network")
+			faults := cluster.Faults{
+				DropRate:      0.1,
+				Jitter:        cluster.Duration(interval / 20),
+				DuplicateRate: 0.1,
+				ReorderRate:   0.1,
+				ReorderWindow: cluster.Duration(interval / 10),
+			}
+			for _, node := range c.Alive() {
+				node.Faults().SetFaults(faults)
+			}
+			sleep()
+			for _, node := range c.Alive() {
+				node.Faults().SetFaults(cluster.Faults{})
+			}
+		}
+	}
+}
+
+// instance returns the running instance of the i-th node, which changes
+// when it restarts.
+func (c *Cluster) instance(i int) (*cluster.RaftNodeInfo, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	node := c.nodes[i]
+	return node.RaftNodeInfo, node.alive
+}
+
+// worker is a client of CheckLinearizability.
+type worker struct {
+	id      int
+	cluster *Cluster
+	rng     *rand.Rand
+	keys    int
+	start   time.Time
+	// node the last operation succeeded on, most likely the leader
+	node int
+}
+
+// run issues operations until ctx is done and returns their history.
+// Operations that surely failed are left out, writes that may have been
+// applied are kept with an unknown outcome.
+func (w *worker) run(ctx context.Context) []Operation {
+	var history []Operation
+	for ctx.Err() == nil {
+		node, alive := w.cluster.instance(w.node)
+		if !alive {
+			w.node = w.rng.Intn(len(w.cluster.nodes))
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		in := w.input()
+		call := w.now()
+		out, err := w.do(node, in)
+		op := Operation{ClientID: w.id, Input: in, Call: call, Output: out, Return: w.now()}
+		if err != nil {
+			w.node = w.rng.Intn(len(w.cluster.nodes))
+		}
+		switch {
+		case err == nil:
+			history = append(history, op)
+		case errors.Is(err, cluster.ErrNotLeader), errors.Is(err, cluster.ErrTimeout):
+			// not handed to raft by this node
+		case in.Op != opGet:
+			op.Output = KVOutput{Unknown: true}
+			op.Return = math.MaxInt64
+			history = append(history, op)
+		}
+	}
+	return history
+}
+
+// input picks the next operation.
+func (w *worker) input() KVInput {
+	in := KVInput{
+		Key:   fmt.Sprintf("key%d", w.rng.Intn(w.keys)),
+		Value: fmt.Sprintf("%d", w.rng.Intn(10)),
+		Prev:  fmt.Sprintf("%d", w.rng.Intn(10)),
+	}
+	switch n := w.rng.Intn(10); {
+	case n < 4:
+		in.Op = opGet
+	case n < 7:
+		in.Op = store.OPSet
+	case n < 8:
+		in.Op = store.OPDel
+	default:
+		in.Op = store.OPCAS
+	}
+	return in
+}
+
+// do runs in on node. Conflicting cas and absent keys are results, not
+// errors.
+func (w *worker) do(node cluster.Node, in KVInput) (KVOutput, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	switch in.Op {
+	case opGet:
+		value, err := node.Get(ctx, in.Key, cluster.ConsistencyLinearizable)
+		if errors.Is(err, cluster.ErrKeyNotFound) {
+			return KVOutput{}, nil
+		}
+		return KVOutput{Value: value, Exists: err == nil}, err
+	case store.OPSet:
+		return KVOutput{}, node.Set(ctx, in.Key, in.Value)
+	case store.OPDel:
+		return KVOutput{}, node.Delete(ctx, in.Key)
+	}
+	err := node.CompareAndSwap(ctx, in.Key, in.Prev, in.Value)
+	if errors.Is(err, cluster.ErrConflict) {
+		return KVOutput{}, nil
+	}
+	return KVOutput{Swapped: err == nil}, err
+}
+
+func (w *worker) now() int64 {
+	return int64(time.Since(w.start))
+}
+
+// formatHistory prints ops in call order, one per line.
+func formatHistory(ops []Operation) string {
+	ops = append([]Operation(nil), ops...)
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Call < ops[j].Call
+	})
+	var b strings.Builder
+	for _, op := range ops {
+		ret := "?"
+		if op.Return != math.MaxInt64 {
+			ret = time.Duration(op.Return).String()
+		}
+		fmt.Fprintf(&b, "client %d [%s, %s] %+v -> %+v\n", op.ClientID, time.Duration(op.Call), ret, op.Input, op.Output)
+	}
+	return b.String()
+}
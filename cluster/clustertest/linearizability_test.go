@@ -0,0 +1,19 @@
+package clustertest_test
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster/clustertest"
+)
+
+var linearizabilityDuration = flag.Duration("linearizability.duration", 5*time.Second, "how long TestLinearizability drives the cluster")
+
+func TestLinearizability(t *testing.T) {
+	duration := *linearizabilityDuration
+	if testing.Short() {
+		duration = time.Second
+	}
+	clustertest.CheckLinearizability(t, clustertest.LinearizabilityOptions{Duration: duration})
+}
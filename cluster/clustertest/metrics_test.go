@@ -0,0 +1,55 @@
+package clustertest_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/emicklei/go-restful"
+)
+
+func TestMetricsToken(t *testing.T) {
+	c := restful.NewContainer()
+	c.Add(cluster.NewMetricsService())
+	c.Filter(cluster.MetricsFilter)
+	c.Filter(cluster.TokenFilter("secret"))
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// as prometheus scrapes
+		req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.code {
+			t.Fatalf("token %q: status %d, want %d", tc.token, resp.StatusCode, tc.code)
+		}
+		if tc.code == http.StatusOK && !strings.Contains(string(body), "leveldbraft_http_requests_total") {
+			t.Fatalf("metrics do not hold the http requests:\n%s", body)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package clustertest_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/cluster/clustertest"
+	"github.com/hashicorp/raft"
+)
+
+func TestRecoverLostQuorum(t *testing.T) {
+	c := clustertest.New(t, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), clustertest.DefaultTimeout)
+	defer cancel()
+
+	leader := c.Leader()
+	for i := 0; i < 20; i++ {
+		if err := leader.Set(ctx, "key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.WaitConverged()
+
+	// lose the leader and another node for good
+	survivor := c.Node((leader.Index + 1) % 3)
+	for _, node := range c.Nodes() {
+		if node != survivor {
+			c.Kill(node.Index)
+		}
+	}
+	stuck, cancelStuck := context.WithTimeout(ctx, 500*time.Millisecond)
+	err := survivor.Set(stuck, "stuck", "value")
+	cancelStuck()
+	if err == nil {
+		t.Fatal("Set succeeded without a quorum")
+	}
+
+	peers := fmt.Sprintf(`[{"id": %q, "address": %q, "non_voter": false}]`, survivor.Addr, survivor.Addr)
+	path := filepath.Join(survivor.Config.DataDir, cluster.PeersFile)
+	if err := ioutil.WriteFile(path, []byte(peers), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.Restart(survivor.Index)
+	if got := c.WaitLeader(); got != survivor {
+		t.Fatalf("%s leads after recovery, want %s", got.Addr, survivor.Addr)
+	}
+
+	configuration, err := survivor.Members(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []raft.Server{{Suffrage: raft.Voter, ID: raft.ServerID(survivor.Addr), Address: survivor.Addr}}
+	if len(configuration.Servers) != 1 || configuration.Servers[0] != want[0] {
+		t.Fatalf("recovered configuration %v, want %v", configuration.Servers, want)
+	}
+	kvs, err := survivor.List(ctx, "", cluster.ConsistencyLeader)
+	if err != nil || len(kvs) != 20 {
+		t.Fatalf("recovered node holds %d keys, %v, want 20", len(kvs), err)
+	}
+	if err := survivor.Set(ctx, "after", "recovery"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is set aside, a restart does not recover again
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("recovery file left in place: %v", err)
+	}
+	if _, err := os.Stat(path + ".recovered"); err != nil {
+		t.Fatal(err)
+	}
+	c.Restart(survivor.Index)
+	c.WaitLeader()
+	if v, err := survivor.Get(ctx, "after", cluster.ConsistencyLeader); err != nil || v != "recovery" {
+		t.Fatalf("Get after restart returned %q, %v", v, err)
+	}
+}
@@ -0,0 +1,84 @@
+package clustertest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster"
+)
+
+func TestParseSchedule(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	// 2026-01-01 is a thursday
+	for _, tc := range []struct {
+		schedule   string
+		from, want time.Time
+	}{
+		// runs strictly after from
+		{"30 10 * * *", date(2026, 1, 1, 10, 30), date(2026, 1, 2, 10, 30)},
+		// ranges
+		{"0 9-17 * * 1-5", date(2026, 1, 2, 12, 30), date(2026, 1, 2, 13, 0)},
+		{"0 9-17 * * 1-5", date(2026, 1, 2, 17, 30), date(2026, 1, 5, 9, 0)},
+		// steps over *, a range and from a value
+		{"*/15 * * * *", date(2026, 1, 1, 10, 7), date(2026, 1, 1, 10, 15)},
+		{"5-20/5 * * * *", date(2026, 1, 1, 10, 20), date(2026, 1, 1, 11, 5)},
+		{"10/20 * * * *", date(2026, 1, 1, 10, 30), date(2026, 1, 1, 10, 50)},
+		// lists
+		{"0 0 1,15 * *", date(2026, 1, 2, 0, 0), date(2026, 1, 15, 0, 0)},
+		{"0 6,18 * * *", date(2026, 1, 1, 7, 0), date(2026, 1, 1, 18, 0)},
+		// both day fields restricted: either matches
+		{"0 0 13 * 5", date(2026, 1, 1, 0, 0), date(2026, 1, 2, 0, 0)},
+		{"0 0 13 * 5", date(2026, 1, 9, 0, 0), date(2026, 1, 13, 0, 0)},
+		// a day field starting with * leaves the other one alone
+		{"0 0 */2 * 5", date(2026, 1, 1, 0, 0), date(2026, 1, 9, 0, 0)},
+		{"0 0 13 * */7", date(2026, 1, 1, 0, 0), date(2026, 9, 13, 0, 0)},
+		// 7 is sunday, as 0
+		{"0 0 * * 7", date(2026, 1, 1, 0, 0), date(2026, 1, 4, 0, 0)},
+		{"0 0 * * 0", date(2026, 1, 1, 0, 0), date(2026, 1, 4, 0, 0)},
+		// month and year rollover
+		{"0 0 1 * *", date(2026, 1, 31, 12, 0), date(2026, 2, 1, 0, 0)},
+		{"0 0 1 1 *", date(2026, 12, 15, 0, 0), date(2027, 1, 1, 0, 0)},
+		{"59 23 31 12 *", date(2026, 12, 31, 23, 59), date(2027, 12, 31, 23, 59)},
+		{"0 0 31 * *", date(2026, 4, 1, 0, 0), date(2026, 5, 31, 0, 0)},
+		{"0 0 29 2 *", date(2026, 3, 1, 0, 0), date(2028, 2, 29, 0, 0)},
+		// shorthands
+		{"@hourly", date(2026, 1, 1, 10, 7), date(2026, 1, 1, 11, 0)},
+		{"@daily", date(2026, 1, 1, 10, 7), date(2026, 1, 2, 0, 0)},
+		{"@every 1h", date(2026, 1, 1, 10, 7), date(2026, 1, 1, 11, 0)},
+	} {
+		s, err := cluster.ParseSchedule(tc.schedule)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tc.schedule, err)
+			continue
+		}
+		if got := s.Next(tc.from); !got.Equal(tc.want) {
+			t.Errorf("%q after %v: got %v, want %v", tc.schedule, tc.from, got, tc.want)
+		}
+	}
+
+	for _, schedule := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1- * * * *",
+		"@every 10ms",
+		"@every often",
+		// never runs
+		"0 0 30 2 *",
+		"0 0 31 4 *",
+	} {
+		if _, err := cluster.ParseSchedule(schedule); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", schedule)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package clustertest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/00arthur00/leveldbraft/client"
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/cluster/clustertest"
+)
+
+func TestSnapshotSaveRestore(t *testing.T) {
+	c := clustertest.New(t, 3)
+	endpoints := c.HTTPEndpoints()
+	cl, err := client.New(endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clustertest.DefaultTimeout)
+	defer cancel()
+
+	if err := cl.Set(ctx, "key", "saved"); err != nil {
+		t.Fatal(err)
+	}
+	leader, err := cl.Leader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := cl.TakeSnapshot(ctx, leader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := cl.Snapshots(ctx, leader)
+	if err != nil || len(infos) == 0 || infos[0].ID != info.ID || infos[0].Configuration == nil {
+		t.Fatalf("Snapshots returned %+v, %v, want %s first", infos, err, info.ID)
+	}
+	var archive bytes.Buffer
+	if err := cl.SaveSnapshot(ctx, leader, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cl.Set(ctx, "key", "overwritten"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Set(ctx, "other", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a damaged archive is rejected before raft sees it
+	damaged := append([]byte(nil), archive.Bytes()...)
+	damaged[len(damaged)/2] ^= 1
+	if _, err := cl.RestoreSnapshot(ctx, bytes.NewReader(damaged)); !errors.Is(err, cluster.ErrBadRequest) {
+		t.Fatalf("RestoreSnapshot of a damaged archive returned %v, want ErrBadRequest", err)
+	}
+	if _, err := cl.RestoreSnapshot(ctx, &archive); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitConverged()
+	for _, node := range c.Nodes() {
+		kvs, err := node.List(ctx, "", cluster.ConsistencyStale)
+		if err != nil || len(kvs) != 1 || kvs[0].Value != "saved" {
+			t.Fatalf("%s holds %v, %v after restore, want key=saved", node.Addr, kvs, err)
+		}
+	}
+}
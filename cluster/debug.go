@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	restfulspec "github.com/emicklei/go-restful-openapi"
+	"github.com/hashicorp/go-hclog"
+)
+
+type faultResource struct {
+	transport *FaultTransport
+	log       hclog.Logger
+}
+
+// NewFaultService returns debug endpoints injecting network faults into the
+// raft transport of a node. It must only be served on debug builds or test
+// clusters.
+func NewFaultService(t *FaultTransport, log hclog.Logger) *restful.WebService {
+	r := &faultResource{transport: t, log: log}
+	ws := &restful.WebService{}
+	tags := []string{"debug"}
+
+	ws.Path("/debug/faults").Consumes(restful.MIME_JSON).Produces(restful.MIME_JSON)
+
+	ws.Route(ws.GET("").To(r.get).
+		Doc("faults injected into the raft transport").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(Faults{}).
+		Returns(http.StatusOK, "ok", Faults{}))
+
+	ws.Route(ws.PUT("").To(r.set).
+		Doc("replace the faults injected into the raft transport").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Reads(Faults{}, "faults to inject").
+		Writes(Faults{}).
+		Returns(http.StatusOK, "ok", Faults{}).
+		Returns(http.StatusBadRequest, "bad request", nil))
+
+	ws.Route(ws.DELETE("").To(r.clear).
+		Doc("stop injecting faults and heal partitions").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(Msg{}).
+		Returns(http.StatusOK, "ok", nil))
+
+	return ws
+}
+
+func (r *faultResource) get(req *restful.Request, resp *restful.Response) {
+	resp.WriteHeaderAndEntity(http.StatusOK, r.transport.Faults())
+}
+
+func (r *faultResource) set(req *restful.Request, resp *restful.Response) {
+	faults := Faults{}
+	if err := req.ReadEntity(&faults); err != nil {
+		writeError(resp, wrapError(ErrBadRequest, err))
+		return
+	}
+	for _, rate := range []float64{faults.DropRate, faults.DuplicateRate, faults.ReorderRate} {
+		if rate < 0 || rate > 1 {
+			writeError(resp, &Error{Code: CodeBadRequest, Message: "rates must be between 0 and 1"})
+			return
+		}
+	}
+	if faults.Delay < 0 || faults.Jitter < 0 || faults.ReorderWindow < 0 {
+		writeError(resp, &Error{Code: CodeBadRequest, Message: "durations must not be negative"})
+		return
+	}
+	r.log.Warn("injecting raft transport faults", "faults", faults)
+	r.transport.SetFaults(faults)
+	resp.WriteHeaderAndEntity(http.StatusOK, r.transport.Faults())
+}
+
+func (r *faultResource) clear(req *restful.Request, resp *restful.Response) {
+	r.log.Warn("cleared raft transport faults")
+	r.transport.SetFaults(Faults{})
+	resp.WriteHeaderAndEntity(http.StatusOK, codeToMsg(http.StatusOK))
+}
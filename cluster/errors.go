@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/hashicorp/raft"
+)
+
+// ErrorCode is a machine-readable error identifier returned to clients.
+type ErrorCode string
+
+const (
+	CodeNotLeader      ErrorCode = "not_leader"
+	CodeKeyNotFound    ErrorCode = "key_not_found"
+	CodeTimeout        ErrorCode = "timeout"
+	CodeOutcomeUnknown ErrorCode = "outcome_unknown"
+	CodeConflict       ErrorCode = "conflict"
+	CodeQuotaExceeded  ErrorCode = "quota_exceeded"
+	CodeUnauthorized   ErrorCode = "unauthorized"
+	CodeShutdown       ErrorCode = "raft_shutdown"
+	CodeBadRequest     ErrorCode = "bad_request"
+	CodeNoSnapshot     ErrorCode = "no_snapshot"
+	CodeInternal       ErrorCode = "internal"
+)
+
+// Error is an error carrying a machine-readable code. Errors with the same
+// code match each other with errors.Is.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Err     error
+}
+
+var (
+	ErrNotLeader   = &Error{Code: CodeNotLeader, Message: "node is not the leader"}
+	ErrKeyNotFound = &Error{Code: CodeKeyNotFound, Message: "key not found"}
+	ErrTimeout     = &Error{Code: CodeTimeout, Message: "timed out"}
+	// ErrOutcomeUnknown is returned when the caller gave up after a command
+	// was handed to raft: it may or may not have been committed.
+	ErrOutcomeUnknown = &Error{Code: CodeOutcomeUnknown, Message: "outcome unknown"}
+	ErrConflict       = &Error{Code: CodeConflict, Message: "conflict"}
+	ErrQuotaExceeded  = &Error{Code: CodeQuotaExceeded, Message: "quota exceeded"}
+	ErrUnauthorized   = &Error{Code: CodeUnauthorized, Message: "unauthorized"}
+	ErrShutdown       = &Error{Code: CodeShutdown, Message: "raft is shutdown"}
+	ErrBadRequest     = &Error{Code: CodeBadRequest, Message: "bad request"}
+	ErrNoSnapshot     = &Error{Code: CodeNoSnapshot, Message: "no snapshot"}
+)
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an *Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// wrapError returns a copy of kind carrying err as its cause.
+func wrapError(kind *Error, err error) *Error {
+	return &Error{Code: kind.Code, Message: kind.Message, Err: err}
+}
+
+// toError converts errors returned by raft into typed errors.
+func toError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	switch err {
+	case raft.ErrNotLeader, raft.ErrLeadershipTransferInProgress:
+		return wrapError(ErrNotLeader, err)
+	case raft.ErrLeadershipLost:
+		return wrapError(ErrOutcomeUnknown, err)
+	case raft.ErrEnqueueTimeout:
+		return wrapError(ErrTimeout, err)
+	case raft.ErrRaftShutdown:
+		return wrapError(ErrShutdown, err)
+	case raft.ErrNothingNewToSnapshot:
+		return wrapError(ErrConflict, err)
+	}
+	return &Error{Code: CodeInternal, Message: "internal error", Err: err}
+}
+
+// httpStatus maps an error code to its HTTP status.
+func httpStatus(code ErrorCode) int {
+	switch code {
+	case CodeNotLeader, CodeShutdown:
+		return http.StatusServiceUnavailable
+	case CodeKeyNotFound, CodeNoSnapshot:
+		return http.StatusNotFound
+	case CodeTimeout, CodeOutcomeUnknown:
+		return http.StatusGatewayTimeout
+	case CodeConflict:
+		return http.StatusConflict
+	case CodeQuotaExceeded:
+		return http.StatusTooManyRequests
+	case CodeUnauthorized:
+		return http.StatusUnauthorized
+	case CodeBadRequest:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// errorToMsg turns err into a response body and its HTTP status.
+func errorToMsg(err error) (int, *Msg) {
+	var e *Error
+	if !errors.As(toError(err), &e) {
+		e = &Error{Code: CodeInternal, Message: "internal error", Err: err}
+	}
+	status := httpStatus(e.Code)
+	return status, &Msg{
+		Code:    status,
+		Error:   e.Code,
+		Message: http.StatusText(status),
+		Data:    e.Error(),
+	}
+}
@@ -0,0 +1,241 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/store"
+)
+
+// Exports and imports are NDJSON streams of KV, one pair per line. The FSM
+// keeps no revisions, so pairs carry none.
+
+// ImportMode tells what an import does with keys that already exist.
+type ImportMode string
+
+const (
+	// ImportOverwrite sets every key imported.
+	ImportOverwrite ImportMode = "overwrite"
+	// ImportSkip leaves existing keys as they are.
+	ImportSkip ImportMode = "skip"
+)
+
+const (
+	// DefaultImportBatch is the number of pairs of a batch if unset.
+	DefaultImportBatch = 256
+	// MaxImportBatch is the max number of pairs of a batch.
+	MaxImportBatch = 4096
+	// MaxImportBatchBytes bounds the keys and values of a batch, keeping
+	// raft entries small.
+	MaxImportBatchBytes = 1 << 20
+)
+
+// ImportOptions configure an import.
+type ImportOptions struct {
+	// Mode is ImportOverwrite if empty.
+	Mode ImportMode
+	// DryRun reads and validates the stream and counts the pairs that
+	// would be applied and skipped, without applying them.
+	DryRun bool
+	// BatchSize is the max number of pairs applied in one raft entry,
+	// 256 if 0.
+	BatchSize int
+}
+
+// ImportProgress counts the pairs of an import. Done is set once the
+// whole stream is imported.
+type ImportProgress struct {
+	// Read is the number of pairs read from the stream.
+	Read    int  `json:"read"`
+	Applied int  `json:"applied"`
+	Skipped int  `json:"skipped"`
+	Batches int  `json:"batches"`
+	DryRun  bool `json:"dry_run,omitempty"`
+	Done    bool `json:"done,omitempty"`
+	// Error is set in the report of an import failing after batches were
+	// applied, which stay applied.
+	Error *Msg `json:"error,omitempty"`
+}
+
+// ImportStatus is the progress of an import running on a node.
+type ImportStatus struct {
+	ID      uint64    `json:"id"`
+	Started time.Time `json:"started"`
+	ImportProgress
+}
+
+// importTracker holds the progress of the imports running on a node.
+type importTracker struct {
+	mtx     sync.Mutex
+	lastID  uint64
+	running map[uint64]*ImportStatus
+}
+
+// start registers an import and returns its id.
+func (t *importTracker) start(dryRun bool) uint64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.running == nil {
+		t.running = map[uint64]*ImportStatus{}
+	}
+	t.lastID++
+	t.running[t.lastID] = &ImportStatus{ID: t.lastID, Started: time.Now(), ImportProgress: ImportProgress{DryRun: dryRun}}
+	return t.lastID
+}
+
+func (t *importTracker) update(id uint64, p ImportProgress) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if status, ok := t.running[id]; ok {
+		status.ImportProgress = p
+	}
+}
+
+func (t *importTracker) finish(id uint64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.running, id)
+}
+
+// list returns the imports running, oldest first.
+func (t *importTracker) list() []ImportStatus {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	imports := []ImportStatus{}
+	for _, status := range t.running {
+		imports = append(imports, *status)
+	}
+	sort.Slice(imports, func(i, j int) bool { return imports[i].ID < imports[j].ID })
+	return imports
+}
+
+// Import loads a stream of NDJSON pairs through raft in batches, which
+// are atomic, calling progress after each. It runs on the leader and
+// stops at the first invalid line, keeping the batches applied before.
+func (r *RaftNodeInfo) Import(ctx context.Context, in io.Reader, opts ImportOptions, progress func(ImportProgress)) (*ImportProgress, error) {
+	if !r.IsLeader() {
+		return nil, ErrNotLeader
+	}
+	if opts.Mode == "" {
+		opts.Mode = ImportOverwrite
+	}
+	if opts.Mode != ImportOverwrite && opts.Mode != ImportSkip {
+		return nil, wrapError(ErrBadRequest, fmt.Errorf("unknown import mode %q", opts.Mode))
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = DefaultImportBatch
+	}
+	if opts.BatchSize < 0 || opts.BatchSize > MaxImportBatch {
+		return nil, wrapError(ErrBadRequest, fmt.Errorf("batch size %d out of 1-%d", opts.BatchSize, MaxImportBatch))
+	}
+	op := store.OPSet
+	if opts.Mode == ImportSkip {
+		op = store.OPAdd
+	}
+
+	id := r.imports.start(opts.DryRun)
+	defer r.imports.finish(id)
+	p := &ImportProgress{DryRun: opts.DryRun}
+	// keys of a dry run, which skips the keys it would have added
+	var seen map[string]bool
+	if opts.DryRun && opts.Mode == ImportSkip {
+		seen = map[string]bool{}
+	}
+	var batch []store.LogEntryData
+	size := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if opts.DryRun {
+			for _, cmd := range batch {
+				if seen != nil {
+					if _, exists := r.cache.Get(cmd.Key); exists || seen[cmd.Key] {
+						p.Skipped++
+						continue
+					}
+					seen[cmd.Key] = true
+				}
+				p.Applied++
+			}
+		} else {
+			result, err := r.applyBatch(ctx, batch)
+			if err != nil {
+				return err
+			}
+			p.Applied += result.Applied
+			p.Skipped += result.Skipped
+		}
+		p.Batches++
+		batch, size = batch[:0], 0
+		r.imports.update(id, *p)
+		if progress != nil {
+			progress(*p)
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(in))
+	for {
+		var kv KV
+		err := dec.Decode(&kv)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return p, wrapError(ErrBadRequest, fmt.Errorf("pair %d: %v", p.Read+1, err))
+		}
+		if kv.Key == "" {
+			return p, wrapError(ErrBadRequest, fmt.Errorf("pair %d: empty key", p.Read+1))
+		}
+		p.Read++
+		if len(batch) > 0 && size+len(kv.Key)+len(kv.Value) > MaxImportBatchBytes {
+			if err := flush(); err != nil {
+				return p, err
+			}
+		}
+		batch = append(batch, store.LogEntryData{Op: op, Key: kv.Key, Value: kv.Value})
+		size += len(kv.Key) + len(kv.Value)
+		if len(batch) == opts.BatchSize {
+			if err := flush(); err != nil {
+				return p, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return p, err
+	}
+	p.Done = true
+	r.log.Info("imported pairs", "read", p.Read, "applied", p.Applied, "skipped", p.Skipped, "dry_run", p.DryRun)
+	return p, nil
+}
+
+// Imports returns the progress of the imports running on this node.
+func (r *RaftNodeInfo) Imports() []ImportStatus {
+	return r.imports.list()
+}
+
+// applyBatch applies cmds as one raft entry.
+func (r *RaftNodeInfo) applyBatch(ctx context.Context, cmds []store.LogEntryData) (*store.BatchResult, error) {
+	cmd := &store.LogEntryData{Op: store.OPBatch, Batch: cmds}
+	b, err := r.encodeCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	response, err := r.apply(ctx, cmd.Op, b)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := response.(*store.BatchResult)
+	if !ok {
+		return nil, errors.New("batch applied without a result")
+	}
+	return result, nil
+}
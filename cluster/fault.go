@@ -0,0 +1,302 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var (
+	// ErrRPCDropped is returned for rpcs dropped by a FaultTransport.
+	ErrRPCDropped = errors.New("fault: rpc dropped")
+	// ErrPartitioned is returned for rpcs from or to a partitioned peer.
+	ErrPartitioned = errors.New("fault: peer partitioned")
+)
+
+// Duration is a time.Duration encoded as a string like "150ms" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Faults are the network failures injected by a FaultTransport. Rates are
+// probabilities between 0 and 1, the zero value injects nothing.
+type Faults struct {
+	// DropRate is the probability an outgoing rpc is lost, half of the
+	// time before the peer handled it and half of the time after.
+	DropRate float64 `json:"drop_rate"`
+	// Delay and a random Jitter are added before every outgoing rpc.
+	Delay  Duration `json:"delay"`
+	Jitter Duration `json:"jitter"`
+	// DuplicateRate is the probability an outgoing rpc is sent twice.
+	DuplicateRate float64 `json:"duplicate_rate"`
+	// ReorderRate is the probability an outgoing rpc is held up to
+	// ReorderWindow longer, letting rpcs sent after it overtake it.
+	ReorderRate   float64  `json:"reorder_rate"`
+	ReorderWindow Duration `json:"reorder_window"`
+	// Partitioned peers can neither be reached nor reach this node.
+	Partitioned []raft.ServerAddress `json:"partitioned"`
+}
+
+// FaultTransport wraps a raft.Transport to drop, delay, duplicate or
+// reorder rpcs and to partition peers. Pipelined replication is disabled so
+// every AppendEntries goes through the faults.
+type FaultTransport struct {
+	raft.Transport
+
+	mtx         sync.Mutex
+	faults      Faults
+	partitioned map[raft.ServerAddress]bool
+	rng         *rand.Rand
+
+	consumeCh  chan raft.RPC
+	shutdownCh chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewFaultTransport wraps inner, injecting no faults until SetFaults.
+func NewFaultTransport(inner raft.Transport) *FaultTransport {
+	f := &FaultTransport{
+		Transport:   inner,
+		partitioned: map[raft.ServerAddress]bool{},
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		consumeCh:   make(chan raft.RPC),
+		shutdownCh:  make(chan struct{}),
+	}
+	go f.forward()
+	return f
+}
+
+// Faults returns the faults being injected.
+func (f *FaultTransport) Faults() Faults {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	faults := f.faults
+	faults.Partitioned = append([]raft.ServerAddress(nil), f.faults.Partitioned...)
+	return faults
+}
+
+// SetFaults replaces the faults being injected.
+func (f *FaultTransport) SetFaults(faults Faults) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.faults = faults
+	f.partitioned = map[raft.ServerAddress]bool{}
+	for _, peer := range faults.Partitioned {
+		f.partitioned[peer] = true
+	}
+}
+
+// Partition cuts this node off from peers, in both directions.
+func (f *FaultTransport) Partition(peers ...raft.ServerAddress) {
+	faults := f.Faults()
+	faults.Partitioned = append(faults.Partitioned, peers...)
+	f.SetFaults(faults)
+}
+
+// Heal reconnects all partitioned peers.
+func (f *FaultTransport) Heal() {
+	faults := f.Faults()
+	faults.Partitioned = nil
+	f.SetFaults(faults)
+}
+
+// Consumer implements raft.Transport, filtering out rpcs of partitioned
+// peers.
+func (f *FaultTransport) Consumer() <-chan raft.RPC {
+	return f.consumeCh
+}
+
+// forward passes the rpcs received by the inner transport to Consumer.
+func (f *FaultTransport) forward() {
+	for {
+		select {
+		case rpc := <-f.Transport.Consumer():
+			if f.reject(rpc) {
+				continue
+			}
+			select {
+			case f.consumeCh <- rpc:
+			case <-f.shutdownCh:
+				return
+			}
+		case <-f.shutdownCh:
+			return
+		}
+	}
+}
+
+// SetHeartbeatHandler implements raft.Transport, filtering out heartbeats
+// of partitioned peers.
+func (f *FaultTransport) SetHeartbeatHandler(cb func(rpc raft.RPC)) {
+	if cb == nil {
+		f.Transport.SetHeartbeatHandler(nil)
+		return
+	}
+	f.Transport.SetHeartbeatHandler(func(rpc raft.RPC) {
+		if !f.reject(rpc) {
+			cb(rpc)
+		}
+	})
+}
+
+// reject answers rpc with ErrPartitioned if it comes from a partitioned
+// peer.
+func (f *FaultTransport) reject(rpc raft.RPC) bool {
+	var source []byte
+	var resp interface{}
+	switch cmd := rpc.Command.(type) {
+	case *raft.AppendEntriesRequest:
+		source, resp = cmd.Leader, &raft.AppendEntriesResponse{}
+	case *raft.RequestVoteRequest:
+		source, resp = cmd.Candidate, &raft.RequestVoteResponse{}
+	case *raft.InstallSnapshotRequest:
+		source, resp = cmd.Leader, &raft.InstallSnapshotResponse{}
+	default:
+		// TimeoutNow does not carry its sender, the leader filters it
+		return false
+	}
+
+	f.mtx.Lock()
+	partitioned := f.partitioned[f.DecodePeer(source)]
+	f.mtx.Unlock()
+	if !partitioned {
+		return false
+	}
+	transportFaults.WithLabelValues("partition").Inc()
+	if rpc.Reader != nil {
+		io.Copy(ioutil.Discard, rpc.Reader)
+	}
+	rpc.Respond(resp, ErrPartitioned)
+	return true
+}
+
+// AppendEntriesPipeline implements raft.Transport, always falling back to
+// AppendEntries.
+func (f *FaultTransport) AppendEntriesPipeline(id raft.ServerID, target raft.ServerAddress) (raft.AppendPipeline, error) {
+	return nil, raft.ErrPipelineReplicationNotSupported
+}
+
+// AppendEntries implements raft.Transport.
+func (f *FaultTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	return f.inject(target, func(duplicate bool) error {
+		if duplicate {
+			return f.Transport.AppendEntries(id, target, args, &raft.AppendEntriesResponse{})
+		}
+		return f.Transport.AppendEntries(id, target, args, resp)
+	})
+}
+
+// RequestVote implements raft.Transport.
+func (f *FaultTransport) RequestVote(id raft.ServerID, target raft.ServerAddress, args *raft.RequestVoteRequest, resp *raft.RequestVoteResponse) error {
+	return f.inject(target, func(duplicate bool) error {
+		if duplicate {
+			return f.Transport.RequestVote(id, target, args, &raft.RequestVoteResponse{})
+		}
+		return f.Transport.RequestVote(id, target, args, resp)
+	})
+}
+
+// InstallSnapshot implements raft.Transport. Snapshots are never
+// duplicated as data can only be read once.
+func (f *FaultTransport) InstallSnapshot(id raft.ServerID, target raft.ServerAddress, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
+	return f.inject(target, func(duplicate bool) error {
+		if duplicate {
+			return nil
+		}
+		return f.Transport.InstallSnapshot(id, target, args, resp, data)
+	})
+}
+
+// TimeoutNow implements raft.Transport.
+func (f *FaultTransport) TimeoutNow(id raft.ServerID, target raft.ServerAddress, args *raft.TimeoutNowRequest, resp *raft.TimeoutNowResponse) error {
+	return f.inject(target, func(duplicate bool) error {
+		if duplicate {
+			return f.Transport.TimeoutNow(id, target, args, &raft.TimeoutNowResponse{})
+		}
+		return f.Transport.TimeoutNow(id, target, args, resp)
+	})
+}
+
+// Close implements raft.WithClose, closing the inner transport if it can.
+func (f *FaultTransport) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.shutdownCh)
+	})
+	if closer, ok := f.Transport.(raft.WithClose); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// inject sends an rpc to target through the faults. send is called with
+// duplicate set for the extra copy of a duplicated rpc.
+func (f *FaultTransport) inject(target raft.ServerAddress, send func(duplicate bool) error) error {
+	f.mtx.Lock()
+	faults, partitioned := f.faults, f.partitioned[target]
+	drop := f.roll(faults.DropRate)
+	dropResponse := f.rng.Intn(2) == 0
+	duplicate := f.roll(faults.DuplicateRate)
+	delay := time.Duration(faults.Delay)
+	if faults.Jitter > 0 {
+		delay += time.Duration(f.rng.Int63n(int64(faults.Jitter)))
+	}
+	if f.roll(faults.ReorderRate) && faults.ReorderWindow > 0 {
+		transportFaults.WithLabelValues("reorder").Inc()
+		delay += time.Duration(f.rng.Int63n(int64(faults.ReorderWindow)))
+	}
+	f.mtx.Unlock()
+
+	if partitioned {
+		transportFaults.WithLabelValues("partition").Inc()
+		return ErrPartitioned
+	}
+	if drop && !dropResponse {
+		transportFaults.WithLabelValues("drop_request").Inc()
+		return ErrRPCDropped
+	}
+	if delay > 0 {
+		transportFaults.WithLabelValues("delay").Inc()
+		select {
+		case <-time.After(delay):
+		case <-f.shutdownCh:
+			return raft.ErrTransportShutdown
+		}
+	}
+	if duplicate {
+		transportFaults.WithLabelValues("duplicate").Inc()
+		// the copy is sent first so the original response is kept
+		send(true)
+	}
+	err := send(false)
+	if drop && err == nil {
+		transportFaults.WithLabelValues("drop_response").Inc()
+		return ErrRPCDropped
+	}
+	return err
+}
+
+// roll returns true with probability rate, f.mtx must be held.
+func (f *FaultTransport) roll(rate float64) bool {
+	return rate > 0 && f.rng.Float64() < rate
+}
@@ -0,0 +1,80 @@
+package cluster
+
+import (
+	"net/http"
+
+	"github.com/00arthur00/leveldbraft/store"
+	"github.com/emicklei/go-restful"
+	restfulspec "github.com/emicklei/go-restful-openapi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// Status is the raft state of a node.
+type Status struct {
+	State              string            `json:"state"`
+	Leader             string            `json:"leader"`
+	IsLeader           bool              `json:"is_leader"`
+	Term               uint64            `json:"term"`
+	LastSnapshot       SnapshotInfo      `json:"last_snapshot"`
+	ConfigurationIndex uint64            `json:"configuration_index"`
+	Stats              map[string]string `json:"stats"`
+	// Store are the statistics of the raft log store.
+	Store store.Stats `json:"store"`
+	// Backup is the state of the scheduled backups, if configured.
+	Backup *BackupStatus `json:"backup,omitempty"`
+}
+
+// SnapshotInfo identifies a raft snapshot. The status only gives its
+// index and term.
+type SnapshotInfo struct {
+	ID                 string              `json:"id,omitempty"`
+	Version            int                 `json:"version,omitempty"`
+	Index              uint64              `json:"index"`
+	Term               uint64              `json:"term"`
+	Size               int64               `json:"size,omitempty"`
+	Configuration      *raft.Configuration `json:"configuration,omitempty"`
+	ConfigurationIndex uint64              `json:"configuration_index,omitempty"`
+}
+
+// NewHealthService returns liveness and readiness probes for node.
+func NewHealthService(node Node, log hclog.Logger) *restful.WebService {
+	r := newResouce(node, log)
+	ws := &restful.WebService{}
+	tags := []string{"health"}
+
+	ws.Path("/health").Produces(restful.MIME_JSON)
+
+	ws.Route(ws.GET("/live").To(r.live).
+		Doc("liveness probe").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(Msg{}).
+		Returns(http.StatusOK, "ok", nil))
+
+	ws.Route(ws.GET("/ready").To(r.ready).
+		Doc("readiness probe: known leader, applied index caught up and stores open").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(Msg{}).
+		Returns(http.StatusOK, "ok", nil).
+		Returns(http.StatusServiceUnavailable, "not ready", nil))
+
+	return ws
+}
+
+func (r *resource) live(req *restful.Request, resp *restful.Response) {
+	resp.WriteHeaderAndEntity(http.StatusOK, codeToMsg(http.StatusOK))
+}
+
+func (r *resource) ready(req *restful.Request, resp *restful.Response) {
+	if err := r.raft.Ready(req.Request.Context()); err != nil {
+		msg := codeToMsg(http.StatusServiceUnavailable)
+		msg.Data = err.Error()
+		resp.WriteHeaderAndEntity(http.StatusServiceUnavailable, msg)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, codeToMsg(http.StatusOK))
+}
+
+func (r *resource) status(req *restful.Request, resp *restful.Response) {
+	resp.WriteHeaderAndEntity(http.StatusOK, r.raft.Status(req.Request.Context()))
+}
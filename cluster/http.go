@@ -1,22 +1,34 @@
 package cluster
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/00arthur00/leveldbraft/store"
 	"github.com/emicklei/go-restful"
 	restfulspec "github.com/emicklei/go-restful-openapi"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 )
 
+const mimeOctetStream = "application/octet-stream"
+
+// mimeNDJSON is the type of exports and imports, one JSON value per line.
+const mimeNDJSON = "application/x-ndjson"
+
 type resource struct {
 	raft Node
 	log  hclog.Logger
 }
 type Msg struct {
-	Code    int    `json:"code"`
-	Data    string `json:"data"`
-	Message string `json"message"`
+	Code    int       `json:"code"`
+	Error   ErrorCode `json:"error,omitempty"`
+	Data    string    `json:"data"`
+	Message string    `json:"message"`
 }
 
 type KV struct {
@@ -24,6 +36,20 @@ type KV struct {
 	Value string `json:"value"`
 }
 
+// CAS sets Key to Value if it holds Prev.
+type CAS struct {
+	Key   string `json:"key"`
+	Prev  string `json:"prev"`
+	Value string `json:"value"`
+}
+
+// Member is a server to add to the cluster.
+type Member struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+}
+
 func newResouce(raft Node, log hclog.Logger) *resource {
 	return &resource{raft, log}
 }
@@ -32,15 +58,27 @@ func NewWebService(node Node, log hclog.Logger) *restful.WebService {
 	ws := &restful.WebService{}
 	tags := []string{"raft leveldb"}
 
-	ws.Path("/raft").Consumes(restful.MIME_JSON).Consumes(restful.MIME_JSON)
+	ws.Path("/raft").Consumes(restful.MIME_JSON).Produces(restful.MIME_JSON)
 
 	ws.Route(ws.GET("/kv/{key}").To(r.get).
 		Doc("get value of key").
 		Metadata(restfulspec.KeyOpenAPITags, tags).
 		Param(ws.PathParameter("key", "key").DataType("string")).
+		Param(ws.QueryParameter("consistency", "stale, leader or linearizable").DataType("string").DefaultValue(string(ConsistencyStale))).
 		Writes(Msg{}).
 		Returns(http.StatusOK, "ok", "").
 		Returns(http.StatusBadRequest, "bad request", nil).
+		Returns(http.StatusNotFound, "key not found", nil).
+		Returns(http.StatusInternalServerError, "internal error", nil))
+
+	ws.Route(ws.GET("/kv").To(r.list).
+		Doc("list key/value pairs").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.QueryParameter("prefix", "key prefix").DataType("string")).
+		Param(ws.QueryParameter("consistency", "stale, leader or linearizable").DataType("string").DefaultValue(string(ConsistencyStale))).
+		Writes([]KV{}).
+		Returns(http.StatusOK, "ok", []KV{}).
+		Returns(http.StatusBadRequest, "bad request", nil).
 		Returns(http.StatusInternalServerError, "internal error", nil))
 
 	ws.Route(ws.DELETE("/kv/{key}").To(r.delete).
@@ -59,7 +97,21 @@ func NewWebService(node Node, log hclog.Logger) *restful.WebService {
 		Writes(Msg{}).
 		Returns(http.StatusOK, "ok", nil).
 		Returns(http.StatusBadRequest, "bad request", nil).
-		Returns(http.StatusInternalServerError, "internal error", nil))
+		Returns(http.StatusInternalServerError, "internal error", nil).
+		Returns(http.StatusServiceUnavailable, "not leader", nil).
+		Returns(http.StatusGatewayTimeout, "apply timeout", nil))
+
+	ws.Route(ws.POST("/kv/cas").To(r.cas).
+		Doc("set key/value if the key holds prev").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Reads(CAS{}, "expected and new value").
+		Writes(Msg{}).
+		Returns(http.StatusOK, "ok", nil).
+		Returns(http.StatusBadRequest, "bad request", nil).
+		Returns(http.StatusConflict, "key absent or holds another value", nil).
+		Returns(http.StatusInternalServerError, "internal error", nil).
+		Returns(http.StatusServiceUnavailable, "not leader", nil).
+		Returns(http.StatusGatewayTimeout, "apply timeout", nil))
 
 	ws.Route(ws.GET("/join").To(r.join).
 		Doc("join the cluster").
@@ -77,44 +129,193 @@ func NewWebService(node Node, log hclog.Logger) *restful.WebService {
 		Returns(http.StatusBadRequest, "bad request", nil).
 		Returns(http.StatusInternalServerError, "internal error", nil))
 
+	ws.Route(ws.PUT("/members").To(r.addMember).
+		Doc("add a voter or nonvoter to the cluster").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Reads(Member{}, "member to add").
+		Writes(Msg{}).
+		Returns(http.StatusOK, "ok", nil).
+		Returns(http.StatusBadRequest, "bad request", nil).
+		Returns(http.StatusServiceUnavailable, "not leader", nil))
+
+	ws.Route(ws.DELETE("/members/{id}").To(r.removeMember).
+		Doc("remove a member from the cluster").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter("id", "server id").DataType("string")).
+		Writes(Msg{}).
+		Returns(http.StatusOK, "ok", nil).
+		Returns(http.StatusServiceUnavailable, "not leader", nil))
+
+	ws.Route(ws.POST("/members/{id}/promote").To(r.promoteMember).
+		Doc("promote a nonvoter to voter").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter("id", "server id").DataType("string")).
+		Writes(Msg{}).
+		Returns(http.StatusOK, "ok", nil).
+		Returns(http.StatusBadRequest, "bad request", nil).
+		Returns(http.StatusServiceUnavailable, "not leader", nil))
+
+	ws.Route(ws.POST("/leader/transfer").To(r.transferLeadership).
+		Doc("transfer leadership to another member").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.QueryParameter("id", "target server id, any up to date follower if empty").DataType("string")).
+		Writes(Msg{}).
+		Returns(http.StatusOK, "ok", nil).
+		Returns(http.StatusServiceUnavailable, "not leader", nil))
+
+	ws.Route(ws.POST("/scrub").To(r.scrub).
+		Doc("verify the checksums of every raft log entry of this node").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(store.ScrubReport{}).
+		Returns(http.StatusOK, "ok", store.ScrubReport{}))
+
+	ws.Route(ws.POST("/compact").To(r.compact).
+		Doc("compact the raft log store of this node, reclaiming the space of truncated logs").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(store.CompactionReport{}).
+		Returns(http.StatusOK, "ok", store.CompactionReport{}))
+
+	ws.Route(ws.POST("/snapshot").To(r.takeSnapshot).
+		Doc("snapshot the fsm of this node now").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(SnapshotInfo{}).
+		Returns(http.StatusOK, "ok", SnapshotInfo{}).
+		Returns(http.StatusConflict, "nothing new to snapshot", nil))
+
+	ws.Route(ws.GET("/snapshots").To(r.listSnapshots).
+		Doc("list the snapshots of this node, newest first").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes([]SnapshotInfo{}).
+		Returns(http.StatusOK, "ok", []SnapshotInfo{}))
+
+	ws.Route(ws.GET("/snapshots/latest").To(r.downloadSnapshot).
+		Doc("download the archive of the latest snapshot of this node").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		// errors are JSON
+		Produces(restful.MIME_JSON, mimeOctetStream).
+		Returns(http.StatusOK, "ok", nil).
+		Returns(http.StatusNotFound, "no snapshot", nil))
+
+	ws.Route(ws.POST("/snapshots/restore").To(r.restoreSnapshot).
+		Doc("restore the cluster from an uploaded snapshot archive, on the leader").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Consumes(mimeOctetStream).
+		Writes(SnapshotInfo{}).
+		Returns(http.StatusOK, "ok", SnapshotInfo{}).
+		Returns(http.StatusBadRequest, "invalid archive", nil).
+		Returns(http.StatusServiceUnavailable, "not leader", nil))
+
+	ws.Route(ws.GET("/export").To(r.export).
+		Doc("stream the key/value pairs as NDJSON, one consistent view").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.QueryParameter("prefix", "key prefix").DataType("string")).
+		Param(ws.QueryParameter("consistency", "stale, leader or linearizable").DataType("string").DefaultValue(string(ConsistencyStale))).
+		// errors are JSON
+		Produces(restful.MIME_JSON, mimeNDJSON).
+		Returns(http.StatusOK, "ok", nil).
+		Returns(http.StatusBadRequest, "bad request", nil).
+		Returns(http.StatusServiceUnavailable, "not leader", nil))
+
+	ws.Route(ws.POST("/import").To(r.importPairs).
+		Doc("load an NDJSON stream of key/value pairs through raft in batches, on the leader, reporting the counts once the stream is read").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.QueryParameter("mode", "overwrite or skip existing keys").DataType("string").DefaultValue(string(ImportOverwrite))).
+		Param(ws.QueryParameter("dry_run", "validate and count without applying").DataType("boolean").DefaultValue("false")).
+		Param(ws.QueryParameter("batch", "max pairs per raft entry").DataType("integer").DefaultValue(strconv.Itoa(DefaultImportBatch))).
+		Consumes(mimeNDJSON).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusOK, "ok", ImportProgress{}).
+		Returns(http.StatusBadRequest, "invalid pair or options, the counts of the batches applied before it", ImportProgress{}).
+		Returns(http.StatusServiceUnavailable, "not leader", nil))
+
+	ws.Route(ws.GET("/imports").To(r.listImports).
+		Doc("progress of the imports running on this node").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes([]ImportStatus{}).
+		Returns(http.StatusOK, "ok", []ImportStatus{}))
+
+	ws.Route(ws.GET("/status").To(r.status).
+		Doc("get raft status of this node").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(Status{}).
+		Returns(http.StatusOK, "ok", Status{}))
+
 	return ws
 }
 
 func (r *resource) get(req *restful.Request, resp *restful.Response) {
 	key := req.PathParameter("key")
 	if key == "" {
-		resp.WriteHeaderAndEntity(http.StatusBadRequest, codeToMsg(http.StatusBadRequest))
+		writeError(resp, ErrBadRequest)
 		return
 	}
 
-	value, ok := r.raft.Get(key)
-	if !ok {
-		msg := codeToMsg(http.StatusBadRequest)
-		resp.WriteHeaderAndEntity(http.StatusBadRequest, msg)
+	consistency, err := readConsistency(req)
+	if err != nil {
+		writeError(resp, err)
 		return
 	}
-	resp.WriteHeaderAndEntity(http.StatusOK, &Msg{
-		Code:    http.StatusOK,
-		Message: http.StatusText(http.StatusOK),
-		Data:    value,
-	})
+
+	value, err := r.raft.Get(req.Request.Context(), key, consistency)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	msg := codeToMsg(http.StatusOK)
+	msg.Data = value
+	resp.WriteHeaderAndEntity(http.StatusOK, msg)
+}
+
+func (r *resource) list(req *restful.Request, resp *restful.Response) {
+	consistency, err := readConsistency(req)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+
+	kvs, err := r.raft.List(req.Request.Context(), req.QueryParameter("prefix"), consistency)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, kvs)
 }
 
 func (r *resource) set(req *restful.Request, resp *restful.Response) {
 	if !r.raft.IsLeader() {
 		r.log.Error("http write to follower")
-		resp.WriteHeaderAndEntity(http.StatusBadRequest, codeToMsg(http.StatusBadRequest))
+		writeError(resp, ErrNotLeader)
 		return
 	}
 
 	kv := KV{}
 	if err := req.ReadEntity(&kv); err != nil {
-		resp.WriteHeaderAndEntity(http.StatusBadRequest, codeToMsg(http.StatusBadRequest))
+		writeError(resp, wrapError(ErrBadRequest, err))
+		return
+	}
+
+	if err := r.raft.Set(req.Request.Context(), kv.Key, kv.Value); err != nil {
+		writeError(resp, err)
+		return
+	}
+
+	resp.WriteHeaderAndEntity(http.StatusOK, codeToMsg(http.StatusOK))
+}
+
+func (r *resource) cas(req *restful.Request, resp *restful.Response) {
+	if !r.raft.IsLeader() {
+		writeError(resp, ErrNotLeader)
 		return
 	}
 
-	if err := r.raft.Set(kv.Key, kv.Value); err != nil {
-		resp.WriteHeaderAndEntity(http.StatusInternalServerError, codeToMsg(http.StatusInternalServerError))
+	cas := CAS{}
+	if err := req.ReadEntity(&cas); err != nil {
+		writeError(resp, wrapError(ErrBadRequest, err))
+		return
+	}
+
+	if err := r.raft.CompareAndSwap(req.Request.Context(), cas.Key, cas.Prev, cas.Value); err != nil {
+		writeError(resp, err)
 		return
 	}
 
@@ -124,12 +325,12 @@ func (r *resource) set(req *restful.Request, resp *restful.Response) {
 func (r *resource) delete(req *restful.Request, resp *restful.Response) {
 	key := req.PathParameter("key")
 	if key == "" {
-		resp.WriteHeaderAndEntity(http.StatusBadRequest, codeToMsg(http.StatusBadRequest))
+		writeError(resp, ErrBadRequest)
 		return
 	}
 
-	if err := r.raft.Delete(key); err != nil {
-		resp.WriteHeaderAndEntity(http.StatusInternalServerError, codeToMsg(http.StatusInternalServerError))
+	if err := r.raft.Delete(req.Request.Context(), key); err != nil {
+		writeError(resp, err)
 		return
 	}
 
@@ -138,25 +339,208 @@ func (r *resource) delete(req *restful.Request, resp *restful.Response) {
 
 func (r *resource) join(req *restful.Request, resp *restful.Response) {
 	if !r.raft.IsLeader() {
-		resp.WriteHeaderAndEntity(http.StatusBadRequest, &Msg{
-			Code:    http.StatusBadRequest,
-			Message: http.StatusText(http.StatusBadRequest),
-			Data:    "cannot join to a non-leader portal",
-		})
+		writeError(resp, wrapError(ErrNotLeader, errors.New("cannot join to a non-leader portal")))
+		return
 	}
 	addr := req.QueryParameter("peer")
 	if addr == "" {
 		r.log.Error("error", "invalid peer addr")
-		resp.WriteHeaderAndEntity(http.StatusBadRequest, codeToMsg(http.StatusBadRequest))
+		writeError(resp, wrapError(ErrBadRequest, errors.New("invalid peer addr")))
 		return
 	}
-	if err := r.raft.Join(addr); err != nil {
-		resp.WriteHeaderAndEntity(http.StatusInternalServerError, codeToMsg(http.StatusInternalServerError))
+	if err := r.raft.Join(req.Request.Context(), addr); err != nil {
+		writeError(resp, err)
 		return
 	}
 	resp.WriteHeaderAndEntity(http.StatusOK, codeToMsg(http.StatusOK))
 }
 
 func (r *resource) members(req *restful.Request, resp *restful.Response) {
+	configuration, err := r.raft.Members(req.Request.Context())
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, configuration)
+}
+
+func (r *resource) addMember(req *restful.Request, resp *restful.Response) {
+	m := Member{}
+	if err := req.ReadEntity(&m); err != nil {
+		writeError(resp, wrapError(ErrBadRequest, err))
+		return
+	}
+	if m.ID == "" || m.Address == "" {
+		writeError(resp, wrapError(ErrBadRequest, errors.New("id and address are required")))
+		return
+	}
+	if err := r.raft.AddMember(req.Request.Context(), m.ID, m.Address, m.Voter); err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, codeToMsg(http.StatusOK))
+}
+
+func (r *resource) removeMember(req *restful.Request, resp *restful.Response) {
+	if err := r.raft.RemoveMember(req.Request.Context(), req.PathParameter("id")); err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, codeToMsg(http.StatusOK))
+}
+
+func (r *resource) promoteMember(req *restful.Request, resp *restful.Response) {
+	if err := r.raft.PromoteMember(req.Request.Context(), req.PathParameter("id")); err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, codeToMsg(http.StatusOK))
+}
+
+func (r *resource) transferLeadership(req *restful.Request, resp *restful.Response) {
+	if err := r.raft.TransferLeadership(req.Request.Context(), req.QueryParameter("id")); err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, codeToMsg(http.StatusOK))
+}
+
+func (r *resource) scrub(req *restful.Request, resp *restful.Response) {
+	report, err := r.raft.ScrubLogs(req.Request.Context())
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, report)
+}
+
+func (r *resource) compact(req *restful.Request, resp *restful.Response) {
+	report, err := r.raft.CompactLogs(req.Request.Context())
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, report)
+}
 
+func (r *resource) takeSnapshot(req *restful.Request, resp *restful.Response) {
+	meta, err := r.raft.TakeSnapshot(req.Request.Context())
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, NewSnapshotInfo(meta))
+}
+
+func (r *resource) listSnapshots(req *restful.Request, resp *restful.Response) {
+	metas, err := r.raft.Snapshots(req.Request.Context())
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	infos := make([]SnapshotInfo, 0, len(metas))
+	for _, meta := range metas {
+		infos = append(infos, NewSnapshotInfo(meta))
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, infos)
+}
+
+func (r *resource) downloadSnapshot(req *restful.Request, resp *restful.Response) {
+	meta, rc, err := r.raft.OpenSnapshot(req.Request.Context())
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	defer rc.Close()
+	resp.AddHeader("Content-Type", mimeOctetStream)
+	resp.AddHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", meta.ID+".snap"))
+	resp.WriteHeader(http.StatusOK)
+	// the status is sent, a failure only shows as a truncated archive
+	if err := store.WriteSnapshotArchive(resp, meta, rc); err != nil {
+		r.log.Error("download snapshot", "id", meta.ID, "error", err)
+	}
+}
+
+func (r *resource) restoreSnapshot(req *restful.Request, resp *restful.Response) {
+	meta, err := r.raft.RestoreSnapshot(req.Request.Context(), req.Request.Body)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, NewSnapshotInfo(meta))
+}
+
+func (r *resource) export(req *restful.Request, resp *restful.Response) {
+	consistency, err := readConsistency(req)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	kvs, err := r.raft.List(req.Request.Context(), req.QueryParameter("prefix"), consistency)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.AddHeader("Content-Type", mimeNDJSON)
+	resp.WriteHeader(http.StatusOK)
+	w := bufio.NewWriter(resp)
+	enc := json.NewEncoder(w)
+	for _, kv := range kvs {
+		if err := enc.Encode(kv); err != nil {
+			r.log.Error("export", "error", err)
+			return
+		}
+	}
+	if err := w.Flush(); err != nil {
+		r.log.Error("export", "error", err)
+	}
+}
+
+func (r *resource) importPairs(req *restful.Request, resp *restful.Response) {
+	opts := ImportOptions{Mode: ImportMode(req.QueryParameter("mode"))}
+	var err error
+	if v := req.QueryParameter("dry_run"); v != "" {
+		if opts.DryRun, err = strconv.ParseBool(v); err != nil {
+			writeError(resp, wrapError(ErrBadRequest, err))
+			return
+		}
+	}
+	if v := req.QueryParameter("batch"); v != "" {
+		if opts.BatchSize, err = strconv.Atoi(v); err != nil {
+			writeError(resp, wrapError(ErrBadRequest, err))
+			return
+		}
+	}
+
+	p, err := r.raft.Import(req.Request.Context(), req.Request.Body, opts, func(p ImportProgress) {
+		r.log.Debug("import progress", "read", p.Read, "applied", p.Applied, "skipped", p.Skipped)
+	})
+	if err != nil && (p == nil || p.Batches == 0) {
+		writeError(resp, err)
+		return
+	}
+	if err != nil {
+		// the batches applied before the error stay applied
+		status, msg := errorToMsg(err)
+		p.Error = msg
+		resp.WriteHeaderAndEntity(status, p)
+		return
+	}
+	resp.WriteHeaderAndEntity(http.StatusOK, p)
+}
+
+func (r *resource) listImports(req *restful.Request, resp *restful.Response) {
+	resp.WriteHeaderAndEntity(http.StatusOK, r.raft.Imports())
+}
+
+// readConsistency returns the consistency query parameter, stale by default.
+func readConsistency(req *restful.Request) (Consistency, error) {
+	consistency := Consistency(req.QueryParameter("consistency"))
+	switch consistency {
+	case "":
+		return ConsistencyStale, nil
+	case ConsistencyStale, ConsistencyLeader, ConsistencyLinearizable:
+		return consistency, nil
+	}
+	return "", wrapError(ErrBadRequest, fmt.Errorf("unknown consistency %q", consistency))
 }
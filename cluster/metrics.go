@@ -0,0 +1,192 @@
+package cluster
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	restfulspec "github.com/emicklei/go-restful-openapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "leveldbraft"
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of HTTP requests, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	raftApplyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "raft",
+		Name:      "apply_duration_seconds",
+		Help:      "Latency of raft.Apply, by command op.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"op"})
+
+	raftApplyErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "raft",
+		Name:      "apply_errors_total",
+		Help:      "Number of failed raft.Apply calls, by command op.",
+	}, []string{"op"})
+
+	leadershipChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "raft",
+		Name:      "leadership_changes_total",
+		Help:      "Number of leadership transitions observed by this node.",
+	})
+
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "raft",
+		Name:      "is_leader",
+		Help:      "1 if this node is the raft leader, 0 otherwise.",
+	})
+
+	transportFaults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "raft",
+		Name:      "transport_faults_total",
+		Help:      "Number of faults injected into raft rpcs, by fault.",
+	}, []string{"fault"})
+
+	backupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "backup",
+		Name:      "runs_total",
+		Help:      "Number of backups taken, by result.",
+	}, []string{"result"})
+
+	backupLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "backup",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the latest successful backup.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		raftApplyDuration,
+		raftApplyErrors,
+		leadershipChanges,
+		isLeader,
+		transportFaults,
+		backupsTotal,
+		backupLastSuccess,
+	)
+}
+
+// NewMetricsService returns the prometheus scrape endpoint /metrics. It is
+// served by the container, so TokenFilter covers it.
+func NewMetricsService() *restful.WebService {
+	ws := &restful.WebService{}
+	// errors are JSON
+	ws.Path("/metrics").Produces(restful.MIME_JSON, "*/*")
+	handler := promhttp.Handler()
+	ws.Route(ws.GET("").To(func(req *restful.Request, resp *restful.Response) {
+		handler.ServeHTTP(resp.ResponseWriter, req.Request)
+	}).
+		Doc("prometheus metrics").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"metrics"}).
+		Returns(http.StatusOK, "ok", nil))
+	return ws
+}
+
+// MetricsFilter is a go-restful container filter recording request count and
+// latency per matched route and response status.
+func MetricsFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	begin := time.Now()
+	chain.ProcessFilter(req, resp)
+
+	route := req.SelectedRoutePath()
+	if route == "" {
+		route = "unmatched"
+	}
+	code := strconv.Itoa(resp.StatusCode())
+	method := req.Request.Method
+	httpRequestsTotal.WithLabelValues(route, method, code).Inc()
+	httpRequestDuration.WithLabelValues(route, method, code).Observe(time.Since(begin).Seconds())
+}
+
+// raftStatsGauges maps raft.Stats keys to exported gauges.
+var raftStatsGauges = map[string]*prometheus.Desc{
+	"term":                newRaftDesc("term", "Current raft term."),
+	"commit_index":        newRaftDesc("commit_index", "Index of the latest committed log entry."),
+	"applied_index":       newRaftDesc("applied_index", "Index of the latest log entry applied to the FSM."),
+	"last_log_index":      newRaftDesc("last_log_index", "Index of the latest log entry in the log store."),
+	"last_snapshot_index": newRaftDesc("last_snapshot_index", "Index of the latest snapshot."),
+	"fsm_pending":         newRaftDesc("fsm_pending", "Number of entries waiting to be applied to the FSM."),
+	"num_peers":           newRaftDesc("num_peers", "Number of other voting servers in the cluster."),
+}
+
+var (
+	lastContactDesc = newRaftDesc("last_contact_seconds", "Time since last contact with the leader, 0 on the leader.")
+	fsmKeysDesc     = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "fsm", "keys"),
+		"Number of keys held by the FSM.", nil, nil)
+)
+
+func newRaftDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "raft", name), help, nil, nil)
+}
+
+// collector exports raft.Stats and FSM state of a node on every scrape.
+type collector struct {
+	node *RaftNodeInfo
+}
+
+// NewCollector returns a prometheus collector for the raft stats of node.
+func NewCollector(node *RaftNodeInfo) prometheus.Collector {
+	return &collector{node}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range raftStatsGauges {
+		ch <- desc
+	}
+	ch <- lastContactDesc
+	ch <- fsmKeysDesc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.node.raft.Stats()
+	for key, desc := range raftStatsGauges {
+		v, err := strconv.ParseUint(stats[key], 10, 64)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v))
+	}
+
+	// last_contact is "0" on the leader, "never" before any contact and a
+	// formatted duration otherwise.
+	switch lc := stats["last_contact"]; lc {
+	case "never", "":
+	case "0":
+		ch <- prometheus.MustNewConstMetric(lastContactDesc, prometheus.GaugeValue, 0)
+	default:
+		if d, err := time.ParseDuration(lc); err == nil {
+			ch <- prometheus.MustNewConstMetric(lastContactDesc, prometheus.GaugeValue, d.Seconds())
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(fsmKeysDesc, prometheus.GaugeValue, float64(c.node.cache.Len()))
+}
@@ -0,0 +1,54 @@
+package cluster
+
+import (
+	"github.com/00arthur00/leveldbraft/store"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+type nodeOptions struct {
+	transport  raft.Transport
+	raftConfig func(*raft.Config)
+	logger     hclog.Logger
+	keys       store.KeyProvider
+}
+
+func defaultNodeOptions() nodeOptions {
+	return nodeOptions{
+		logger: hclog.Default(),
+	}
+}
+
+// NodeOption configures NewRaftNode.
+type NodeOption func(o *nodeOptions)
+
+// WithTransport uses t instead of a TCP transport on Config.RaftTCPAddr.
+func WithTransport(t raft.Transport) NodeOption {
+	return func(o *nodeOptions) {
+		o.transport = t
+	}
+}
+
+// WithRaftConfig lets fn adjust the raft configuration before the node
+// starts.
+func WithRaftConfig(fn func(*raft.Config)) NodeOption {
+	return func(o *nodeOptions) {
+		o.raftConfig = fn
+	}
+}
+
+// WithLogger sets the logger of the node and of raft.
+func WithLogger(l hclog.Logger) NodeOption {
+	return func(o *nodeOptions) {
+		o.logger = l
+	}
+}
+
+// WithKeyProvider encrypts the raft logs, stable keys and snapshots of the
+// node with the keys of kp. All nodes need the same keys, followers
+// restore the snapshots of the leader.
+func WithKeyProvider(kp store.KeyProvider) NodeOption {
+	return func(o *nodeOptions) {
+		o.keys = kp
+	}
+}
@@ -0,0 +1,77 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/store"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// PeersFile is the recovery file looked for in the data dir at startup,
+// in the format of raft's peers.json: a list of {"id", "address",
+// "non_voter"} servers, or of addresses as node ids are their addresses.
+// A node finding it replaces its configuration by the servers listed,
+// letting the survivors of a lost quorum form a new cluster.
+const PeersFile = "peers.json"
+
+// recoveredSuffix is appended to the name of a recovery file once used,
+// so that a restart does not recover again.
+const recoveredSuffix = ".recovered"
+
+// readPeersFile reads a recovery file in either format.
+func readPeersFile(path string) (raft.Configuration, error) {
+	configuration, err := raft.ReadConfigJSON(path)
+	if err == nil {
+		return configuration, nil
+	}
+	configuration, perr := raft.ReadPeersJSON(path)
+	if perr != nil {
+		return raft.Configuration{}, err
+	}
+	return configuration, nil
+}
+
+// recoverCluster recovers the stores of a node with the configuration of
+// the recovery file in dataDir, if there is one, before raft starts.
+func recoverCluster(dataDir string, conf *raft.Config, fsm raft.FSM, logs raft.LogStore, stable raft.StableStore,
+	snaps raft.SnapshotStore, trans raft.Transport, log hclog.Logger) error {
+	path := filepath.Join(dataDir, PeersFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	configuration, err := readPeersFile(path)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	local := false
+	for _, server := range configuration.Servers {
+		local = local || server.ID == conf.LocalID
+	}
+	if !local {
+		return fmt.Errorf("%s does not list this node %s", path, conf.LocalID)
+	}
+
+	log.Warn("recovering the cluster from the recovery file, committed entries the other nodes hold may be lost",
+		"path", path, "servers", configuration.Servers)
+	begin := time.Now()
+	if err := raft.RecoverCluster(conf, fsm, logs, stable, snaps, trans, configuration); err != nil {
+		return fmt.Errorf("recover cluster from %s: %w", path, err)
+	}
+	recovered := path + recoveredSuffix
+	if err := os.Rename(path, recovered); err != nil {
+		return err
+	}
+	if err := store.SyncDir(dataDir); err != nil {
+		return err
+	}
+	log.Warn("recovered the cluster", "servers", len(configuration.Servers), "renamed", recovered,
+		"seconds", time.Since(begin).Seconds())
+	return nil
+}
@@ -0,0 +1,154 @@
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells when a periodic job runs next.
+type Schedule interface {
+	// Next returns the first run strictly after t.
+	Next(t time.Time) time.Time
+}
+
+// ParseSchedule parses a cron expression of five fields, minute, hour,
+// day of month, month and day of week, evaluated in UTC. Fields hold *,
+// numbers, ranges a-b and lists of them, each with an optional /step.
+// Day of week 7 is sunday. As in cron, a day matches either day field when
+// both are restricted, a field starting with * being unrestricted.
+// @hourly, @daily and @every <duration> are accepted too. Expressions that
+// never match, such as february 30th, are rejected.
+func ParseSchedule(s string) (Schedule, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "@hourly":
+		s = "0 * * * *"
+	case s == "@daily":
+		s = "0 0 * * *"
+	case strings.HasPrefix(s, "@every "):
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(s, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", s, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("schedule %q: interval under a second", s)
+		}
+		return every(d), nil
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: want 5 fields, minute hour day month weekday", s)
+	}
+	c := &cronSchedule{}
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		set, err := parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", s, err)
+		}
+		*b.set = set
+	}
+	// 7 is sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDom, c.anyDow = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q: never runs", s)
+	}
+	return c, nil
+}
+
+// every runs at the multiples of a duration.
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Truncate(time.Duration(e)).Add(time.Duration(e))
+}
+
+// cronSchedule holds the allowed values of each field as bits.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// days match on either field when both are restricted, as in cron
+	anyDom, anyDow bool
+}
+
+// Next returns the zero time if no run comes within five years.
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	// no schedule is more than four years apart, february 29th
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseCronField returns the values of field between min and max as bits.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", item)
+			}
+			item, step = item[:i], n
+		}
+		lo, hi := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", item)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
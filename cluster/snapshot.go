@@ -0,0 +1,115 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/store"
+	"github.com/hashicorp/raft"
+)
+
+// NewSnapshotInfo returns the description of the snapshot of meta.
+func NewSnapshotInfo(meta *raft.SnapshotMeta) SnapshotInfo {
+	return SnapshotInfo{
+		ID:                 meta.ID,
+		Version:            int(meta.Version),
+		Index:              meta.Index,
+		Term:               meta.Term,
+		Size:               meta.Size,
+		Configuration:      &meta.Configuration,
+		ConfigurationIndex: meta.ConfigurationIndex,
+	}
+}
+
+// TakeSnapshot snapshots the FSM of this node now, ErrConflict if nothing
+// was applied since the last snapshot.
+func (r *RaftNodeInfo) TakeSnapshot(ctx context.Context) (*raft.SnapshotMeta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	future := r.raft.Snapshot()
+	if err := future.Error(); err != nil {
+		return nil, toError(err)
+	}
+	meta, rc, err := future.Open()
+	if err != nil {
+		return nil, toError(err)
+	}
+	rc.Close()
+	r.log.Info("took snapshot", "id", meta.ID, "index", meta.Index, "size", meta.Size)
+	return meta, nil
+}
+
+// Snapshots lists the snapshots of this node, newest first.
+func (r *RaftNodeInfo) Snapshots(ctx context.Context) ([]*raft.SnapshotMeta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	metas, err := r.snapshots.List()
+	if err != nil {
+		return nil, toError(err)
+	}
+	return metas, nil
+}
+
+// OpenSnapshot opens the latest snapshot of this node that verifies,
+// ErrNoSnapshot if there is none.
+func (r *RaftNodeInfo) OpenSnapshot(ctx context.Context) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	metas, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, meta := range metas {
+		meta, rc, err := r.snapshots.Open(meta.ID)
+		if errors.Is(err, store.ErrSnapshotCorrupt) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, toError(err)
+		}
+		return meta, rc, nil
+	}
+	return nil, nil, ErrNoSnapshot
+}
+
+// RestoreSnapshot verifies a snapshot archive and restores the cluster
+// from it, replacing the state of every node. It must run on the leader.
+func (r *RaftNodeInfo) RestoreSnapshot(ctx context.Context, archive io.Reader) (*raft.SnapshotMeta, error) {
+	if r.raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+
+	// raft.Restore reads the state once, verify it first
+	f, err := ioutil.TempFile(r.dataDir, "restore-*.tmp")
+	if err != nil {
+		return nil, toError(err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	meta, err := store.ReadSnapshotArchive(archive, f)
+	if errors.Is(err, store.ErrSnapshotArchive) {
+		return nil, wrapError(ErrBadRequest, err)
+	}
+	if err != nil {
+		return nil, toError(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, toError(err)
+	}
+
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if err := r.raft.Restore(meta, f, timeout); err != nil {
+		return nil, toError(err)
+	}
+	r.log.Warn("restored snapshot", "id", meta.ID, "index", meta.Index, "size", meta.Size)
+	return meta, nil
+}
@@ -0,0 +1,46 @@
+package cluster
+
+import (
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// streamLayer implements raft.StreamLayer over a plain TCP listener. It
+// replaces consul's RaftLayer, which only accepts the connections consul's
+// rpc server hands off to it and prefixes outgoing ones with consul's rpc
+// mode byte: with no such server, nodes never accepted each other's
+// connections and clusters of more than one node could not form.
+type streamLayer struct {
+	advertise net.Addr
+	listener  *net.TCPListener
+}
+
+func newStreamLayer(addr *net.TCPAddr) (*streamLayer, error) {
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &streamLayer{advertise: addr, listener: listener}, nil
+}
+
+// Dial implements raft.StreamLayer.
+func (s *streamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", string(address), timeout)
+}
+
+// Accept implements net.Listener.
+func (s *streamLayer) Accept() (net.Conn, error) {
+	return s.listener.Accept()
+}
+
+// Close implements net.Listener.
+func (s *streamLayer) Close() error {
+	return s.listener.Close()
+}
+
+// Addr implements net.Listener.
+func (s *streamLayer) Addr() net.Addr {
+	return s.advertise
+}
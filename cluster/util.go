@@ -1,10 +1,65 @@
 package cluster
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/hashicorp/raft"
+)
+
+// defaultTimeout bounds raft operations whose context has no deadline.
+const defaultTimeout = 5 * time.Second
 
 func codeToMsg(code int) *Msg {
 	return &Msg{
-		Code:    http.StatusBadRequest,
-		Message: http.StatusText(http.StatusBadGateway),
+		Code:    code,
+		Message: http.StatusText(code),
+	}
+}
+
+// writeError writes err as a JSON error body with its mapped HTTP status.
+func writeError(resp *restful.Response, err error) {
+	status, msg := errorToMsg(err)
+	resp.WriteHeaderAndEntity(status, msg)
+}
+
+// parseStat returns the uint64 value of a raft.Stats entry, 0 if absent.
+func parseStat(stats map[string]string, key string) uint64 {
+	v, _ := strconv.ParseUint(stats[key], 10, 64)
+	return v
+}
+
+// timeoutFromContext returns the time left until the deadline of ctx, or
+// defaultTimeout if it has none. A done ctx yields ErrTimeout.
+func timeoutFromContext(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapError(ErrTimeout, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return defaultTimeout, nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, wrapError(ErrTimeout, context.DeadlineExceeded)
+	}
+	return timeout, nil
+}
+
+// wait blocks until f is done or ctx is done. As f has already been handed
+// to raft, giving up on ctx yields ErrOutcomeUnknown.
+func wait(ctx context.Context, f raft.Future) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Error()
+	}()
+	select {
+	case err := <-done:
+		return toError(err)
+	case <-ctx.Done():
+		return wrapError(ErrOutcomeUnknown, ctx.Err())
 	}
 }
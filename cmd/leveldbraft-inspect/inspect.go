@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/00arthur00/leveldbraft/store"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// dirInfo is the output of info.
+type dirInfo struct {
+	DataDir    string               `json:"data_dir"`
+	FirstIndex uint64               `json:"first_index"`
+	LastIndex  uint64               `json:"last_index"`
+	Raft       *store.RaftState     `json:"raft"`
+	Snapshots  []*raft.SnapshotMeta `json:"snapshots"`
+}
+
+func info(g *globals, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	logs, stable, closeStores, err := openStores(g, false)
+	if err != nil {
+		return err
+	}
+	defer closeStores()
+
+	d := &dirInfo{DataDir: g.dataDir}
+	if d.FirstIndex, err = logs.FirstIndex(); err != nil {
+		return err
+	}
+	if d.LastIndex, err = logs.LastIndex(); err != nil {
+		return err
+	}
+	if d.Raft, err = stable.RaftState(); err != nil {
+		return err
+	}
+	if snapshots, err := openSnapshots(g); err == nil {
+		if d.Snapshots, err = snapshots.List(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return printJSON(os.Stdout, d)
+}
+
+// logEntry is a decoded raft log entry.
+type logEntry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Type  string `json:"type"`
+	// Command is the FSM command of command entries.
+	Command       *store.LogEntryData `json:"command,omitempty"`
+	Configuration *raft.Configuration `json:"configuration,omitempty"`
+	// Data is the payload of entries that did not decode.
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+var logTypes = map[raft.LogType]string{
+	raft.LogCommand:              "command",
+	raft.LogNoop:                 "noop",
+	raft.LogAddPeerDeprecated:    "add_peer",
+	raft.LogRemovePeerDeprecated: "remove_peer",
+	raft.LogBarrier:              "barrier",
+	raft.LogConfiguration:        "configuration",
+}
+
+// logs prints the entries from first to last, all by default and the one
+// at first if last is omitted. Entries that fail to read are printed with
+// their error.
+func logs(g *globals, args []string) error {
+	if err := nargs(args, 0, 2, "[first [last]]"); err != nil {
+		return err
+	}
+	logs, _, closeStores, err := openStores(g, false)
+	if err != nil {
+		return err
+	}
+	defer closeStores()
+
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := logs.LastIndex()
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		if first, err = parseIndex(args[0]); err != nil {
+			return err
+		}
+		last = first
+	}
+	if len(args) > 1 {
+		if last, err = parseIndex(args[1]); err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	failed := 0
+	for index := first; index != 0 && index <= last; index++ {
+		entry := decodeEntry(logs, index)
+		if entry.Error != "" {
+			failed++
+		}
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d entries failed to read", failed)
+	}
+	return nil
+}
+
+func decodeEntry(logs *store.LevelDBStore, index uint64) *logEntry {
+	var log raft.Log
+	if err := logs.GetLog(index, &log); err != nil {
+		return &logEntry{Index: index, Error: err.Error()}
+	}
+	entry := &logEntry{Index: log.Index, Term: log.Term, Type: logTypes[log.Type]}
+	if entry.Type == "" {
+		entry.Type = fmt.Sprintf("unknown(%d)", log.Type)
+	}
+	switch log.Type {
+	case raft.LogCommand:
+		cmd := &store.LogEntryData{}
+		if err := store.DecodeCommand(log.Data, cmd); err != nil {
+			entry.Data, entry.Error = log.Data, err.Error()
+			break
+		}
+		entry.Command = cmd
+	case raft.LogConfiguration:
+		configuration, err := decodeConfiguration(log.Data)
+		if err != nil {
+			entry.Data, entry.Error = log.Data, err.Error()
+			break
+		}
+		entry.Configuration = &configuration
+	default:
+		entry.Data = log.Data
+	}
+	return entry
+}
+
+// decodeConfiguration recovers from the panic of raft.DecodeConfiguration
+// on damaged data.
+func decodeConfiguration(b []byte) (configuration raft.Configuration, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decode configuration: %v", r)
+		}
+	}()
+	return raft.DecodeConfiguration(b), nil
+}
+
+func snapshots(g *globals, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	snapshots, err := openSnapshots(g)
+	if err != nil {
+		return err
+	}
+	metas, err := snapshots.List()
+	if err != nil {
+		return err
+	}
+	return printJSON(os.Stdout, metas)
+}
+
+// fsmDump is the output of dump.
+type fsmDump struct {
+	Snapshot *raft.SnapshotMeta `json:"snapshot"`
+	KVs      []kv               `json:"kvs"`
+}
+
+type kv struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func dump(g *globals, args []string) error {
+	if err := nargs(args, 0, 1, "[snapshot id]"); err != nil {
+		return err
+	}
+	snapshots, err := openSnapshots(g)
+	if err != nil {
+		return err
+	}
+	var id string
+	if len(args) > 0 {
+		id = args[0]
+	} else {
+		metas, err := snapshots.List()
+		if err != nil {
+			return err
+		}
+		if len(metas) == 0 {
+			return errors.New("no snapshot")
+		}
+		id = metas[0].ID
+	}
+
+	meta, rc, err := snapshots.Open(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	cache := store.NewCache()
+	fsm := store.NewFSM(cache, hclog.NewNullLogger(), store.WithKeyProvider(g.keys))
+	if err := fsm.Restore(rc); err != nil {
+		return fmt.Errorf("restore snapshot %s: %w", id, err)
+	}
+	d := &fsmDump{Snapshot: meta, KVs: []kv{}}
+	cache.Range(func(k, v string) bool {
+		d.KVs = append(d.KVs, kv{Key: k, Value: v})
+		return true
+	})
+	sort.Slice(d.KVs, func(i, j int) bool { return d.KVs[i].Key < d.KVs[j].Key })
+	return printJSON(os.Stdout, d)
+}
+
+// verifyReport is the output of verify.
+type verifyReport struct {
+	Logs      *store.ScrubReport `json:"logs"`
+	Snapshots []snapshotCheck    `json:"snapshots"`
+}
+
+type snapshotCheck struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+func verify(g *globals, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	report := &verifyReport{Snapshots: []snapshotCheck{}}
+	var err error
+	report.Logs, err = store.ScrubDir(context.Background(), store.WithPath(g.dataDir), store.WithKeyProvider(g.keys))
+	if err != nil {
+		return err
+	}
+	damaged := !report.Logs.OK()
+
+	snapshots, err := openSnapshots(g)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		metas, err := snapshots.List()
+		if err != nil {
+			return err
+		}
+		for _, meta := range metas {
+			check := snapshotCheck{ID: meta.ID}
+			_, rc, err := snapshots.Open(meta.ID)
+			if err == nil {
+				rc.Close()
+			} else {
+				check.Error, damaged = err.Error(), true
+			}
+			report.Snapshots = append(report.Snapshots, check)
+		}
+	}
+
+	if err := printJSON(os.Stdout, report); err != nil {
+		return err
+	}
+	if damaged {
+		return errors.New("damage found")
+	}
+	return nil
+}
+
+func truncateTail(g *globals, args []string) error {
+	if err := nargs(args, 1, 1, "<index>"); err != nil {
+		return err
+	}
+	from, err := parseIndex(args[0])
+	if err != nil {
+		return err
+	}
+	logs, _, closeStores, err := openStores(g, true)
+	if err != nil {
+		return err
+	}
+	defer closeStores()
+
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := logs.LastIndex()
+	if err != nil {
+		return err
+	}
+	if last == 0 || from > last {
+		return fmt.Errorf("no log from index %d, the log holds %d to %d", from, first, last)
+	}
+	if from <= first {
+		return fmt.Errorf("index %d would remove the whole log %d to %d", from, first, last)
+	}
+	if err := logs.DeleteRange(from, last); err != nil {
+		return err
+	}
+	fmt.Printf("removed logs %d to %d, the log holds %d to %d\n", from, last, first, from-1)
+	return nil
+}
+
+func resetVote(g *globals, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	_, stable, closeStores, err := openStores(g, true)
+	if err != nil {
+		return err
+	}
+	defer closeStores()
+
+	state, err := stable.RaftState()
+	if err != nil {
+		return err
+	}
+	if err := stable.ResetVote(); err != nil {
+		return err
+	}
+	fmt.Printf("forgot the vote for %q in term %d, current term %d\n",
+		state.LastVoteCandidate, state.LastVoteTerm, state.CurrentTerm)
+	return nil
+}
@@ -0,0 +1,144 @@
+// Command leveldbraft-inspect looks inside the data dir of a stopped node:
+// its raft log, term and vote, and snapshots. Stores are opened read only
+// except by the unsafe commands, which need -unsafe.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/00arthur00/leveldbraft/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+const usage = `usage: leveldbraft-inspect [flags] <command> [args]
+
+commands:
+  info                      first and last log index, term, vote and snapshots
+  logs [first [last]]       decode log entries, one json object per line
+  snapshots                 list the snapshots
+  dump [snapshot id]        print the fsm state of a snapshot, the latest if omitted
+  verify                    verify log and snapshot checksums, exits 1 on damage
+  truncate-tail <index>     unsafe: remove the logs from index to the last one
+  reset-vote                unsafe: forget the vote of the current term
+
+flags:
+`
+
+// snapshotsDir is the snapshot directory in the data dir.
+const snapshotsDir = "snapshots"
+
+// globals are the flags shared by all commands.
+type globals struct {
+	dataDir string
+	keyFile string
+	unsafe  bool
+	keys    store.KeyProvider
+}
+
+type command struct {
+	run func(g *globals, args []string) error
+	// writes opens the stores writable, with -unsafe only
+	writes bool
+}
+
+var commands = map[string]command{
+	"info":          {run: info},
+	"logs":          {run: logs},
+	"snapshots":     {run: snapshots},
+	"dump":          {run: dump},
+	"verify":        {run: verify},
+	"truncate-tail": {run: truncateTail, writes: true},
+	"reset-vote":    {run: resetVote, writes: true},
+}
+
+func main() {
+	g := &globals{}
+	fs := flag.NewFlagSet("leveldbraft-inspect", flag.ExitOnError)
+	fs.StringVar(&g.dataDir, "datadir", "./leveldb", "data directory of the stopped node")
+	fs.StringVar(&g.keyFile, "key-file", "", "key file of the node, if its data is encrypted")
+	fs.BoolVar(&g.unsafe, "unsafe", false, "allow the unsafe commands, which write to the data dir")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	args := fs.Args()
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "missing command")
+		fs.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		fs.Usage()
+		os.Exit(2)
+	}
+	if cmd.writes && !g.unsafe {
+		fmt.Fprintf(os.Stderr, "%s writes to the data dir of a stopped node and can lose committed data, pass -unsafe\n", args[0])
+		os.Exit(2)
+	}
+	if g.keyFile != "" {
+		keys, err := store.NewFileKeyProvider(g.keyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(2)
+		}
+		g.keys = keys
+	}
+
+	if err := cmd.run(g, args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// nargs checks the number of args of a command.
+func nargs(args []string, min, max int, want string) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("want args %s, got %d", want, len(args))
+	}
+	return nil
+}
+
+// openStores opens the stores of the data dir, writable for the unsafe
+// commands only.
+func openStores(g *globals, writable bool) (logs *store.LevelDBStore, stable *store.LevelDBStore, closeStores func(), err error) {
+	logs, stable, err = store.OpenDataDir(!writable, store.WithPath(g.dataDir), store.WithKeyProvider(g.keys))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	closeStores = func() {
+		logs.Close()
+		if stable != logs {
+			stable.Close()
+		}
+	}
+	return logs, stable, closeStores, nil
+}
+
+// openSnapshots opens the snapshot store of the data dir read only.
+func openSnapshots(g *globals) (*store.SnapshotStore, error) {
+	return store.OpenSnapshotStore(filepath.Join(g.dataDir, snapshotsDir), hclog.NewNullLogger())
+}
+
+func parseIndex(s string) (uint64, error) {
+	index, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad index %q", s)
+	}
+	return index, nil
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -5,7 +5,7 @@ import "github.com/emicklei/go-restful"
 func setcors(c *restful.Container) {
 	cors := restful.CrossOriginResourceSharing{
 		AllowedDomains: []string{"*"},
-		AllowedHeaders: []string{"Content-Type", "Accept"},
+		AllowedHeaders: []string{"Content-Type", "Accept", "Authorization"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
 		CookiesAllowed: true,
 		Container:      c}
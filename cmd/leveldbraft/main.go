@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/00arthur00/leveldbraft/cluster"
 	"github.com/00arthur00/leveldbraft/config"
+	"github.com/00arthur00/leveldbraft/store"
 	"github.com/emicklei/go-restful"
 	"github.com/hashicorp/go-hclog"
 	"github.com/oklog/oklog/pkg/group"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var conf config.Config
@@ -23,10 +27,48 @@ func main() {
 	flag.StringVar(&conf.JoinAddr, "join", "", "join addr for raft cluster")
 	flag.StringVar(&conf.DataDir, "datadir", "./leveldb", "data directory")
 	flag.StringVar(&conf.RaftTCPAddr, "raft", ":8902", "raft tcp addr")
+	flag.Uint64Var(&conf.ReadyMaxLag, "ready-max-lag", 100, "max entries applied index may lag commit index while ready")
+	flag.StringVar(&conf.TLSCertFile, "tls-cert", "", "tls certificate file, enables https")
+	flag.StringVar(&conf.TLSKeyFile, "tls-key", "", "tls key file")
+	flag.StringVar(&conf.TLSCAFile, "tls-ca", "", "ca file to verify the join addr")
+	flag.StringVar(&conf.AuthToken, "token", "", "bearer token required by the http api")
+	flag.BoolVar(&conf.SingleDB, "single-db", false, "keep raft logs and stable keys in a single leveldb, migrating existing data dirs")
+	flag.BoolVar(&conf.RelaxedSync, "relaxed-sync", false, "do not fsync raft logs and stable keys, a power loss can lose acknowledged writes")
+	flag.IntVar(&conf.LogCacheSize, "log-cache", 512, "number of recent raft logs cached in memory, 0 disables the cache")
+	flag.StringVar(&conf.LogCompression, "log-compression", "none", "compression of the raft logs written: none, snappy or zstd")
+	flag.StringVar(&conf.LogFormat, "log-format", "msgpack", "encoding of the raft logs written: msgpack, json or binary")
+	flag.StringVar(&conf.CommandFormat, "command-format", "", "encoding of fsm commands: msgpack, json or binary, empty for the bare json every version reads")
+	flag.IntVar(&conf.LogCompactTombstones, "log-compact-tombstones", 10000, "compact the raft log store once that many logs were truncated, 0 disables")
+	flag.DurationVar(&conf.LogCompactInterval, "log-compact-interval", 10*time.Minute, "compact the raft log store at this interval if logs were truncated, 0 disables")
+	flag.IntVar(&conf.SnapshotRetain, "snapshot-retain", 2, "number of snapshots kept, older ones are restored if the latest is corrupt")
+	flag.StringVar(&conf.BackupDir, "backup-dir", "", "dir of scheduled backups, empty disables them")
+	flag.StringVar(&conf.BackupSchedule, "backup-schedule", "@hourly", "cron schedule of backups in UTC: 5 fields, @hourly, @daily or @every <duration>")
+	flag.StringVar(&conf.BackupNode, "backup-node", "", "raft id of the node taking backups, the leader if empty")
+	flag.IntVar(&conf.BackupKeepHourly, "backup-keep-hourly", 24, "keep the newest backup of this many recent hours")
+	flag.IntVar(&conf.BackupKeepDaily, "backup-keep-daily", 7, "keep the newest backup of this many recent days")
+	flag.BoolVar(&conf.DebugFaults, "debug-faults", false, "serve /debug/faults to inject raft network faults, for testing only")
+	keyFile := flag.String("key-file", "", "file of \"<id> <hex key>\" lines encrypting data at rest with the highest id, reloaded on SIGHUP")
+	scrub := flag.Bool("scrub", false, "verify the raft log of the stopped node in datadir and exit")
 	flag.Parse()
 
+	// a nil provider stores plaintext
+	var keys *store.FileKeyProvider
+	var provider store.KeyProvider
+	if *keyFile != "" {
+		var err error
+		if keys, err = store.NewFileKeyProvider(*keyFile); err != nil {
+			hclog.Default().Error("key file", "error", err)
+			os.Exit(1)
+		}
+		provider = keys
+	}
+
+	if *scrub {
+		os.Exit(scrubDataDir(conf.DataDir, provider))
+	}
+
 	//new raft node
-	node, err := cluster.NewRaftNode(&conf)
+	node, err := cluster.NewRaftNode(&conf, cluster.WithKeyProvider(provider))
 	if err != nil {
 		hclog.Default().Error("new raft node", err)
 		os.Exit(1)
@@ -34,7 +76,7 @@ func main() {
 
 	//join cluster
 	if conf.JoinAddr != "" {
-		if err := cluster.JoinCluster(&conf); err != nil {
+		if err := cluster.JoinCluster(context.Background(), &conf); err != nil {
 			hclog.Default().Error("join cluster", err)
 			return
 		}
@@ -46,6 +88,19 @@ func main() {
 	{
 		c := restful.NewContainer()
 		c.Add(cluster.NewWebService(node, hclog.Default()))
+		c.Add(cluster.NewHealthService(node, hclog.Default()))
+		if conf.DebugFaults {
+			hclog.Default().Warn("raft network fault injection enabled on /debug/faults")
+			c.Add(cluster.NewFaultService(node.Faults(), hclog.Default()))
+		}
+		//metrics
+		prometheus.MustRegister(cluster.NewCollector(node))
+		c.Filter(cluster.MetricsFilter)
+		c.Add(cluster.NewMetricsService())
+		//auth
+		if conf.AuthToken != "" {
+			c.Filter(cluster.TokenFilter(conf.AuthToken))
+		}
 		//swagger api
 		registerOpenAPI(c, "")
 		//cors
@@ -54,6 +109,9 @@ func main() {
 		server := &http.Server{Addr: conf.HTTPAddr, Handler: c}
 		g.Add(func() error {
 			hclog.Default().Info("http listening on ", conf.HTTPAddr)
+			if conf.TLSCertFile != "" {
+				return server.ListenAndServeTLS(conf.TLSCertFile, conf.TLSKeyFile)
+			}
 			return server.ListenAndServe()
 		}, func(error) {
 			if err := server.Shutdown(context.TODO()); err != nil {
@@ -62,6 +120,30 @@ func main() {
 		})
 	}
 
+	// key file reload, rotating keys
+	if keys != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		g.Add(func() error {
+			for {
+				select {
+				case <-c:
+					if err := keys.Reload(); err != nil {
+						hclog.Default().Error("reload key file", "error", err)
+						continue
+					}
+					id, _, _ := keys.CurrentKey()
+					hclog.Default().Info("reloaded key file", "current", id)
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}, func(error) {
+			cancel()
+		})
+	}
+
 	// terminator
 	{
 		ctx, cancel := context.WithCancel(context.Background())
@@ -79,9 +161,30 @@ func main() {
 		})
 	}
 
-	if err := g.Run(); err != nil {
-		hclog.Default().Error("shutdown with error:", err.Error())
+	runErr := g.Run()
+	if err := node.Shutdown(); err != nil {
+		hclog.Default().Error("shutdown raft node", "error", err)
+	}
+	if runErr != nil {
+		hclog.Default().Error("shutdown with error:", runErr.Error())
 		os.Exit(2)
 	}
 	hclog.Default().Info("server gracefully shutdown")
 }
+
+// scrubDataDir prints the scrub report of the raft log in dir, decrypted
+// with keys, and returns the exit code, 1 if the log is damaged.
+func scrubDataDir(dir string, keys store.KeyProvider) int {
+	report, err := store.ScrubDir(context.Background(), store.WithPath(dir), store.WithKeyProvider(keys))
+	if err != nil {
+		hclog.Default().Error("scrub", "dir", dir, "error", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
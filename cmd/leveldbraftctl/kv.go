@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/client"
+	"github.com/00arthur00/leveldbraft/cluster"
+)
+
+func kvGet(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 1, 1, "<key>"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	value, err := c.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	kv := cluster.KV{Key: args[0], Value: value}
+	return output(g, kv, []string{"KEY", "VALUE"}, [][]string{{kv.Key, kv.Value}})
+}
+
+func kvPut(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 2, 2, "<key> <value>"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	return c.Set(ctx, args[0], args[1])
+}
+
+func kvCAS(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 3, 3, "<key> <prev> <value>"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	return c.CompareAndSwap(ctx, args[0], args[1], args[2])
+}
+
+func kvDel(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 1, 1, "<key>"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	return c.Delete(ctx, args[0])
+}
+
+func kvList(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 1, "[prefix]"); err != nil {
+		return err
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	kvs, err := c.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(kvs))
+	for _, kv := range kvs {
+		rows = append(rows, []string{kv.Key, kv.Value})
+	}
+	return output(g, kvs, []string{"KEY", "VALUE"}, rows)
+}
+
+// kvWatch polls key and prints it every time its value changes, until
+// interrupted.
+func kvWatch(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("kv watch", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Second, "poll interval")
+	fs.Parse(args)
+	if err := nargs(fs.Args(), 1, 1, "<key>"); err != nil {
+		return err
+	}
+	key := fs.Arg(0)
+
+	var last *cluster.KV
+	for {
+		reqCtx, cancel := withTimeout(ctx, g)
+		value, err := c.Get(reqCtx, key)
+		cancel()
+		switch {
+		case err == nil:
+			if last == nil || last.Value != value {
+				last = &cluster.KV{Key: key, Value: value}
+				if err := output(g, last, []string{"KEY", "VALUE"}, [][]string{{key, value}}); err != nil {
+					return err
+				}
+			}
+		case errors.Is(err, cluster.ErrKeyNotFound):
+			if last != nil {
+				last = nil
+				if err := output(g, cluster.KV{Key: key}, []string{"KEY", "VALUE"}, [][]string{{key, "<deleted>"}}); err != nil {
+					return err
+				}
+			}
+		case ctx.Err() == nil:
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// kvExport writes the pairs under prefix to stdout as NDJSON.
+func kvExport(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 1, "[prefix]"); err != nil {
+		return err
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	ctx, cancel := withTransferTimeout(ctx, g)
+	defer cancel()
+	return c.Export(ctx, prefix, os.Stdout)
+}
+
+// kvImport loads an NDJSON file of pairs, or stdin for -, printing the
+// progress to stderr.
+func kvImport(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("kv import", flag.ExitOnError)
+	mode := fs.String("mode", string(cluster.ImportOverwrite), "existing keys: overwrite or skip")
+	dryRun := fs.Bool("dry-run", false, "validate and count without applying")
+	batch := fs.Int("batch", 0, "pairs per raft entry, 256 if 0")
+	fs.Parse(args)
+	if err := nargs(fs.Args(), 1, 1, "<file|->"); err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	ctx, cancel := withTransferTimeout(ctx, g)
+	defer cancel()
+	opts := cluster.ImportOptions{Mode: cluster.ImportMode(*mode), DryRun: *dryRun, BatchSize: *batch}
+	p, err := c.Import(ctx, in, opts, func(p cluster.ImportProgress) {
+		fmt.Fprintf(os.Stderr, "read %d applied %d skipped %d\n", p.Read, p.Applied, p.Skipped)
+	})
+	if err != nil {
+		if p != nil {
+			fmt.Fprintf(os.Stderr, "stopped after %d pairs applied in %d batches\n", p.Applied, p.Batches)
+		}
+		return err
+	}
+	return output(g, p, []string{"READ", "APPLIED", "SKIPPED", "BATCHES", "DRY RUN"}, [][]string{{
+		strconv.Itoa(p.Read), strconv.Itoa(p.Applied), strconv.Itoa(p.Skipped), strconv.Itoa(p.Batches),
+		strconv.FormatBool(p.DryRun),
+	}})
+}
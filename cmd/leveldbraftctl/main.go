@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/client"
+	"github.com/00arthur00/leveldbraft/cluster"
+)
+
+const usage = `usage: leveldbraftctl [flags] <command> [args]
+
+commands:
+  kv get <key>
+  kv put <key> <value>
+  kv cas <key> <prev> <value>
+  kv del <key>
+  kv list [prefix]
+  kv watch [-interval 1s] <key>
+  kv export [prefix]
+  kv import [-mode overwrite|skip] [-dry-run] [-batch 256] <file|->
+  member list
+  member add [-nonvoter] <id> <address>
+  member remove <id>
+  member promote <id>
+  leader transfer [id]
+  status
+  health
+  scrub
+  compact
+  snapshot take
+  snapshot list
+  snapshot save <file>
+  snapshot restore <file>
+
+flags:
+`
+
+// globals are the flags shared by all commands.
+type globals struct {
+	endpoints       string
+	output          string
+	token           string
+	caFile          string
+	insecure        bool
+	timeout         time.Duration
+	transferTimeout time.Duration
+	consistency     string
+}
+
+type command func(ctx context.Context, g *globals, c *client.Client, args []string) error
+
+var commands = map[string]map[string]command{
+	"kv": {
+		"get":    kvGet,
+		"put":    kvPut,
+		"cas":    kvCAS,
+		"del":    kvDel,
+		"list":   kvList,
+		"watch":  kvWatch,
+		"export": kvExport,
+		"import": kvImport,
+	},
+	"member": {
+		"list":    memberList,
+		"add":     memberAdd,
+		"remove":  memberRemove,
+		"promote": memberPromote,
+	},
+	"leader": {
+		"transfer": leaderTransfer,
+	},
+	"status":  {"": status},
+	"health":  {"": health},
+	"scrub":   {"": scrub},
+	"compact": {"": compact},
+	"snapshot": {
+		"take":    snapshotTake,
+		"list":    snapshotList,
+		"save":    snapshotSave,
+		"restore": snapshotRestore,
+	},
+}
+
+func main() {
+	g := &globals{}
+	fs := flag.NewFlagSet("leveldbraftctl", flag.ExitOnError)
+	fs.StringVar(&g.endpoints, "endpoints", "127.0.0.1:8901", "comma separated http addrs of the nodes")
+	fs.StringVar(&g.output, "o", "table", "output format: table or json")
+	fs.StringVar(&g.token, "token", "", "bearer token of the http api")
+	fs.StringVar(&g.caFile, "tls-ca", "", "ca file to verify the nodes, enables https")
+	fs.BoolVar(&g.insecure, "tls-insecure", false, "use https without verifying the nodes")
+	fs.DurationVar(&g.timeout, "timeout", 10*time.Second, "timeout of a command, of each request for kv import")
+	fs.DurationVar(&g.transferTimeout, "transfer-timeout", 0, "timeout of kv export, kv import and snapshot save and restore, 0 for none")
+	fs.StringVar(&g.consistency, "consistency", string(cluster.ConsistencyLeader), "read consistency: stale, leader or linearizable")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	cmd, args, err := lookup(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := cmd(ctx, g, c, args); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// lookup resolves the command named by the leading args.
+func lookup(args []string) (command, []string, error) {
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("missing command")
+	}
+	sub, ok := commands[args[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown command %q", args[0])
+	}
+	if cmd, ok := sub[""]; ok {
+		return cmd, args[1:], nil
+	}
+	if len(args) < 2 {
+		return nil, nil, fmt.Errorf("missing %s subcommand", args[0])
+	}
+	cmd, ok := sub[args[1]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown command %q", args[0]+" "+args[1])
+	}
+	return cmd, args[2:], nil
+}
+
+func newClient(g *globals) (*client.Client, error) {
+	opts := []client.Option{
+		client.WithHTTPClient(&http.Client{Timeout: g.timeout}),
+		client.WithConsistency(cluster.Consistency(g.consistency)),
+		client.WithToken(g.token),
+	}
+	if g.caFile != "" || g.insecure {
+		tlsConfig := &tls.Config{InsecureSkipVerify: g.insecure}
+		if g.caFile != "" {
+			pem, err := ioutil.ReadFile(g.caFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", g.caFile)
+			}
+		}
+		opts = append(opts, client.WithTLSConfig(tlsConfig))
+	}
+	return client.New(strings.Split(g.endpoints, ","), opts...)
+}
+
+// withTimeout bounds a single request by the timeout flag.
+func withTimeout(ctx context.Context, g *globals) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, g.timeout)
+}
+
+// withTransferTimeout bounds a command streaming data by the
+// transfer-timeout flag, if set.
+func withTransferTimeout(ctx context.Context, g *globals) (context.Context, context.CancelFunc) {
+	if g.transferTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, g.transferTimeout)
+}
+
+// nargs checks that args holds between min and max arguments.
+func nargs(args []string, min, max int, names string) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("expected arguments: %s", names)
+	}
+	return nil
+}
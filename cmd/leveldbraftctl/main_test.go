@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/00arthur00/leveldbraft/cluster/clustertest"
+)
+
+// usageCommands returns the commands listed in the usage, without their
+// arguments.
+func usageCommands() []string {
+	var names []string
+	lines := strings.Split(usage[strings.Index(usage, "commands:\n")+len("commands:\n"):], "\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "  ") {
+			break
+		}
+		var words []string
+		for _, word := range strings.Fields(line) {
+			if strings.ContainsAny(word[:1], "[<-") {
+				break
+			}
+			words = append(words, word)
+		}
+		names = append(names, strings.Join(words, " "))
+	}
+	return names
+}
+
+// TestCommands runs every command of the usage against a cluster.
+func TestCommands(t *testing.T) {
+	c := clustertest.New(t, 3)
+	g := &globals{
+		endpoints:   strings.Join(c.HTTPEndpoints(), ","),
+		output:      "json",
+		timeout:     clustertest.DefaultTimeout,
+		consistency: "leader",
+	}
+	cl, err := newClient(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "leveldbraftctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot")
+	export := filepath.Join(dir, "export.ndjson")
+	if err := ioutil.WriteFile(export, []byte(`{"key":"imported","value":"value"}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// commands print to stdout
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+
+	// in order, later commands rely on the earlier ones
+	runs := [][]string{
+		{"kv", "put", "key", "value"},
+		{"kv", "get", "key"},
+		{"kv", "cas", "key", "value", "swapped"},
+		{"kv", "list", "k"},
+		{"kv", "watch", "-interval", "10ms", "key"},
+		{"kv", "export", "k"},
+		{"kv", "import", "-mode", "skip", export},
+		{"kv", "del", "key"},
+		{"status"},
+		{"health"},
+		{"scrub"},
+		{"compact"},
+		// raft takes no snapshot until the FSM caught up with the latest
+		// configuration, run them before the member changes
+		{"snapshot", "take"},
+		{"snapshot", "list"},
+		{"snapshot", "save", snapshot},
+		{"snapshot", "restore", snapshot},
+		{"member", "list"},
+		{"member", "add", "-nonvoter", "extra", "extra"},
+		{"member", "promote", "extra"},
+		{"member", "remove", "extra"},
+		{"leader", "transfer"},
+	}
+	ran := map[string]bool{}
+	for _, args := range runs {
+		cmd, rest, err := lookup(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := strings.Join(args[:len(args)-len(rest)], " ")
+		ran[name] = true
+
+		ctx, cancel := context.WithTimeout(context.Background(), clustertest.DefaultTimeout)
+		if name == "kv watch" {
+			// watch runs until interrupted
+			ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+		}
+		err = cmd(ctx, g, cl, rest)
+		cancel()
+		if err != nil {
+			t.Errorf("%s: %v", strings.Join(args, " "), err)
+		}
+	}
+	for _, name := range usageCommands() {
+		if !ran[name] {
+			t.Errorf("usage command %q was not run", name)
+		}
+	}
+}
+
+// TestImportTimeout checks -timeout bounds each batch of an import, not the
+// whole import.
+func TestImportTimeout(t *testing.T) {
+	c := clustertest.New(t, 3)
+	g := &globals{
+		endpoints:   strings.Join(c.HTTPEndpoints(), ","),
+		output:      "json",
+		timeout:     500 * time.Millisecond,
+		consistency: "leader",
+	}
+	cl, err := newClient(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stdin, stdout, stderr := os.Stdin, os.Stdout, os.Stderr
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdin, os.Stdout, os.Stderr = r, devNull, devNull
+	defer func() { os.Stdin, os.Stdout, os.Stderr = stdin, stdout, stderr }()
+
+	// the stream lasts twice the timeout
+	go func() {
+		defer w.Close()
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "{\"key\":\"key%d\",\"value\":\"value\"}\n", i)
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+	if err := kvImport(context.Background(), g, cl, []string{"-batch", "1", "-"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cl.Get(context.Background(), "key4"); err != nil || v != "value" {
+		t.Fatalf("Get of the last pair returned %q, %v", v, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/00arthur00/leveldbraft/client"
+	"github.com/00arthur00/leveldbraft/cluster"
+)
+
+func memberList(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	configuration, err := c.Members(ctx)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(configuration.Servers))
+	for _, server := range configuration.Servers {
+		rows = append(rows, []string{string(server.ID), string(server.Address), server.Suffrage.String()})
+	}
+	return output(g, configuration, []string{"ID", "ADDRESS", "SUFFRAGE"}, rows)
+}
+
+func memberAdd(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("member add", flag.ExitOnError)
+	nonvoter := fs.Bool("nonvoter", false, "add as nonvoter")
+	fs.Parse(args)
+	if err := nargs(fs.Args(), 2, 2, "<id> <address>"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	return c.AddMember(ctx, cluster.Member{ID: fs.Arg(0), Address: fs.Arg(1), Voter: !*nonvoter})
+}
+
+func memberRemove(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 1, 1, "<id>"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	return c.RemoveMember(ctx, args[0])
+}
+
+func memberPromote(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 1, 1, "<id>"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	return c.PromoteMember(ctx, args[0])
+}
+
+func leaderTransfer(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 1, "[id]"); err != nil {
+		return err
+	}
+	id := ""
+	if len(args) == 1 {
+		id = args[0]
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+	return c.TransferLeadership(ctx, id)
+}
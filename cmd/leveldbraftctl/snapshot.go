@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/00arthur00/leveldbraft/client"
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/store"
+)
+
+// endpointSnapshots are the snapshots of one node.
+type endpointSnapshots struct {
+	Endpoint  string                 `json:"endpoint"`
+	Snapshots []cluster.SnapshotInfo `json:"snapshots,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+func snapshotTake(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+
+	var taken []endpointSnapshots
+	var rows [][]string
+	failed := 0
+	for _, endpoint := range c.Endpoints() {
+		info, err := c.TakeSnapshot(ctx, endpoint)
+		if err != nil {
+			taken = append(taken, endpointSnapshots{Endpoint: endpoint, Error: err.Error()})
+			rows = append(rows, []string{endpoint, "", "", "", "", err.Error()})
+			failed++
+			continue
+		}
+		taken = append(taken, endpointSnapshots{Endpoint: endpoint, Snapshots: []cluster.SnapshotInfo{*info}})
+		rows = append(rows, snapshotRow(endpoint, info))
+	}
+	if err := output(g, taken, snapshotHeader, rows); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.New(strconv.Itoa(failed) + " endpoints failed to snapshot")
+	}
+	return nil
+}
+
+func snapshotList(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+
+	var lists []endpointSnapshots
+	var rows [][]string
+	for _, endpoint := range c.Endpoints() {
+		infos, err := c.Snapshots(ctx, endpoint)
+		if err != nil {
+			lists = append(lists, endpointSnapshots{Endpoint: endpoint, Error: err.Error()})
+			rows = append(rows, []string{endpoint, "", "", "", "", err.Error()})
+			continue
+		}
+		lists = append(lists, endpointSnapshots{Endpoint: endpoint, Snapshots: infos})
+		for i := range infos {
+			rows = append(rows, snapshotRow(endpoint, &infos[i]))
+		}
+	}
+	return output(g, lists, snapshotHeader, rows)
+}
+
+var snapshotHeader = []string{"ENDPOINT", "ID", "INDEX", "TERM", "SIZE", "ERROR"}
+
+func snapshotRow(endpoint string, info *cluster.SnapshotInfo) []string {
+	return []string{
+		endpoint, info.ID, strconv.FormatUint(info.Index, 10), strconv.FormatUint(info.Term, 10),
+		strconv.FormatInt(info.Size, 10), "",
+	}
+}
+
+// snapshotSave downloads the latest snapshot of the leader to a file,
+// verified before it replaces the file.
+func snapshotSave(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 1, 1, "<file>"); err != nil {
+		return err
+	}
+	ctx, cancel := withTransferTimeout(ctx, g)
+	defer cancel()
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		return err
+	}
+
+	path := args[0]
+	f, err := ioutil.TempFile(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := c.SaveSnapshot(ctx, leader, f); err != nil {
+		return err
+	}
+	meta, err := verifyArchive(f)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	fmt.Printf("saved snapshot %s of index %d from %s to %s\n", meta.ID, meta.Index, leader, path)
+	return nil
+}
+
+// snapshotRestore restores the cluster from a file saved by snapshot save.
+func snapshotRestore(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 1, 1, "<file>"); err != nil {
+		return err
+	}
+	ctx, cancel := withTransferTimeout(ctx, g)
+	defer cancel()
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := verifyArchive(f); err != nil {
+		return err
+	}
+	info, err := c.RestoreSnapshot(ctx, f)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored snapshot %s of index %d\n", info.ID, info.Index)
+	return nil
+}
+
+// verifyArchive checks the snapshot archive f and rewinds it.
+func verifyArchive(f *os.File) (*cluster.SnapshotInfo, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	meta, err := store.ReadSnapshotArchive(f, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	info := cluster.NewSnapshotInfo(meta)
+	return &info, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/00arthur00/leveldbraft/client"
+	"github.com/00arthur00/leveldbraft/cluster"
+	"github.com/00arthur00/leveldbraft/store"
+)
+
+// endpointStatus is the status of one node, or why it could not be read.
+type endpointStatus struct {
+	Endpoint string          `json:"endpoint"`
+	Status   *cluster.Status `json:"status,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func status(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+
+	var statuses []endpointStatus
+	var rows [][]string
+	for _, endpoint := range c.Endpoints() {
+		s, err := c.Status(ctx, endpoint)
+		if err != nil {
+			statuses = append(statuses, endpointStatus{Endpoint: endpoint, Error: err.Error()})
+			rows = append(rows, []string{endpoint, "", "", "", "", "", err.Error()})
+			continue
+		}
+		statuses = append(statuses, endpointStatus{Endpoint: endpoint, Status: s})
+		rows = append(rows, []string{
+			endpoint, s.State, s.Leader, strconv.FormatUint(s.Term, 10),
+			s.Stats["commit_index"], s.Stats["applied_index"], "",
+		})
+	}
+	return output(g, statuses, []string{"ENDPOINT", "STATE", "LEADER", "TERM", "COMMIT", "APPLIED", "ERROR"}, rows)
+}
+
+// endpointHealth is the readiness of one node.
+type endpointHealth struct {
+	Endpoint string `json:"endpoint"`
+	Ready    bool   `json:"ready"`
+	Error    string `json:"error,omitempty"`
+}
+
+func health(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+
+	var healths []endpointHealth
+	var rows [][]string
+	unhealthy := 0
+	for _, endpoint := range c.Endpoints() {
+		h := endpointHealth{Endpoint: endpoint, Ready: true}
+		if err := c.Health(ctx, endpoint); err != nil {
+			h.Ready, h.Error = false, err.Error()
+			unhealthy++
+		}
+		healths = append(healths, h)
+		rows = append(rows, []string{endpoint, strconv.FormatBool(h.Ready), h.Error})
+	}
+	if err := output(g, healths, []string{"ENDPOINT", "READY", "ERROR"}, rows); err != nil {
+		return err
+	}
+	if unhealthy > 0 {
+		return errors.New(strconv.Itoa(unhealthy) + " unhealthy endpoints")
+	}
+	return nil
+}
+
+// endpointScrub is the log scrub report of one node.
+type endpointScrub struct {
+	Endpoint string             `json:"endpoint"`
+	Report   *store.ScrubReport `json:"report,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+func scrub(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+
+	var scrubs []endpointScrub
+	var rows [][]string
+	damaged := 0
+	for _, endpoint := range c.Endpoints() {
+		r, err := c.ScrubLogs(ctx, endpoint)
+		if err != nil {
+			scrubs = append(scrubs, endpointScrub{Endpoint: endpoint, Error: err.Error()})
+			rows = append(rows, []string{endpoint, "", "", "", "", err.Error()})
+			damaged++
+			continue
+		}
+		scrubs = append(scrubs, endpointScrub{Endpoint: endpoint, Report: r})
+		var ranges []string
+		for _, d := range r.Damaged {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", d.First, d.Last))
+		}
+		rows = append(rows, []string{
+			endpoint, fmt.Sprintf("%d-%d", r.FirstIndex, r.LastIndex), strconv.FormatUint(r.Checked, 10),
+			strconv.FormatUint(r.Corrupted, 10), strconv.FormatUint(r.Missing, 10), strings.Join(ranges, ","),
+		})
+		if !r.OK() {
+			damaged++
+		}
+	}
+	if err := output(g, scrubs, []string{"ENDPOINT", "LOG", "CHECKED", "CORRUPTED", "MISSING", "DAMAGED"}, rows); err != nil {
+		return err
+	}
+	if damaged > 0 {
+		return errors.New(strconv.Itoa(damaged) + " endpoints with damaged or unchecked logs")
+	}
+	return nil
+}
+
+// endpointCompaction is the log compaction report of one node.
+type endpointCompaction struct {
+	Endpoint string                  `json:"endpoint"`
+	Report   *store.CompactionReport `json:"report,omitempty"`
+	Error    string                  `json:"error,omitempty"`
+}
+
+func compact(ctx context.Context, g *globals, c *client.Client, args []string) error {
+	if err := nargs(args, 0, 0, "none"); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, g)
+	defer cancel()
+
+	var compactions []endpointCompaction
+	var rows [][]string
+	failed := 0
+	for _, endpoint := range c.Endpoints() {
+		r, err := c.CompactLogs(ctx, endpoint)
+		if err != nil {
+			compactions = append(compactions, endpointCompaction{Endpoint: endpoint, Error: err.Error()})
+			rows = append(rows, []string{endpoint, "", "", "", err.Error()})
+			failed++
+			continue
+		}
+		compactions = append(compactions, endpointCompaction{Endpoint: endpoint, Report: r})
+		rows = append(rows, []string{
+			endpoint, strconv.FormatInt(r.BytesBefore, 10), strconv.FormatInt(r.BytesAfter, 10),
+			strconv.FormatFloat(r.Seconds, 'f', 3, 64), "",
+		})
+	}
+	if err := output(g, compactions, []string{"ENDPOINT", "BYTES BEFORE", "BYTES AFTER", "SECONDS", "ERROR"}, rows); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.New(strconv.Itoa(failed) + " endpoints failed to compact")
+	}
+	return nil
+}
@@ -1,9 +1,61 @@
 package config
 
+import "time"
+
 type Config struct {
 	DataDir     string
 	HTTPAddr    string
 	RaftTCPAddr string
 	Bootstrap   bool
 	JoinAddr    string
+	// ReadyMaxLag is the max distance between commit and applied index for
+	// a node to be reported ready.
+	ReadyMaxLag uint64
+	// TLSCertFile and TLSKeyFile enable https on HTTPAddr.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSCAFile verifies the join target, system roots if empty.
+	TLSCAFile string
+	// AuthToken is the bearer token required by the http api, if not empty.
+	AuthToken string
+	// SingleDB keeps logs and stable keys in one leveldb under DataDir/raft
+	// instead of DataDir/logs and DataDir/conf, migrating existing data.
+	SingleDB bool
+	// RelaxedSync skips the fsync of log appends and stable keys: faster,
+	// but a power loss can lose acknowledged entries and votes.
+	RelaxedSync bool
+	// LogCacheSize is the number of recent raft logs kept in memory, 0
+	// disables the cache.
+	LogCacheSize int
+	// LogCompression compresses the raft logs written: none, snappy or
+	// zstd. Logs are read whatever their compression.
+	LogCompression string
+	// LogFormat encodes the raft logs written: msgpack, json or binary.
+	// Logs are read whatever their format.
+	LogFormat string
+	// CommandFormat encodes FSM commands: msgpack, json or binary. Empty
+	// keeps the bare JSON of older versions, set it once every node reads
+	// formats.
+	CommandFormat string
+	// LogCompactTombstones compacts the raft log store once that many
+	// logs were truncated, and LogCompactInterval every interval if any
+	// were. 0 disables either.
+	LogCompactTombstones int
+	LogCompactInterval   time.Duration
+	// SnapshotRetain is the number of snapshots kept, older ones are
+	// restored if the latest fails verification. 0 keeps 2.
+	SnapshotRetain int
+	// BackupDir enables backups, snapshot archives written to this dir on
+	// BackupSchedule, a cron expression in UTC, @hourly if empty. The
+	// leader takes them, or the node of id BackupNode if set.
+	BackupDir      string
+	BackupSchedule string
+	BackupNode     string
+	// BackupKeepHourly and BackupKeepDaily keep the newest backup of that
+	// many recent hours and days, besides the newest one.
+	BackupKeepHourly int
+	BackupKeepDaily  int
+	// DebugFaults wraps the raft transport to inject network faults and
+	// serves /debug/faults, never enable it in production.
+	DebugFaults bool
 }
@@ -3,21 +3,28 @@ module github.com/00arthur00/leveldbraft
 go 1.14
 
 require (
-	github.com/aws/aws-sdk-go v1.27.0 // indirect
 	github.com/emicklei/go-restful v2.12.0+incompatible
 	github.com/emicklei/go-restful-openapi v1.3.0
+	github.com/fatih/color v1.9.0 // indirect
 	github.com/go-openapi/spec v0.0.0-20180415031709-bcff419492ee
-	github.com/google/btree v1.0.0 // indirect
-	github.com/hashicorp/consul v1.7.2
+	github.com/golang/snappy v0.0.1
 	github.com/hashicorp/go-hclog v0.12.0
-	github.com/hashicorp/go-version v1.2.0 // indirect
+	github.com/hashicorp/go-immutable-radix v1.1.0 // indirect
+	github.com/hashicorp/go-uuid v1.0.1 // indirect
+	github.com/hashicorp/golang-lru v0.5.1 // indirect
 	github.com/hashicorp/raft v1.1.2
-	github.com/hashicorp/raft-boltdb v0.0.0-20191021154308-4207f1bf0617 // indirect
+	github.com/klauspost/compress v1.11.13
+	github.com/kr/pretty v0.2.0 // indirect
+	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/oklog/oklog v0.3.2
-	github.com/prometheus/client_golang v1.3.0 // indirect
+	github.com/oklog/run v1.0.0 // indirect
+	github.com/prometheus/client_golang v1.3.0
+	github.com/stretchr/testify v1.4.0 // indirect
 	github.com/syndtr/goleveldb v1.0.0
 	github.com/ugorji/go/codec v0.0.0-20181204163529-d75b2dcb6bc8
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478 // indirect
 	golang.org/x/sys v0.0.0-20200420163511-1957bb5e6d1f // indirect
-	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
-	google.golang.org/grpc v1.26.0 // indirect
+	golang.org/x/text v0.3.2 // indirect
+	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
+	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// logCache holds the most recent logs in a ring buffer indexed by log
+// index, like raft.LogCache. A nil logCache caches nothing.
+type logCache struct {
+	mtx  sync.RWMutex
+	logs []*raft.Log
+}
+
+func newLogCache(size int) *logCache {
+	if size <= 0 {
+		return nil
+	}
+	return &logCache{logs: make([]*raft.Log, size)}
+}
+
+// get copies the log at index into log if it is cached.
+func (c *logCache) get(index uint64, log *raft.Log) bool {
+	if c == nil {
+		return false
+	}
+	c.mtx.RLock()
+	cached := c.logs[index%uint64(len(c.logs))]
+	c.mtx.RUnlock()
+	if cached == nil || cached.Index != index {
+		logCacheLookups.WithLabelValues("miss").Inc()
+		return false
+	}
+	logCacheLookups.WithLabelValues("hit").Inc()
+	*log = *cached
+	return true
+}
+
+// add caches logs, evicting the logs in their slots. The logs are copied,
+// their data is shared.
+func (c *logCache) add(logs []*raft.Log) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, log := range logs {
+		cached := *log
+		c.logs[log.Index%uint64(len(c.logs))] = &cached
+	}
+}
+
+// remove drops the cached logs from min to max, inclusive.
+func (c *logCache) remove(min, max uint64) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i, log := range c.logs {
+		if log != nil && log.Index >= min && log.Index <= max {
+			c.logs[i] = nil
+		}
+	}
+}
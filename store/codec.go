@@ -3,27 +3,300 @@ package store
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 
+	"github.com/hashicorp/raft"
 	"github.com/ugorji/go/codec"
 )
 
+// Format identifies a Codec. It is written as the leading byte of encoded
+// logs and commands, never renumber.
+type Format byte
+
+const (
+	FormatMsgpack Format = 1
+	FormatJSON    Format = 2
+	FormatBinary  Format = 3
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatMsgpack:
+		return "msgpack"
+	case FormatJSON:
+		return "json"
+	case FormatBinary:
+		return "binary"
+	}
+	return fmt.Sprintf("format(%d)", byte(f))
+}
+
+// ParseFormat returns the format named s: msgpack, json or binary.
+func ParseFormat(s string) (Format, error) {
+	for f := range codecs {
+		if f.String() == s {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown format %q", s)
+}
+
+// Codec encodes raft logs for storage and FSM commands for raft.
+type Codec interface {
+	Format() Format
+	EncodeLog(log *raft.Log) ([]byte, error)
+	DecodeLog(b []byte, log *raft.Log) error
+	EncodeCommand(cmd *LogEntryData) ([]byte, error)
+	DecodeCommand(b []byte, cmd *LogEntryData) error
+}
+
+var codecs = map[Format]Codec{
+	FormatMsgpack: msgpackCodec{},
+	FormatJSON:    jsonCodec{},
+	FormatBinary:  binaryCodec{},
+}
+
+// CodecOf returns the codec of format f.
+func CodecOf(f Format) (Codec, error) {
+	c, ok := codecs[f]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %d", byte(f))
+	}
+	return c, nil
+}
+
+// EncodeCommand encodes cmd with the codec of f, behind its format byte.
+func EncodeCommand(f Format, cmd *LogEntryData) ([]byte, error) {
+	c, err := CodecOf(f)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.EncodeCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(f)}, b...), nil
+}
+
+// DecodeCommand decodes a command encoded by EncodeCommand, or a bare JSON
+// command written before formats, which starts with '{'. Logs mixing
+// formats are decoded, so nodes can change format one at a time.
+func DecodeCommand(b []byte, cmd *LogEntryData) error {
+	if len(b) == 0 {
+		return errors.New("empty command")
+	}
+	if b[0] == '{' {
+		return json.Unmarshal(b, cmd)
+	}
+	c, err := CodecOf(Format(b[0]))
+	if err != nil {
+		return err
+	}
+	return c.DecodeCommand(b[1:], cmd)
+}
+
+// msgpackHandle is shared by all msgpack encoders and decoders, it is safe
+// for concurrent use once set up.
+var msgpackHandle = &codec.MsgpackHandle{}
+
 // Decode reverses the encode operation on a byte slice input
 func decodeMsgPack(buf []byte, out interface{}) error {
-	r := bytes.NewBuffer(buf)
-	hd := codec.MsgpackHandle{}
-	dec := codec.NewDecoder(r, &hd)
-	return dec.Decode(out)
+	return codec.NewDecoderBytes(buf, msgpackHandle).Decode(out)
 }
 
 // Encode writes an encoded object to a new bytes buffer
 func encodeMsgPack(in interface{}) (*bytes.Buffer, error) {
 	buf := bytes.NewBuffer(nil)
-	hd := codec.MsgpackHandle{}
-	enc := codec.NewEncoder(buf, &hd)
+	enc := codec.NewEncoder(buf, msgpackHandle)
 	err := enc.Encode(in)
 	return buf, err
 }
 
+// msgpackCodec is the encoding of logs before formats, as used by
+// raft-boltdb.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Format() Format { return FormatMsgpack }
+
+func (msgpackCodec) EncodeLog(log *raft.Log) ([]byte, error) {
+	buf, err := encodeMsgPack(log)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) DecodeLog(b []byte, log *raft.Log) error {
+	return decodeMsgPack(b, log)
+}
+
+func (msgpackCodec) EncodeCommand(cmd *LogEntryData) ([]byte, error) {
+	buf, err := encodeMsgPack(cmd)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) DecodeCommand(b []byte, cmd *LogEntryData) error {
+	return decodeMsgPack(b, cmd)
+}
+
+// jsonCodec is readable, and the encoding of commands before formats.
+type jsonCodec struct{}
+
+func (jsonCodec) Format() Format { return FormatJSON }
+
+func (jsonCodec) EncodeLog(log *raft.Log) ([]byte, error) {
+	return json.Marshal(log)
+}
+
+func (jsonCodec) DecodeLog(b []byte, log *raft.Log) error {
+	return json.Unmarshal(b, log)
+}
+
+func (jsonCodec) EncodeCommand(cmd *LogEntryData) ([]byte, error) {
+	return json.Marshal(cmd)
+}
+
+func (jsonCodec) DecodeCommand(b []byte, cmd *LogEntryData) error {
+	return json.Unmarshal(b, cmd)
+}
+
+// binaryCodec is a compact encoding of uvarints and length prefixed byte
+// strings, in field order.
+type binaryCodec struct{}
+
+func (binaryCodec) Format() Format { return FormatBinary }
+
+func (binaryCodec) EncodeLog(log *raft.Log) ([]byte, error) {
+	b := make([]byte, 0, 3*binary.MaxVarintLen64+len(log.Data)+len(log.Extensions)+2)
+	b = appendUvarint(b, log.Index)
+	b = appendUvarint(b, log.Term)
+	b = append(b, byte(log.Type))
+	b = appendBytes(b, log.Data)
+	return appendBytes(b, log.Extensions), nil
+}
+
+func (binaryCodec) DecodeLog(b []byte, log *raft.Log) error {
+	d := binaryDecoder{b: b}
+	log.Index = d.uvarint()
+	log.Term = d.uvarint()
+	log.Type = raft.LogType(d.byte())
+	log.Data = d.bytes()
+	log.Extensions = d.bytes()
+	return d.finish()
+}
+
+func (binaryCodec) EncodeCommand(cmd *LogEntryData) ([]byte, error) {
+	b := make([]byte, 0, 4*binary.MaxVarintLen64+len(cmd.Op)+len(cmd.Key)+len(cmd.Value)+len(cmd.Prev))
+	for _, s := range []string{string(cmd.Op), cmd.Key, cmd.Value, cmd.Prev} {
+		b = appendBytes(b, []byte(s))
+	}
+	// commands without a batch end here, as before batches
+	if len(cmd.Batch) == 0 {
+		return b, nil
+	}
+	b = appendUvarint(b, uint64(len(cmd.Batch)))
+	for i := range cmd.Batch {
+		sub, err := binaryCodec{}.EncodeCommand(&cmd.Batch[i])
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytes(b, sub)
+	}
+	return b, nil
+}
+
+func (binaryCodec) DecodeCommand(b []byte, cmd *LogEntryData) error {
+	d := binaryDecoder{b: b}
+	cmd.Op = OP(d.bytes())
+	cmd.Key = string(d.bytes())
+	cmd.Value = string(d.bytes())
+	cmd.Prev = string(d.bytes())
+	cmd.Batch = nil
+	if d.err == nil && len(d.b) > 0 {
+		n := d.uvarint()
+		if n > uint64(len(d.b)) {
+			return errShortBinary
+		}
+		cmd.Batch = make([]LogEntryData, n)
+		for i := range cmd.Batch {
+			sub := d.bytes()
+			if d.err != nil {
+				break
+			}
+			if err := (binaryCodec{}).DecodeCommand(sub, &cmd.Batch[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return d.finish()
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendBytes appends the length of p and p to b. Empty and nil slices
+// both decode as nil.
+func appendBytes(b, p []byte) []byte {
+	return append(appendUvarint(b, uint64(len(p))), p...)
+}
+
+// binaryDecoder reads the fields of binaryCodec, keeping the first error.
+type binaryDecoder struct {
+	b   []byte
+	err error
+}
+
+var errShortBinary = errors.New("binary: unexpected end of input")
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errShortBinary
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *binaryDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) == 0 {
+		d.err = errShortBinary
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *binaryDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	if uint64(len(d.b)) < n {
+		d.err = errShortBinary
+		return nil
+	}
+	v := append([]byte(nil), d.b[:n]...)
+	d.b = d.b[n:]
+	return v
+}
+
+// finish returns the first error, or an error if input is left.
+func (d *binaryDecoder) finish() error {
+	if d.err == nil && len(d.b) > 0 {
+		return fmt.Errorf("binary: %d trailing bytes", len(d.b))
+	}
+	return d.err
+}
+
 // Converts bytes to an integer
 func bytesToUint64(b []byte) uint64 {
 	return binary.BigEndian.Uint64(b)
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// commitRequest is a batch waiting for a group commit.
+type commitRequest struct {
+	batch *leveldb.Batch
+	// written runs once the batch is written, within the write
+	written func()
+	done    chan error
+}
+
+// groupCommitter coalesces batches committed concurrently into a single
+// write, so that they share one fsync. The first caller to find no write in
+// progress leads: it writes its batch and those queued meanwhile, until the
+// queue is empty.
+type groupCommitter struct {
+	mtx     sync.Mutex
+	queue   []*commitRequest
+	leading bool
+}
+
+// commit writes batch with write, possibly merged with other batches, and
+// returns the error of the write that included it. write calls its
+// function once the merged batch is written, which runs the written
+// functions of the batches merged, in order.
+func (g *groupCommitter) commit(batch *leveldb.Batch, written func(), write func(*leveldb.Batch, func()) error) error {
+	req := &commitRequest{batch: batch, written: written, done: make(chan error, 1)}
+	g.mtx.Lock()
+	g.queue = append(g.queue, req)
+	if g.leading {
+		g.mtx.Unlock()
+		return <-req.done
+	}
+
+	g.leading = true
+	for len(g.queue) > 0 {
+		group := g.queue
+		g.queue = nil
+		g.mtx.Unlock()
+
+		merged := group[0].batch
+		if len(group) > 1 {
+			merged = new(leveldb.Batch)
+			for _, r := range group {
+				// batches are replayed in order, later puts win as if
+				// written one after the other
+				r.batch.Replay(merged)
+			}
+		}
+		groupCommitSize.Observe(float64(len(group)))
+		err := write(merged, func() {
+			for _, r := range group {
+				r.written()
+			}
+		})
+		for _, r := range group {
+			r.done <- err
+		}
+
+		g.mtx.Lock()
+	}
+	g.leading = false
+	g.mtx.Unlock()
+	return <-req.done
+}
@@ -0,0 +1,178 @@
+package store
+
+import (
+	"io/ioutil"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Compaction triggers, the trigger label of the compaction metrics.
+const (
+	triggerTombstones = "tombstones"
+	triggerInterval   = "interval"
+	triggerManual     = "manual"
+)
+
+// compaction tracks the logs truncated since the last compaction. Their
+// tombstones keep the space of the logs until leveldb compacts the range,
+// which it otherwise does only once enough writes land on it, never for a
+// log appended at its end.
+type compaction struct {
+	tombstones int
+	interval   time.Duration
+
+	mtx sync.Mutex
+	// pending logs were deleted in [min, max]
+	pending  int
+	min, max uint64
+
+	// running is set while a background compaction runs, run serializes
+	// compactions
+	running int32
+	run     sync.Mutex
+}
+
+// add records n logs deleted in [min, max] and reports whether the
+// tombstone threshold is reached.
+func (c *compaction) add(min, max uint64, n int) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.pending == 0 || min < c.min {
+		c.min = min
+	}
+	if c.pending == 0 || max > c.max {
+		c.max = max
+	}
+	c.pending += n
+	return c.tombstones > 0 && c.pending >= c.tombstones
+}
+
+// take returns and forgets the pending range.
+func (c *compaction) take() (min, max uint64, n int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	min, max, n = c.min, c.max, c.pending
+	c.pending = 0
+	return min, max, n
+}
+
+// CompactionReport describes a compaction.
+type CompactionReport struct {
+	Trigger string `json:"trigger"`
+	// Tombstones is the number of truncated logs compacted.
+	Tombstones int `json:"tombstones"`
+	// BytesBefore and BytesAfter are the size of the db files.
+	BytesBefore int64   `json:"bytes_before"`
+	BytesAfter  int64   `json:"bytes_after"`
+	Seconds     float64 `json:"seconds"`
+}
+
+// truncated records logs deleted by DeleteRange, compacting them in the
+// background once the tombstone threshold is reached.
+func (ls *LevelDBStore) truncated(min, max uint64, n int) {
+	if n > 0 && ls.compaction.add(min, max, n) {
+		ls.compactAsync(triggerTombstones)
+	}
+}
+
+// Compact compacts the whole db, reclaiming the space of deleted logs and
+// overwritten stable keys. It waits for a running compaction.
+func (ls *LevelDBStore) Compact() (*CompactionReport, error) {
+	return ls.compact(triggerManual)
+}
+
+// compact compacts the pending range, or the whole db if triggered
+// manually. Nothing is done if no log is pending otherwise.
+func (ls *LevelDBStore) compact(trigger string) (*CompactionReport, error) {
+	c := &ls.compaction
+	c.run.Lock()
+	defer c.run.Unlock()
+
+	min, max, n := c.take()
+	r := util.Range{}
+	if trigger != triggerManual {
+		if n == 0 {
+			return nil, nil
+		}
+		r = util.Range{Start: ls.logKey(min), Limit: ls.logKey(max + 1)}
+		if max == math.MaxUint64 {
+			r.Limit = ls.logRange().Limit
+		}
+	}
+
+	report := &CompactionReport{
+		Trigger:     trigger,
+		Tombstones:  n,
+		BytesBefore: ls.diskBytes(),
+	}
+	begin := time.Now()
+	if err := ls.ldb.CompactRange(r); err != nil {
+		// compacted by the next one
+		c.add(min, max, n)
+		compactions.WithLabelValues(trigger, "error").Inc()
+		return nil, err
+	}
+	report.Seconds = time.Since(begin).Seconds()
+	report.BytesAfter = ls.diskBytes()
+
+	compactions.WithLabelValues(trigger, "ok").Inc()
+	compactionDuration.Observe(report.Seconds)
+	compactionDiskBytes.WithLabelValues("before").Set(float64(report.BytesBefore))
+	compactionDiskBytes.WithLabelValues("after").Set(float64(report.BytesAfter))
+	return report, nil
+}
+
+// compactAsync starts a compaction of the pending range unless one runs.
+// Close waits for it.
+func (ls *LevelDBStore) compactAsync(trigger string) {
+	if !atomic.CompareAndSwapInt32(&ls.compaction.running, 0, 1) {
+		return
+	}
+	ls.background.Add(1)
+	go func() {
+		defer ls.background.Done()
+		defer atomic.StoreInt32(&ls.compaction.running, 0)
+		// failures are counted by compact
+		ls.compact(trigger)
+	}()
+}
+
+// startCompactions compacts the pending range every interval, until Close.
+func (ls *LevelDBStore) startCompactions() {
+	if ls.compaction.interval <= 0 {
+		return
+	}
+	ls.background.Add(1)
+	go func() {
+		defer ls.background.Done()
+		ticker := time.NewTicker(ls.compaction.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ls.compactAsync(triggerInterval)
+			case <-ls.closing:
+				return
+			}
+		}
+	}()
+}
+
+// diskBytes returns the size of the db files, 0 if they cannot be listed.
+func (ls *LevelDBStore) diskBytes() int64 {
+	files, err := ioutil.ReadDir(ls.path)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			size += f.Size()
+		}
+	}
+	return size
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the codec of stored log payloads. Its value is written in
+// the entry header, never renumber.
+type Compression byte
+
+const (
+	CompressionNone   Compression = 0
+	CompressionSnappy Compression = 1
+	CompressionZstd   Compression = 2
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// ParseCompression returns the compression named s: none, snappy or zstd.
+func ParseCompression(s string) (Compression, error) {
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %q", s)
+}
+
+// zstd encoders and decoders run goroutines, they are shared and built on
+// first use.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func compress(c Compression, src []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return src, nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, src), nil
+	case CompressionZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(src, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", byte(c))
+}
+
+func decompress(c Compression, src []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return src, nil
+	case CompressionSnappy:
+		return snappy.Decode(nil, src)
+	case CompressionZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(src, nil)
+	}
+	return nil, fmt.Errorf("unknown compression %d", byte(c))
+}
@@ -0,0 +1,372 @@
+package store
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNoKeys is returned reading encrypted data without a KeyProvider.
+	ErrNoKeys = errors.New("encrypted data and no key provider")
+	// ErrUnknownKey is returned reading data encrypted with a key the
+	// KeyProvider does not hold.
+	ErrUnknownKey = errors.New("unknown encryption key")
+)
+
+// KeyProvider supplies the AES keys encrypting data at rest, 16, 24 or 32
+// bytes long. Keys are identified by an id stored with the data they
+// encrypt, a rotated out key must be kept until no data uses it.
+type KeyProvider interface {
+	// CurrentKey returns the key encrypting new data and its id.
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key of id, ErrUnknownKey if there is none.
+	Key(id uint32) ([]byte, error)
+}
+
+// MemKeyProvider holds keys in memory, a stand-in for tests.
+type MemKeyProvider struct {
+	mtx     sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewMemKeyProvider returns a provider holding one random key.
+func NewMemKeyProvider() *MemKeyProvider {
+	p := &MemKeyProvider{keys: map[uint32][]byte{}}
+	if _, err := p.Rotate(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Rotate makes a new random key current and returns its id.
+func (p *MemKeyProvider) Rotate() (uint32, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.current++
+	p.keys[p.current] = key
+	return p.current, nil
+}
+
+// Remove forgets the key of id.
+func (p *MemKeyProvider) Remove(id uint32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.keys, id)
+}
+
+func (p *MemKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *MemKeyProvider) Key(id uint32) ([]byte, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// FileKeyProvider reads keys from a file of "<id> <hex key>" lines, the
+// highest id being current. Blank lines and lines starting with # are
+// skipped. Rotate keys by adding a line and calling Reload.
+type FileKeyProvider struct {
+	path string
+	mem  MemKeyProvider
+}
+
+// NewFileKeyProvider reads the keys of the file at path.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the key file again, keeping the keys if it is invalid.
+func (p *FileKeyProvider) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := map[uint32][]byte{}
+	var current uint32
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want <id> <hex key>", p.path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return fmt.Errorf("%s:%d: invalid key id %q", p.path, line, fields[0])
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", p.path, line, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return fmt.Errorf("%s:%d: %v", p.path, line, err)
+		}
+		keys[uint32(id)] = key
+		if uint32(id) > current {
+			current = uint32(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if current == 0 {
+		return fmt.Errorf("%s: no key", p.path)
+	}
+
+	p.mem.mtx.Lock()
+	defer p.mem.mtx.Unlock()
+	p.mem.keys, p.mem.current = keys, current
+	return nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return p.mem.CurrentKey()
+}
+
+func (p *FileKeyProvider) Key(id uint32) ([]byte, error) {
+	return p.mem.Key(id)
+}
+
+// sealedHeaderSize is the size of the key id and nonce before a sealed
+// ciphertext.
+const sealedHeaderSize = 4 + 12
+
+// keyring seals and opens data with AES-GCM under the keys of a
+// KeyProvider. A nil keyring encrypts nothing.
+type keyring struct {
+	keys  KeyProvider
+	mtx   sync.Mutex
+	aeads map[string]cipher.AEAD
+}
+
+func newKeyring(keys KeyProvider) *keyring {
+	if keys == nil {
+		return nil
+	}
+	return &keyring{keys: keys, aeads: map[string]cipher.AEAD{}}
+}
+
+// aead returns the cipher of key, built once per key.
+func (k *keyring) aead(key []byte) (cipher.AEAD, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if aead, ok := k.aeads[string(key)]; ok {
+		return aead, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k.aeads[string(key)] = aead
+	return aead, nil
+}
+
+// current returns the id of the key sealing new data.
+func (k *keyring) current() (uint32, error) {
+	id, _, err := k.keys.CurrentKey()
+	return id, err
+}
+
+// seal encrypts plaintext with the current key, authenticating ad, and
+// appends the key id, nonce and ciphertext to dst.
+func (k *keyring) seal(dst, plaintext, ad []byte) ([]byte, error) {
+	id, key, err := k.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	var header [sealedHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], id)
+	if _, err := io.ReadFull(rand.Reader, header[4:]); err != nil {
+		return nil, err
+	}
+	dst = append(dst, header[:]...)
+	return aead.Seal(dst, header[4:], plaintext, ad), nil
+}
+
+// open decrypts data sealed by seal with the same ad.
+func (k *keyring) open(sealed, ad []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrNoKeys
+	}
+	if len(sealed) < sealedHeaderSize {
+		return nil, errors.New("truncated ciphertext")
+	}
+	key, err := k.keys.Key(sealedKeyID(sealed))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, sealed[4:sealedHeaderSize], sealed[sealedHeaderSize:], ad)
+}
+
+// sealedKeyID returns the id of the key that sealed data.
+func sealedKeyID(sealed []byte) uint32 {
+	return binary.BigEndian.Uint32(sealed[:4])
+}
+
+// Encrypted streams start with streamMagic, followed by frames of a big
+// endian uint32 length and a sealed chunk. The sequence number of a chunk
+// and whether it is the last are authenticated, so frames cannot be
+// reordered, dropped or truncated unnoticed.
+var streamMagic = []byte("LRE1")
+
+const streamChunkSize = 64 << 10
+
+// encryptWriter encrypts a stream written to w. Close writes the last
+// frame, it does not close w.
+type encryptWriter struct {
+	w    io.Writer
+	keys *keyring
+	buf  []byte
+	seq  uint64
+}
+
+func newEncryptWriter(w io.Writer, keys *keyring) (*encryptWriter, error) {
+	if _, err := w.Write(streamMagic); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, keys: keys, buf: make([]byte, 0, streamChunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(e.buf) == streamChunkSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):streamChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	frame, err := e.keys.seal(make([]byte, 4), e.buf, streamAD(e.seq, last))
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(frame)-4))
+	if _, err := e.w.Write(frame); err != nil {
+		return err
+	}
+	e.seq++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decryptReader decrypts a stream written by encryptWriter, after its
+// magic was read.
+type decryptReader struct {
+	r    io.Reader
+	keys *keyring
+	buf  []byte
+	seq  uint64
+	last bool
+}
+
+func newDecryptReader(r io.Reader, keys *keyring) *decryptReader {
+	return &decryptReader{r: r, keys: keys}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.last {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next frame.
+func (d *decryptReader) next() error {
+	var size [4]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		return fmt.Errorf("encrypted stream truncated: %w", err)
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > streamChunkSize+sealedHeaderSize+64 {
+		return fmt.Errorf("encrypted stream frame of %d bytes", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(d.r, frame); err != nil {
+		return fmt.Errorf("encrypted stream truncated: %w", err)
+	}
+	// the last frame is told apart by its authentication
+	buf, err := d.keys.open(frame, streamAD(d.seq, false))
+	if err != nil {
+		if buf, err = d.keys.open(frame, streamAD(d.seq, true)); err != nil {
+			return err
+		}
+		d.last = true
+	}
+	d.buf = buf
+	d.seq++
+	return nil
+}
+
+func streamAD(seq uint64, last bool) []byte {
+	ad := make([]byte, len(streamMagic)+9)
+	copy(ad, streamMagic)
+	binary.BigEndian.PutUint64(ad[len(streamMagic):], seq)
+	if last {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/hashicorp/raft"
+)
+
+// Log entries are stored as a version byte, a flags byte, the CRC32C of
+// the rest of the entry, the Format of the payload and the payload: the
+// raft.Log encoded by the codec of the format, compressed as the low bits
+// of flags tell and, if flagsEncrypted is set, sealed by a keyring which
+// authenticates the index, flags and format. Older entries are still
+// decoded: version 2 has no format byte and holds msgpack, version 1 has
+// no flags byte either and entries written before versioning are bare
+// msgpack maps.
+const (
+	entryVersion1 = 0x01
+	entryVersion2 = 0x02
+	entryVersion3 = 0x03
+	// entryHeaderSize is the header size of version 3 entries
+	entryHeaderSize = 7
+
+	// flagsCompression masks the Compression of the payload
+	flagsCompression = 0x0f
+	flagsEncrypted   = 0x10
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrChecksumMismatch is the cause of a CorruptionError of an entry
+	// whose payload does not match its checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrUnknownVersion is the cause of a CorruptionError of an entry
+	// with an unknown version byte.
+	ErrUnknownVersion = errors.New("unknown entry version")
+)
+
+// CorruptionError reports a stored log entry that cannot be trusted.
+type CorruptionError struct {
+	Index uint64
+	Err   error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("log %d corrupted: %v", e.Index, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// encodeLog returns the stored form of log, encoded by codec, compressed
+// with c unless that does not make it smaller and encrypted if keys is not
+// nil, and the size of its uncompressed encoding.
+func encodeLog(log *raft.Log, codec Codec, c Compression, keys *keyring) ([]byte, int, error) {
+	raw, err := codec.EncodeLog(log)
+	if err != nil {
+		return nil, 0, err
+	}
+	payload, err := compress(c, raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(payload) >= len(raw) {
+		payload, c = raw, CompressionNone
+	}
+
+	header := make([]byte, entryHeaderSize, entryHeaderSize+sealedHeaderSize+len(payload)+16)
+	header[0] = entryVersion3
+	header[1] = byte(c) & flagsCompression
+	header[6] = byte(codec.Format())
+	var val []byte
+	if keys != nil {
+		header[1] |= flagsEncrypted
+		if val, err = keys.seal(header, payload, entryAD(log.Index, header)); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		val = append(header, payload...)
+	}
+	binary.BigEndian.PutUint32(val[2:6], crc32.Checksum(val[6:], castagnoli))
+	return val, len(raw), nil
+}
+
+// decodeLog decodes the entry stored at index into log, returning a
+// *CorruptionError if it is damaged. keys decrypt encrypted entries.
+func decodeLog(index uint64, val []byte, log *raft.Log, keys *keyring) error {
+	format, payload, err := entryPayload(index, val, keys)
+	if err != nil {
+		if errors.Is(err, ErrNoKeys) || errors.Is(err, ErrUnknownKey) {
+			return err
+		}
+		return &CorruptionError{Index: index, Err: err}
+	}
+	codec, err := CodecOf(format)
+	if err != nil {
+		return &CorruptionError{Index: index, Err: err}
+	}
+	if err := codec.DecodeLog(payload, log); err != nil {
+		return &CorruptionError{Index: index, Err: err}
+	}
+	if log.Index != index {
+		return &CorruptionError{Index: index, Err: fmt.Errorf("entry holds log %d", log.Index)}
+	}
+	return nil
+}
+
+// entryPayload checks the header of the entry stored at index, decrypts
+// it and returns its format and uncompressed payload.
+func entryPayload(index uint64, val []byte, keys *keyring) (Format, []byte, error) {
+	if len(val) == 0 {
+		return 0, nil, errors.New("empty entry")
+	}
+	if legacyEntry(val) {
+		return FormatMsgpack, val, nil
+	}
+
+	// the checksum covers val[checked:]
+	var headerSize, checked int
+	switch val[0] {
+	case entryVersion1:
+		headerSize, checked = 5, 5
+	case entryVersion2:
+		headerSize, checked = 6, 6
+	case entryVersion3:
+		headerSize, checked = entryHeaderSize, 6
+	default:
+		return 0, nil, fmt.Errorf("%w %d", ErrUnknownVersion, val[0])
+	}
+	if len(val) < headerSize {
+		return 0, nil, errors.New("truncated entry header")
+	}
+	if binary.BigEndian.Uint32(val[checked-4:checked]) != crc32.Checksum(val[checked:], castagnoli) {
+		return 0, nil, ErrChecksumMismatch
+	}
+
+	format, c := FormatMsgpack, CompressionNone
+	if val[0] >= entryVersion2 {
+		c = Compression(val[1] & flagsCompression)
+	}
+	payload := val[headerSize:]
+	if val[0] == entryVersion3 {
+		format = Format(val[6])
+		if val[1]&flagsEncrypted != 0 {
+			var err error
+			if payload, err = keys.open(payload, entryAD(index, val[:headerSize])); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+	payload, err := decompress(c, payload)
+	return format, payload, err
+}
+
+// entryAD returns the data authenticated with the payload of an encrypted
+// entry: its index, flags and format, so entries cannot be swapped.
+func entryAD(index uint64, header []byte) []byte {
+	return append(uint64ToBytes(index), header[1], header[6])
+}
+
+// entryKeyID returns the id of the key encrypting a stored entry, false if
+// it is not encrypted.
+func entryKeyID(val []byte) (uint32, bool) {
+	if len(val) < entryHeaderSize+4 || val[0] != entryVersion3 || val[1]&flagsEncrypted == 0 {
+		return 0, false
+	}
+	return sealedKeyID(val[entryHeaderSize:]), true
+}
+
+// legacyEntry reports whether val is an unversioned entry, a raft.Log
+// encoded as a msgpack map.
+func legacyEntry(val []byte) bool {
+	return val[0]&0xf0 == 0x80 || val[0] == 0xde || val[0] == 0xdf
+}
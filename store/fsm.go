@@ -1,9 +1,13 @@
 package store
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
@@ -13,10 +17,18 @@ import (
 type FSM struct {
 	c   Cacher
 	log hclog.Logger
+	// keys encrypt snapshots, nil if disabled
+	keys *keyring
 }
 
-func NewFSM(c Cacher, log hclog.Logger) *FSM {
-	return &FSM{c, log}
+// NewFSM returns an FSM applying commands to c. Only the WithKeyProvider
+// option is used, to encrypt snapshots.
+func NewFSM(c Cacher, log hclog.Logger, opts ...option) *FSM {
+	conf := options{}
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	return &FSM{c: c, log: log, keys: newKeyring(conf.keys)}
 }
 
 type OP string
@@ -24,16 +36,41 @@ type OP string
 const (
 	OPSet OP = "set"
 	OPDel OP = "del"
+	// OPCAS sets Value if the key holds Prev.
+	OPCAS OP = "cas"
+	// OPAdd sets Value if the key is absent.
+	OPAdd OP = "add"
+	// OPBatch applies the commands of Batch in order, as one log entry.
+	OPBatch OP = "batch"
 )
 
+// ErrCompareFailed is the result of a cas whose key is absent or does not
+// hold the expected value.
+var ErrCompareFailed = errors.New("compare failed")
+
+// ErrUnknownOp is the result of a command this version cannot apply,
+// proposed by a newer node. Nothing of it is applied.
+var ErrUnknownOp = errors.New("unknown op")
+
 func (op OP) String() string {
 	return string(op)
 }
 
+// LogEntryData is an FSM command, encoded by EncodeCommand.
 type LogEntryData struct {
 	Op    OP
 	Key   string
 	Value string
+	Prev  string `json:",omitempty"`
+	// Batch are the commands of a batch, batches do not nest.
+	Batch []LogEntryData `json:",omitempty"`
+}
+
+// BatchResult is the result of a batch: the number of commands applied
+// and of those skipped as their key did not hold the value expected.
+type BatchResult struct {
+	Applied int
+	Skipped int
 }
 
 // Apply log is invoked once a log entry is committed.
@@ -42,18 +79,56 @@ type LogEntryData struct {
 // method was called on the same Raft node as the FSM.
 func (fsm *FSM) Apply(logEntry *raft.Log) interface{} {
 	var kv LogEntryData
-	if err := json.Unmarshal(logEntry.Data, &kv); err != nil {
+	if err := DecodeCommand(logEntry.Data, &kv); err != nil {
 		panic(fmt.Errorf("failed to apply request: %#v", logEntry))
 	}
-	var ret interface{}
+	ret := fsm.apply(&kv)
+	if err, ok := ret.(error); ok && errors.Is(err, ErrUnknownOp) {
+		fsm.log.Error("fsm.Apply() skipped a command, upgrade this node", "index", logEntry.Index, "error", err)
+	}
+	fsmApplyTotal.WithLabelValues(kv.Op.String()).Inc()
+	fsm.log.Debug("fms.Apply()", "op", kv.Op, "key", kv.Key, "ret", ret)
+	return ret
+}
+
+func (fsm *FSM) apply(kv *LogEntryData) interface{} {
 	switch kv.Op {
 	case OPDel:
 		fsm.c.Del(kv.Key)
 	case OPSet:
 		fsm.c.Set(kv.Key, kv.Value)
+	case OPCAS:
+		if current, ok := fsm.c.Get(kv.Key); !ok || current != kv.Prev {
+			return ErrCompareFailed
+		}
+		fsm.c.Set(kv.Key, kv.Value)
+	case OPAdd:
+		if _, ok := fsm.c.Get(kv.Key); ok {
+			return ErrCompareFailed
+		}
+		fsm.c.Set(kv.Key, kv.Value)
+	case OPBatch:
+		// a batch is applied whole or not at all
+		for i := range kv.Batch {
+			switch op := kv.Batch[i].Op; op {
+			case OPDel, OPSet, OPCAS, OPAdd:
+			default:
+				return fmt.Errorf("%w %q in batch", ErrUnknownOp, op)
+			}
+		}
+		result := &BatchResult{}
+		for i := range kv.Batch {
+			if fsm.apply(&kv.Batch[i]) != nil {
+				result.Skipped++
+				continue
+			}
+			result.Applied++
+		}
+		return result
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownOp, kv.Op)
 	}
-	fsm.log.Debug("fms.Apply(), logEntry:%s, ret:%v\n", logEntry.Data, ret)
-	return ret
+	return nil
 }
 
 // Snapshot is used to support log compaction. This call should
@@ -63,13 +138,31 @@ func (fsm *FSM) Apply(logEntry *raft.Log) interface{} {
 // the FSM should be implemented in a fashion that allows for concurrent
 // updates while a snapshot is happening.
 func (fsm *FSM) Snapshot() (raft.FSMSnapshot, error) {
-	return &snapshot{c: fsm.c}, nil
+	return &snapshot{c: fsm.c, keys: fsm.keys}, nil
 }
 
 // Restore is used to restore an FSM from a snapshot. It is not called
 // concurrently with any other command. The FSM must discard all previous
-// state.
+// state. Encrypted and plain snapshots are both restored.
 func (fsm *FSM) Restore(old io.ReadCloser) error {
 	defer old.Close()
-	return fsm.c.UnMarshal(old)
+	defer func(begin time.Time) {
+		snapshotRestoreDuration.Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	r := bufio.NewReader(old)
+	magic, err := r.Peek(len(streamMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.Equal(magic, streamMagic) {
+		return fsm.c.UnMarshal(ioutil.NopCloser(r))
+	}
+	if fsm.keys == nil {
+		return ErrNoKeys
+	}
+	if _, err := r.Discard(len(streamMagic)); err != nil {
+		return err
+	}
+	return fsm.c.UnMarshal(ioutil.NopCloser(newDecryptReader(r, fsm.keys)))
 }
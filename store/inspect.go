@@ -0,0 +1,91 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Stable keys of raft, see raft.go of hashicorp/raft.
+var (
+	keyCurrentTerm  = []byte("CurrentTerm")
+	keyLastVoteTerm = []byte("LastVoteTerm")
+	keyLastVoteCand = []byte("LastVoteCand")
+)
+
+// RaftState is the raft state held by a stable store.
+type RaftState struct {
+	CurrentTerm  uint64 `json:"current_term"`
+	LastVoteTerm uint64 `json:"last_vote_term"`
+	// LastVoteCandidate is the address voted for in LastVoteTerm.
+	LastVoteCandidate string `json:"last_vote_candidate"`
+}
+
+// OpenDataDir opens the log and stable stores of the data dir of a stopped
+// node, one store serving both in single db mode. Nothing is created or
+// migrated, and the stores refuse writes if readOnly is set.
+func OpenDataDir(readOnly bool, opts ...option) (logs *LevelDBStore, stable *LevelDBStore, err error) {
+	conf := defaultOptions()
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	ldbOptions := opt.Options{}
+	if conf.ldbOptions != nil {
+		ldbOptions = *conf.ldbOptions
+	}
+	ldbOptions.ReadOnly = readOnly
+	ldbOptions.ErrorIfMissing = true
+	conf.ldbOptions = &ldbOptions
+	conf.compactTombstones, conf.compactInterval = 0, 0
+
+	if exists(filepath.Join(conf.path, dbRaft)) {
+		conf.logPrefix, conf.stablePrefix = prefixLogs, prefixStable
+		db, err := open(filepath.Join(conf.path, dbRaft), conf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open %s: %w", dbRaft, err)
+		}
+		return db, db, nil
+	}
+
+	logConf := conf
+	logConf.holdsStable = false
+	if logs, err = open(filepath.Join(conf.path, dbLogs), logConf); err != nil {
+		return nil, nil, fmt.Errorf("open %s: %w", dbLogs, err)
+	}
+	stableConf := conf
+	stableConf.holdsLogs = false
+	if stable, err = open(filepath.Join(conf.path, dbConf), stableConf); err != nil {
+		logs.Close()
+		return nil, nil, fmt.Errorf("open %s: %w", dbConf, err)
+	}
+	return logs, stable, nil
+}
+
+// RaftState returns the current term and vote stored by raft.
+func (ls *LevelDBStore) RaftState() (*RaftState, error) {
+	s := &RaftState{}
+	var err error
+	if s.CurrentTerm, err = ls.GetUint64(keyCurrentTerm); err != nil {
+		return nil, err
+	}
+	if s.LastVoteTerm, err = ls.GetUint64(keyLastVoteTerm); err != nil {
+		return nil, err
+	}
+	cand, err := ls.Get(keyLastVoteCand)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	s.LastVoteCandidate = string(cand)
+	return s, nil
+}
+
+// ResetVote forgets the vote of the node, which may then vote again in
+// the current term. Two votes in a term can elect two leaders, this only
+// helps a node whose stable store holds a vote it never cast.
+func (ls *LevelDBStore) ResetVote() error {
+	if err := ls.Set(keyLastVoteCand, nil); err != nil {
+		return err
+	}
+	return ls.SetUint64(keyLastVoteTerm, 0)
+}
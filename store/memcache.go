@@ -10,6 +10,10 @@ type Cacher interface {
 	Get(k string) (string, bool)
 	Set(k, v string) error
 	Del(k string)
+	Len() int
+	// Range calls fn for every pair until it returns false, holding a
+	// consistent view of the cache.
+	Range(fn func(k, v string) bool)
 	Marshal() ([]byte, error)
 	UnMarshal(serialized io.ReadCloser) error
 }
@@ -38,14 +42,30 @@ func (c *cache) Get(k string) (string, bool) {
 	return val, ok
 }
 func (c *cache) Del(k string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.kv, k)
+}
+
+func (c *cache) Len() int {
 	c.mtx.RLock()
 	defer c.mtx.RUnlock()
-	delete(c.kv, k)
+	return len(c.kv)
+}
+
+func (c *cache) Range(fn func(k, v string) bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for k, v := range c.kv {
+		if !fn(k, v) {
+			return
+		}
+	}
 }
 
 func (c *cache) Marshal() ([]byte, error) {
 	c.mtx.RLock()
-	c.mtx.RUnlock()
+	defer c.mtx.RUnlock()
 	return json.Marshal(c.kv)
 }
 
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "leveldbraft"
+
+var (
+	// leveldb store operation latencies, labeled by operation name
+	storeOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of LevelDBStore operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 2, 16),
+	}, []string{"op"})
+
+	groupCommitSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "group_commit_size",
+		Help:      "Number of StoreLogs calls coalesced into one synced write.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 8),
+	})
+
+	// log cache lookups of GetLog, labeled by result: hit or miss
+	logCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "log_cache_lookups_total",
+		Help:      "Number of GetLog calls looked up in the log cache.",
+	}, []string{"result"})
+
+	// size of the logs written, labeled by kind: raw before compression
+	// or stored
+	logBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "log_bytes_total",
+		Help:      "Size of the raft logs written, before and after compression.",
+	}, []string{"kind"})
+
+	logCorruptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "log_corruptions_total",
+		Help:      "Number of damaged log entries read by GetLog.",
+	})
+
+	// rekey runs started after log truncations, labeled by result: ok
+	// or error
+	rekeyRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "rekey_runs_total",
+		Help:      "Number of runs re-encrypting logs and stable keys with the current key.",
+	}, []string{"result"})
+
+	rekeyedEntries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "rekeyed_entries_total",
+		Help:      "Number of logs and stable keys re-encrypted with the current key.",
+	})
+
+	// compactions of the db, labeled by trigger: tombstones, interval or
+	// manual, and result: ok or error
+	compactions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "compactions_total",
+		Help:      "Number of compactions reclaiming the space of truncated logs.",
+	}, []string{"trigger", "result"})
+
+	compactionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "compaction_duration_seconds",
+		Help:      "Latency of compactions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	// size of the db files around the last compaction, labeled by stage:
+	// before or after
+	compactionDiskBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "compaction_disk_bytes",
+		Help:      "Size of the db files before and after the last compaction.",
+	}, []string{"stage"})
+
+	// fsm applied commands, labeled by op
+	fsmApplyTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fsm",
+		Name:      "apply_total",
+		Help:      "Number of log entries applied to the FSM.",
+	}, []string{"op"})
+
+	snapshotPersistDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fsm",
+		Name:      "snapshot_persist_duration_seconds",
+		Help:      "Time spent persisting FSM snapshots.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	})
+
+	snapshotSizeBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fsm",
+		Name:      "snapshot_size_bytes",
+		Help:      "Size of persisted FSM snapshots.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 12),
+	})
+
+	snapshotCorruptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "snapshot_corruptions_total",
+		Help:      "Number of snapshots set aside after failing verification.",
+	})
+
+	snapshotRestoreDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fsm",
+		Name:      "snapshot_restore_duration_seconds",
+		Help:      "Time spent restoring the FSM from a snapshot.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		storeOpDuration,
+		groupCommitSize,
+		logCacheLookups,
+		logCorruptions,
+		logBytes,
+		rekeyRuns,
+		rekeyedEntries,
+		compactions,
+		compactionDuration,
+		compactionDiskBytes,
+		fsmApplyTotal,
+		snapshotPersistDuration,
+		snapshotSizeBytes,
+		snapshotCorruptions,
+		snapshotRestoreDuration,
+	)
+}
+
+// observeOp records the latency of a store operation started at begin.
+func observeOp(op string, begin time.Time) {
+	storeOpDuration.WithLabelValues(op).Observe(time.Since(begin).Seconds())
+}
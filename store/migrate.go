@@ -0,0 +1,172 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// migrateBatchSize bounds the memory used to copy a db.
+const migrateBatchSize = 1024
+
+// migratedMarker is written in the single db by a migration before it is
+// renamed into place, and removed once the old dbs are. Old dbs found
+// next to a single db without it were written after the migration, by a
+// node started without the single db.
+const migratedMarker = "MIGRATED"
+
+// ErrMixedLayout is returned when a data dir holds data in both the
+// single db and the logs and conf dbs, and neither can be dropped safely.
+var ErrMixedLayout = errors.New("data dir holds both the single db and the logs and conf dbs")
+
+// MigrateToSingleDB converts the logs and conf dbs of a data dir into the
+// single db opened by NewLevelDBStore. The copy is built aside, marked and
+// renamed into place, then the old dbs are removed, so an interrupted
+// migration is redone or finished on the next call. Old dbs next to an
+// unmarked single db fail with ErrMixedLayout. It reports whether it
+// copied data.
+func MigrateToSingleDB(opts ...option) (bool, error) {
+	conf := defaultOptions()
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	logsPath := filepath.Join(conf.path, dbLogs)
+	confPath := filepath.Join(conf.path, dbConf)
+	raftPath := filepath.Join(conf.path, dbRaft)
+	marker := filepath.Join(raftPath, migratedMarker)
+	old := exists(logsPath) || exists(confPath)
+
+	if exists(raftPath) {
+		if exists(marker) {
+			// a previous migration stopped before removing the old dbs
+			return false, removeMigrated(conf.path)
+		}
+		if old {
+			return false, fmt.Errorf("%w: %s, %s and %s", ErrMixedLayout, raftPath, logsPath, confPath)
+		}
+		return false, nil
+	}
+	if !old {
+		return false, nil
+	}
+
+	tmpPath := raftPath + ".migrating"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return false, err
+	}
+	dst, err := leveldb.OpenFile(tmpPath, conf.ldbOptions)
+	if err != nil {
+		return false, err
+	}
+	for _, src := range []struct {
+		path   string
+		prefix []byte
+	}{
+		{logsPath, prefixLogs},
+		{confPath, prefixStable},
+	} {
+		if !exists(src.path) {
+			continue
+		}
+		if err := copyDB(dst, src.path, src.prefix, conf.ldbOptions); err != nil {
+			dst.Close()
+			return false, err
+		}
+	}
+	if err := dst.Close(); err != nil {
+		return false, err
+	}
+	if err := writeSynced(filepath.Join(tmpPath, migratedMarker)); err != nil {
+		return false, err
+	}
+	if err := SyncDir(tmpPath); err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(tmpPath, raftPath); err != nil {
+		return false, err
+	}
+	if err := SyncDir(conf.path); err != nil {
+		return false, err
+	}
+	return true, removeMigrated(conf.path)
+}
+
+// removeMigrated removes the old dbs of a migrated data dir, then the
+// marker of the migration.
+func removeMigrated(dir string) error {
+	if err := os.RemoveAll(filepath.Join(dir, dbLogs)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(dir, dbConf)); err != nil {
+		return err
+	}
+	if err := SyncDir(dir); err != nil {
+		return err
+	}
+	raftPath := filepath.Join(dir, dbRaft)
+	if err := os.Remove(filepath.Join(raftPath, migratedMarker)); err != nil {
+		return err
+	}
+	return SyncDir(raftPath)
+}
+
+// writeSynced creates an empty file at path and syncs it.
+func writeSynced(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// copyDB copies every key of the db at path into dst, under prefix. The
+// last batch is synced.
+func copyDB(dst *leveldb.DB, path string, prefix []byte, o *opt.Options) error {
+	src, err := leveldb.OpenFile(path, o)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	iter := src.NewIterator(nil, nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		key := append(append([]byte(nil), prefix...), iter.Key()...)
+		batch.Put(key, iter.Value())
+		if batch.Len() >= migrateBatchSize {
+			if err := dst.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return dst.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// SyncDir flushes the entries of dir, making a rename in it durable.
+func SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+
+	"github.com/hashicorp/raft"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// stableMagic starts encrypted stable values. Values raft stores, uint64s
+// and server addresses, are shorter than any encrypted value or do not
+// start with a zero byte.
+var stableMagic = []byte{0x00, 'E', 0x01}
+
+// rekeyBatchSize bounds the logs rewritten while appends wait.
+const rekeyBatchSize = 256
+
+// encryptedStable reports whether a stable value is encrypted.
+func encryptedStable(val []byte) bool {
+	return len(val) >= len(stableMagic)+sealedHeaderSize+16 && bytes.HasPrefix(val, stableMagic)
+}
+
+// Rekey encrypts the logs and stable keys that are plaintext or encrypted
+// with another key than the current one with the current key, returning
+// how many it rewrote. It runs concurrently with raft. Damaged logs are
+// left as they are, for Scrub to report.
+func (ls *LevelDBStore) Rekey(ctx context.Context) (int, error) {
+	if ls.keys == nil {
+		return 0, ErrNoKeys
+	}
+	current, err := ls.keys.current()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	if ls.holdsLogs {
+		rekeyed, err := ls.rekeyLogs(ctx, current)
+		n += rekeyed
+		if err != nil {
+			return n, err
+		}
+	}
+	if ls.holdsStable {
+		rekeyed, err := ls.rekeyStable(current)
+		n += rekeyed
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (ls *LevelDBStore) rekeyLogs(ctx context.Context, current uint32) (int, error) {
+	var stale [][]byte
+	iter := ls.ldb.NewIterator(ls.logRange(), nil)
+	for iter.Next() {
+		if id, ok := entryKeyID(iter.Value()); !ok || id != current {
+			stale = append(stale, append([]byte(nil), iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for len(stale) > 0 {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		batch := stale
+		if len(batch) > rekeyBatchSize {
+			batch = batch[:rekeyBatchSize]
+		}
+		stale = stale[len(batch):]
+		rekeyed, err := ls.rekeyLogBatch(batch)
+		n += rekeyed
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// rekeyLogBatch rewrites the logs of keys, holding off appends and
+// truncations so that no log is resurrected or overwritten.
+func (ls *LevelDBStore) rekeyLogBatch(keys [][]byte) (int, error) {
+	ls.logMtx.Lock()
+	defer ls.logMtx.Unlock()
+	b := new(leveldb.Batch)
+	for _, key := range keys {
+		val, err := ls.ldb.Get(key, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		var log raft.Log
+		if err := decodeLog(bytesToUint64(key[len(ls.logPrefix):]), val, &log, ls.keys); err != nil {
+			if _, ok := err.(*CorruptionError); ok {
+				continue
+			}
+			return 0, err
+		}
+		val, _, err = encodeLog(&log, ls.codec, ls.compression, ls.keys)
+		if err != nil {
+			return 0, err
+		}
+		b.Put(key, val)
+	}
+	if err := ls.ldb.Write(b, ls.writeOptions()); err != nil {
+		return 0, err
+	}
+	rekeyedEntries.Add(float64(b.Len()))
+	return b.Len(), nil
+}
+
+func (ls *LevelDBStore) rekeyStable(current uint32) (int, error) {
+	ls.stableMtx.Lock()
+	defer ls.stableMtx.Unlock()
+	b := new(leveldb.Batch)
+	iter := ls.ldb.NewIterator(util.BytesPrefix(ls.stablePrefix), nil)
+	for iter.Next() {
+		val := iter.Value()
+		if encryptedStable(val) && sealedKeyID(val[len(stableMagic):]) == current {
+			continue
+		}
+		key := iter.Key()[len(ls.stablePrefix):]
+		if encryptedStable(val) {
+			var err error
+			if val, err = ls.keys.open(val[len(stableMagic):], key); err != nil {
+				iter.Release()
+				return 0, err
+			}
+		}
+		sealed, err := ls.keys.seal(append([]byte(nil), stableMagic...), val, key)
+		if err != nil {
+			iter.Release()
+			return 0, err
+		}
+		b.Put(append([]byte(nil), iter.Key()...), sealed)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if err := ls.ldb.Write(b, ls.writeOptions()); err != nil {
+		return 0, err
+	}
+	rekeyedEntries.Add(float64(b.Len()))
+	return b.Len(), nil
+}
+
+// rekeyAsync starts a Rekey unless one runs or the store has no keys. It
+// is stopped by Close.
+func (ls *LevelDBStore) rekeyAsync() {
+	if ls.keys == nil || !atomic.CompareAndSwapInt32(&ls.rekeying, 0, 1) {
+		return
+	}
+	ls.background.Add(1)
+	go func() {
+		defer ls.background.Done()
+		defer atomic.StoreInt32(&ls.rekeying, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-ls.closing:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		result := "ok"
+		if _, err := ls.Rekey(ctx); err != nil {
+			result = "error"
+		}
+		rekeyRuns.WithLabelValues(result).Inc()
+	}()
+}
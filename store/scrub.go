@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// IndexRange is an inclusive range of log indexes.
+type IndexRange struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+// ScrubReport is the result of verifying every entry of a log.
+type ScrubReport struct {
+	FirstIndex uint64 `json:"first_index"`
+	LastIndex  uint64 `json:"last_index"`
+	// Checked is the number of entries read.
+	Checked uint64 `json:"checked"`
+	// Corrupted entries fail their checksum or decoding.
+	Corrupted uint64 `json:"corrupted"`
+	// Missing indexes are gaps between the first and last index.
+	Missing uint64 `json:"missing"`
+	// Damaged are the ranges of corrupted or missing entries.
+	Damaged []IndexRange `json:"damaged"`
+}
+
+// OK reports whether no damage was found.
+func (r *ScrubReport) OK() bool {
+	return len(r.Damaged) == 0
+}
+
+// damage adds index to the damaged ranges, extending the last range if
+// index follows it.
+func (r *ScrubReport) damage(first, last uint64) {
+	if n := len(r.Damaged); n > 0 && r.Damaged[n-1].Last+1 == first {
+		r.Damaged[n-1].Last = last
+		return
+	}
+	r.Damaged = append(r.Damaged, IndexRange{First: first, Last: last})
+}
+
+// Scrub verifies every log entry of an open store. It reads a consistent
+// view of the db and runs concurrently with raft.
+func (ls *LevelDBStore) Scrub(ctx context.Context) (*ScrubReport, error) {
+	defer observeOp("scrub", time.Now())
+	iter := ls.ldb.NewIterator(ls.logRange(), nil)
+	defer iter.Release()
+	return scrub(ctx, iter, len(ls.logPrefix), ls.keys)
+}
+
+// ScrubDir verifies the log of a data dir whose node is stopped, in single
+// db mode if the dir holds a single db.
+func ScrubDir(ctx context.Context, opts ...option) (*ScrubReport, error) {
+	conf := defaultOptions()
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	path := filepath.Join(conf.path, dbLogs)
+	var prefix []byte
+	if exists(filepath.Join(conf.path, dbRaft)) {
+		path, prefix = filepath.Join(conf.path, dbRaft), prefixLogs
+	}
+
+	ldbOptions := opt.Options{}
+	if conf.ldbOptions != nil {
+		ldbOptions = *conf.ldbOptions
+	}
+	ldbOptions.ReadOnly = true
+	ldbOptions.ErrorIfMissing = true
+	db, err := leveldb.OpenFile(path, &ldbOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	ls := &LevelDBStore{ldb: db, path: path, logPrefix: prefix, keys: newKeyring(conf.keys)}
+	return ls.Scrub(ctx)
+}
+
+func scrub(ctx context.Context, iter iterator.Iterator, prefixLen int, keys *keyring) (*ScrubReport, error) {
+	r := &ScrubReport{}
+	var log raft.Log
+	for iter.Next() {
+		if r.Checked%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		index := bytesToUint64(iter.Key()[prefixLen:])
+		if r.Checked == 0 {
+			r.FirstIndex = index
+		} else if index > r.LastIndex+1 {
+			r.Missing += index - r.LastIndex - 1
+			r.damage(r.LastIndex+1, index-1)
+		}
+		r.LastIndex = index
+		r.Checked++
+
+		if err := decodeLog(index, iter.Value(), &log, keys); err != nil {
+			var corruption *CorruptionError
+			if !errors.As(err, &corruption) {
+				// missing keys are not damage of the log
+				return nil, err
+			}
+			r.Corrupted++
+			r.damage(index, index)
+		}
+	}
+	return r, iter.Error()
+}
@@ -1,13 +1,20 @@
 package store
 
-import "github.com/hashicorp/raft"
+import (
+	"io"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
 
 type snapshot struct {
-	c Cacher
+	c    Cacher
+	keys *keyring
 }
 
 // Persist saves the FSM snapshot out to the given sink.
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	begin := time.Now()
 
 	sinkWriteClose := func() error {
 		snapshotBytes, err := s.c.Marshal()
@@ -15,9 +22,10 @@ func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 			return err
 		}
 
-		if _, err := sink.Write(snapshotBytes); err != nil {
+		if err := s.write(sink, snapshotBytes); err != nil {
 			return err
 		}
+		snapshotSizeBytes.Observe(float64(len(snapshotBytes)))
 
 		if err := sink.Close(); err != nil {
 			return err
@@ -30,7 +38,24 @@ func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 		return err
 	}
 
+	snapshotPersistDuration.Observe(time.Since(begin).Seconds())
 	return nil
 }
 
+// write writes the snapshot to sink, encrypted if the FSM has keys.
+func (s *snapshot) write(sink io.Writer, snapshotBytes []byte) error {
+	if s.keys == nil {
+		_, err := sink.Write(snapshotBytes)
+		return err
+	}
+	w, err := newEncryptWriter(sink, s.keys)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(snapshotBytes); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
 func (f *snapshot) Release() {}
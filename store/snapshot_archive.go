@@ -0,0 +1,115 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+
+	"github.com/hashicorp/raft"
+)
+
+// Snapshot archives carry a snapshot out of and back into a cluster: the
+// magic, the archive version, the big endian uint32 length of the JSON
+// raft.SnapshotMeta, the meta, the state and the CRC64-ECMA of everything
+// before it.
+var snapshotArchiveMagic = []byte("LRSNAP")
+
+const snapshotArchiveVersion = 1
+
+// maxSnapshotMetaSize bounds the meta read from an archive.
+const maxSnapshotMetaSize = 16 << 20
+
+// ErrSnapshotArchive is the cause of errors reading an invalid archive.
+var ErrSnapshotArchive = errors.New("invalid snapshot archive")
+
+// WriteSnapshotArchive writes the archive of the snapshot of meta, whose
+// state is read from state.
+func WriteSnapshotArchive(w io.Writer, meta *raft.SnapshotMeta, state io.Reader) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	h := crc64.New(crc64Table)
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	header := make([]byte, len(snapshotArchiveMagic)+5)
+	copy(header, snapshotArchiveMagic)
+	header[len(snapshotArchiveMagic)] = snapshotArchiveVersion
+	binary.BigEndian.PutUint32(header[len(snapshotArchiveMagic)+1:], uint32(len(b)))
+	bw.Write(header)
+	bw.Write(b)
+	n, err := io.Copy(bw, state)
+	if err != nil {
+		return err
+	}
+	if n != meta.Size {
+		return fmt.Errorf("snapshot %s holds %d bytes, want %d", meta.ID, n, meta.Size)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err = w.Write(h.Sum(nil))
+	return err
+}
+
+// ReadSnapshotArchive reads an archive written by WriteSnapshotArchive,
+// copying the snapshot state to state, and returns its meta once the
+// archive is verified. The state copied is to be discarded on error.
+func ReadSnapshotArchive(r io.Reader, state io.Writer) (*raft.SnapshotMeta, error) {
+	h := crc64.New(crc64Table)
+	br := bufio.NewReader(r)
+	tr := io.TeeReader(br, h)
+
+	header := make([]byte, len(snapshotArchiveMagic)+5)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotArchive, err)
+	}
+	if !bytes.Equal(header[:len(snapshotArchiveMagic)], snapshotArchiveMagic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrSnapshotArchive)
+	}
+	if v := header[len(snapshotArchiveMagic)]; v != snapshotArchiveVersion {
+		return nil, fmt.Errorf("%w: unknown archive version %d", ErrSnapshotArchive, v)
+	}
+	size := binary.BigEndian.Uint32(header[len(snapshotArchiveMagic)+1:])
+	if size > maxSnapshotMetaSize {
+		return nil, fmt.Errorf("%w: meta of %d bytes", ErrSnapshotArchive, size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(tr, b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotArchive, err)
+	}
+	meta := &raft.SnapshotMeta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotArchive, err)
+	}
+	if meta.Version < raft.SnapshotVersionMin || meta.Version > raft.SnapshotVersionMax {
+		return nil, fmt.Errorf("%w: unsupported snapshot version %d", ErrSnapshotArchive, meta.Version)
+	}
+	if meta.Size < 0 {
+		return nil, fmt.Errorf("%w: snapshot of %d bytes", ErrSnapshotArchive, meta.Size)
+	}
+
+	n, err := io.Copy(state, io.LimitReader(tr, meta.Size))
+	if err != nil {
+		return nil, err
+	}
+	if n != meta.Size {
+		return nil, fmt.Errorf("%w: truncated state, %d bytes of %d", ErrSnapshotArchive, n, meta.Size)
+	}
+	sum := h.Sum(nil)
+	trailer := make([]byte, len(sum))
+	if _, err := io.ReadFull(br, trailer); err != nil {
+		return nil, fmt.Errorf("%w: truncated checksum", ErrSnapshotArchive)
+	}
+	if !bytes.Equal(trailer, sum) {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotArchive, ErrChecksumMismatch)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%w: trailing data", ErrSnapshotArchive)
+	}
+	return meta, nil
+}
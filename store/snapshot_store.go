@@ -0,0 +1,355 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	snapshotMetaFile  = "meta.json"
+	snapshotStateFile = "state.bin"
+	// suffixes of snapshots being written and of snapshots that failed
+	// verification, both skipped by List
+	snapshotTmpSuffix     = ".tmp"
+	snapshotCorruptSuffix = ".corrupt"
+)
+
+// ErrSnapshotCorrupt is the cause of errors opening a snapshot whose state
+// does not match its checksum or size.
+var ErrSnapshotCorrupt = errors.New("snapshot corrupt")
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// SnapshotStore is a raft.SnapshotStore keeping the retain latest
+// snapshots in a directory of their own, one sub directory per snapshot
+// holding its metadata and state. The layout and checksums are those of
+// raft.FileSnapshotStore, so either reads the snapshots of the other.
+//
+// Snapshots are verified on Open. A snapshot failing verification is
+// renamed with a .corrupt suffix, which drops it from List: raft then
+// restores or sends the previous snapshot instead.
+type SnapshotStore struct {
+	dir    string
+	retain int
+	log    hclog.Logger
+	// readOnly stores neither create nor set aside snapshots
+	readOnly bool
+}
+
+// snapshotMeta is the content of meta.json.
+type snapshotMeta struct {
+	raft.SnapshotMeta
+	// CRC is the CRC64-ECMA of the state
+	CRC []byte
+}
+
+// NewSnapshotStore opens the snapshot store in dir, creating it if needed,
+// and removes the snapshots left unfinished by a crash.
+func NewSnapshotStore(dir string, retain int, log hclog.Logger) (*SnapshotStore, error) {
+	if retain < 1 {
+		return nil, fmt.Errorf("retain %d snapshots, want at least 1", retain)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &SnapshotStore{dir: dir, retain: retain, log: log}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasSuffix(e.Name(), snapshotTmpSuffix) {
+			log.Warn("removing unfinished snapshot", "name", e.Name())
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// OpenSnapshotStore opens the snapshot store in dir read only, listing all
+// its snapshots. Snapshots failing verification are left in place.
+func OpenSnapshotStore(dir string, log hclog.Logger) (*SnapshotStore, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return &SnapshotStore{dir: dir, retain: math.MaxInt32, log: log, readOnly: true}, nil
+}
+
+// Create starts a snapshot, which becomes visible once its sink is closed.
+func (s *SnapshotStore) Create(version raft.SnapshotVersion, index, term uint64,
+	configuration raft.Configuration, configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+	if s.readOnly {
+		return nil, errors.New("snapshot store is read only")
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	id := fmt.Sprintf("%d-%d-%d", term, index, time.Now().UnixNano()/int64(time.Millisecond))
+	dir := filepath.Join(s.dir, id+snapshotTmpSuffix)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, snapshotStateFile))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	sink := &snapshotSink{
+		store: s,
+		dir:   dir,
+		meta: snapshotMeta{SnapshotMeta: raft.SnapshotMeta{
+			Version:            version,
+			ID:                 id,
+			Index:              index,
+			Term:               term,
+			Configuration:      configuration,
+			ConfigurationIndex: configurationIndex,
+		}},
+		file: f,
+		hash: crc64.New(crc64Table),
+	}
+	sink.w = bufio.NewWriter(io.MultiWriter(f, sink.hash))
+	return sink, nil
+}
+
+// List returns the retained snapshots, newest first.
+func (s *SnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	metas, err := s.snapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(metas) > s.retain {
+		metas = metas[:s.retain]
+	}
+	list := make([]*raft.SnapshotMeta, 0, len(metas))
+	for _, meta := range metas {
+		list = append(list, &meta.SnapshotMeta)
+	}
+	return list, nil
+}
+
+// snapshots returns the metadata of all snapshots, newest first.
+func (s *SnapshotStore) snapshots() ([]*snapshotMeta, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var metas []*snapshotMeta
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || strings.HasSuffix(name, snapshotTmpSuffix) || strings.HasSuffix(name, snapshotCorruptSuffix) {
+			continue
+		}
+		meta, err := s.readMeta(name)
+		if err != nil {
+			s.log.Warn("skipping snapshot with unreadable metadata", "name", name, "error", err)
+			continue
+		}
+		if meta.Version < raft.SnapshotVersionMin || meta.Version > raft.SnapshotVersionMax {
+			s.log.Warn("skipping snapshot of unsupported version", "name", name, "version", meta.Version)
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		a, b := metas[i], metas[j]
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		return a.ID > b.ID
+	})
+	return metas, nil
+}
+
+func (s *SnapshotStore) readMeta(id string) (*snapshotMeta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, id, snapshotMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	meta := &snapshotMeta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Open verifies the snapshot of id against its checksum and returns its
+// state. A snapshot failing verification is set aside.
+func (s *SnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(filepath.Join(s.dir, id, snapshotStateFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := verifySnapshot(meta, f); err != nil {
+		f.Close()
+		if errors.Is(err, ErrSnapshotCorrupt) && !s.readOnly {
+			s.quarantine(id, err)
+		}
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &meta.SnapshotMeta, &bufferedReadCloser{Reader: bufio.NewReader(f), Closer: f}, nil
+}
+
+// verifySnapshot reads the state r and checks its size and checksum.
+func verifySnapshot(meta *snapshotMeta, r io.Reader) error {
+	h := crc64.New(crc64Table)
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if n != meta.Size {
+		return fmt.Errorf("snapshot %s: %w: %d bytes, want %d", meta.ID, ErrSnapshotCorrupt, n, meta.Size)
+	}
+	if !bytes.Equal(h.Sum(nil), meta.CRC) {
+		return fmt.Errorf("snapshot %s: %w: %v", meta.ID, ErrSnapshotCorrupt, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// quarantine renames the snapshot of id so that List skips it, keeping it
+// for inspection.
+func (s *SnapshotStore) quarantine(id string, cause error) {
+	snapshotCorruptions.Inc()
+	s.log.Error("snapshot failed verification, falling back to the previous one", "id", id, "error", cause)
+	if err := os.Rename(filepath.Join(s.dir, id), filepath.Join(s.dir, id+snapshotCorruptSuffix)); err != nil {
+		s.log.Error("set aside corrupt snapshot", "id", id, "error", err)
+	}
+}
+
+// reap removes the snapshots past the retain latest.
+func (s *SnapshotStore) reap() error {
+	metas, err := s.snapshots()
+	if err != nil {
+		return err
+	}
+	for i := s.retain; i < len(metas); i++ {
+		s.log.Info("removing old snapshot", "id", metas[i].ID)
+		if err := os.RemoveAll(filepath.Join(s.dir, metas[i].ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type bufferedReadCloser struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// snapshotSink writes a snapshot to a temporary directory, renamed once
+// the state and metadata are synced.
+type snapshotSink struct {
+	store  *SnapshotStore
+	dir    string
+	meta   snapshotMeta
+	file   *os.File
+	hash   hash.Hash64
+	w      *bufio.Writer
+	closed bool
+}
+
+func (s *snapshotSink) ID() string {
+	return s.meta.ID
+}
+
+func (s *snapshotSink) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.meta.Size += int64(n)
+	return n, err
+}
+
+// Close makes the snapshot visible and removes the snapshots no longer
+// retained.
+func (s *snapshotSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.finish(); err != nil {
+		s.file.Close()
+		os.RemoveAll(s.dir)
+		return err
+	}
+	return s.store.reap()
+}
+
+func (s *snapshotSink) finish() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.meta.CRC = s.hash.Sum(nil)
+	b, err := json.Marshal(&s.meta)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(s.dir, snapshotMetaFile), b); err != nil {
+		return err
+	}
+	final := filepath.Join(s.store.dir, s.meta.ID)
+	if err := os.Rename(s.dir, final); err != nil {
+		return err
+	}
+	return SyncDir(s.store.dir)
+}
+
+// Cancel discards the snapshot.
+func (s *snapshotSink) Cancel() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.file.Close()
+	return os.RemoveAll(s.dir)
+}
+
+// writeFileSync writes b to a new file at path and syncs it.
+func writeFileSync(path string, b []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -2,8 +2,12 @@ package store
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -13,18 +17,70 @@ import (
 
 var (
 	// db dir suffix we perform transactions in
-	dbLogs         = "logs"
-	dbConf         = "conf"
+	dbLogs = "logs"
+	dbConf = "conf"
+	// dbRaft holds logs and stable keys in a single db
+	dbRaft         = "raft"
 	ErrKeyNotFound = errors.New("not found")
 )
 
-// LevelDBStore implements LogStore and StableStore with go leveldb.
+// Key prefixes of the namespaces of a single db.
+var (
+	prefixLogs   = []byte("l")
+	prefixStable = []byte("s")
+	// PrefixFSM is reserved for FSM data kept in the same db.
+	PrefixFSM = []byte("f")
+)
+
+// LevelDBStore implements LogStore and StableStore with go leveldb. Reads
+// rely on leveldb being safe for concurrent use and take no lock.
 type LevelDBStore struct {
+	// first and last log index, kept first for 64-bit alignment of atomic
+	// accesses
+	firstIndex uint64
+	lastIndex  uint64
+	// uncompressed and stored size of the logs written since open
+	rawLogBytes    uint64
+	storedLogBytes uint64
+	// indexes are loaded on first use, a db opened as stable store only
+	// never reads them
+	indexOnce sync.Once
+	indexErr  error
+	// logMtx serializes log writes with the updates of the indexes
+	logMtx sync.Mutex
+
 	// an open db, default isolation level: snapshot, read/batch write is atomic
 	ldb *leveldb.DB
 	// path to store data
-	path  string
-	rwMtx sync.RWMutex
+	path string
+	// key prefixes of logs and stable keys, empty if the db only holds one
+	// of them
+	logPrefix    []byte
+	stablePrefix []byte
+	// sync fsyncs log appends and stable keys, concurrent appends share
+	// an fsync through committer
+	sync      bool
+	committer groupCommitter
+	// cache holds recent logs, nil if disabled
+	cache *logCache
+	// codec and compression of the logs written
+	codec       Codec
+	compression Compression
+	// keys encrypt logs and stable keys, nil if disabled
+	keys *keyring
+	// stableMtx serializes stable key writes with their rekeying
+	stableMtx sync.Mutex
+	// whether the db holds logs and stable keys, rekeyed if so
+	holdsLogs   bool
+	holdsStable bool
+	// rekeying is set while a rekey runs
+	rekeying int32
+	// compaction of truncated logs, see compact.go
+	compaction compaction
+	// closing stops the background rekeys and compactions
+	closing    chan struct{}
+	closeOnce  sync.Once
+	background sync.WaitGroup
 }
 
 func NewLevelDBStableLogStore(opts ...option) (*LevelDBStore, error) {
@@ -35,8 +91,12 @@ func NewLevelDBStableLogStore(opts ...option) (*LevelDBStore, error) {
 		opt(&conf)
 	}
 
+	if err := checkTwoDBs(conf.path); err != nil {
+		return nil, err
+	}
 	path := filepath.Join(conf.path, dbConf)
-	return New(path, conf.ldbOptions)
+	conf.holdsLogs = false
+	return open(path, conf)
 }
 
 func NewLevelDBCommitLogStore(opts ...option) (*LevelDBStore, error) {
@@ -46,106 +106,269 @@ func NewLevelDBCommitLogStore(opts ...option) (*LevelDBStore, error) {
 		opt(&conf)
 	}
 
+	if err := checkTwoDBs(conf.path); err != nil {
+		return nil, err
+	}
 	path := filepath.Join(conf.path, dbLogs)
-	return New(path, conf.ldbOptions)
+	conf.holdsStable = false
+	return open(path, conf)
+
+}
+
+// checkTwoDBs refuses to open the logs and conf dbs of a data dir that was
+// migrated to the single db, where they would start empty.
+func checkTwoDBs(dir string) error {
+	if raftPath := filepath.Join(dir, dbRaft); exists(raftPath) {
+		return fmt.Errorf("%w: %s, open it as a single db", ErrMixedLayout, raftPath)
+	}
+	return nil
+}
 
+// NewLevelDBStore opens a single db holding both logs and stable keys,
+// under distinct key prefixes. It serves as both LogStore and StableStore.
+func NewLevelDBStore(opts ...option) (*LevelDBStore, error) {
+	conf := defaultOptions()
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	conf.logPrefix = prefixLogs
+	conf.stablePrefix = prefixStable
+	return open(filepath.Join(conf.path, dbRaft), conf)
 }
 
+// New opens the db at path, syncing writes.
 func New(path string, o *opt.Options) (*LevelDBStore, error) {
-	store, err := leveldb.OpenFile(path, o)
+	conf := defaultOptions()
+	conf.ldbOptions = o
+	return open(path, conf)
+}
+
+func open(path string, conf options) (*LevelDBStore, error) {
+	store, err := leveldb.OpenFile(path, conf.ldbOptions)
 	if err != nil {
 		return nil, err
 	}
-	return &LevelDBStore{path: path, ldb: store}, nil
+	ls := &LevelDBStore{
+		path:         path,
+		ldb:          store,
+		sync:         conf.sync,
+		logPrefix:    conf.logPrefix,
+		stablePrefix: conf.stablePrefix,
+		cache:        newLogCache(conf.logCacheSize),
+		codec:        conf.codec,
+		compression:  conf.compression,
+		keys:         newKeyring(conf.keys),
+		holdsLogs:    conf.holdsLogs,
+		holdsStable:  conf.holdsStable,
+		compaction: compaction{
+			tombstones: conf.compactTombstones,
+			interval:   conf.compactInterval,
+		},
+		closing: make(chan struct{}),
+	}
+	if ls.holdsLogs {
+		ls.startCompactions()
+	}
+	return ls, nil
+}
+
+// writeOptions returns the options of writes that must survive a power
+// loss when syncing.
+func (ls *LevelDBStore) writeOptions() *opt.WriteOptions {
+	return &opt.WriteOptions{Sync: ls.sync}
+}
+
+// logKey returns the db key of the log at index.
+func (ls *LevelDBStore) logKey(index uint64) []byte {
+	return append(append([]byte(nil), ls.logPrefix...), uint64ToBytes(index)...)
+}
+
+// stableKey returns the db key of a stable key.
+func (ls *LevelDBStore) stableKey(key []byte) []byte {
+	return append(append([]byte(nil), ls.stablePrefix...), key...)
+}
+
+// logRange returns the range of db keys holding logs.
+func (ls *LevelDBStore) logRange() *util.Range {
+	return util.BytesPrefix(ls.logPrefix)
 }
 
 func (ls *LevelDBStore) Close() error {
+	ls.closeOnce.Do(func() {
+		close(ls.closing)
+	})
+	ls.background.Wait()
 	return ls.ldb.Close()
 }
 
+// Ping returns an error if the underlying db has been closed.
+func (ls *LevelDBStore) Ping() error {
+	_, err := ls.ldb.GetProperty("leveldb.num-files-at-level0")
+	return err
+}
+
 // Set implements StableStore
 func (ls *LevelDBStore) Set(key []byte, val []byte) error {
-	ls.rwMtx.Lock()
-	defer ls.rwMtx.Unlock()
-	return ls.ldb.Put(key, val, nil)
+	defer observeOp("set", time.Now())
+	return ls.putStable(key, val)
 }
 
-// Get returns the value for key, or an empty byte slice if key was not found.
+// Get returns the value for key, or ErrKeyNotFound if key was not found, as
+// raft matches its message "not found".
 // StableStore
 func (ls *LevelDBStore) Get(key []byte) ([]byte, error) {
-	ls.rwMtx.Lock()
-	defer ls.rwMtx.Unlock()
-	val, err := ls.ldb.Get(key, nil)
-	if err != nil {
-		if err == leveldb.ErrNotFound {
-			return nil, ErrKeyNotFound
-		}
-		return nil, err
+	defer observeOp("get", time.Now())
+	val, err := ls.getStable(key)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrKeyNotFound
 	}
 	return val, err
 }
 
 // SetUint64 implements StableStore
 func (ls *LevelDBStore) SetUint64(key []byte, val uint64) error {
-	ls.rwMtx.Lock()
-	defer ls.rwMtx.Unlock()
-	return ls.ldb.Put(key, uint64ToBytes(val), nil)
+	defer observeOp("set_uint64", time.Now())
+	return ls.putStable(key, uint64ToBytes(val))
 }
 
 // GetUint64 returns the uint64 value for key, or 0 if key was not found.
 // StableStore
 func (ls *LevelDBStore) GetUint64(key []byte) (uint64, error) {
-	ls.rwMtx.Lock()
-	defer ls.rwMtx.Unlock()
-	val, err := ls.ldb.Get(key, nil)
+	defer observeOp("get_uint64", time.Now())
+	val, err := ls.getStable(key)
 	if err != nil {
 		if err == leveldb.ErrNotFound {
-			return 0, ErrKeyNotFound
+			return 0, nil
 		}
 		return 0, err
 	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("value of key %q is not a uint64", key)
+	}
 	return bytesToUint64(val), nil
 }
 
+// putStable writes a stable key, encrypted if the store has keys.
+func (ls *LevelDBStore) putStable(key, val []byte) error {
+	ls.stableMtx.Lock()
+	defer ls.stableMtx.Unlock()
+	if ls.keys != nil {
+		var err error
+		if val, err = ls.keys.seal(append([]byte(nil), stableMagic...), val, key); err != nil {
+			return err
+		}
+	}
+	return ls.ldb.Put(ls.stableKey(key), val, ls.writeOptions())
+}
+
+// getStable reads a stable key, decrypting it if it is encrypted.
+func (ls *LevelDBStore) getStable(key []byte) ([]byte, error) {
+	val, err := ls.ldb.Get(ls.stableKey(key), nil)
+	if err != nil || !encryptedStable(val) {
+		return val, err
+	}
+	return ls.keys.open(val[len(stableMagic):], key)
+}
+
 // FirstIndex returns the first index written. 0 for no entries.
 // LogStore.
 func (ls *LevelDBStore) FirstIndex() (uint64, error) {
-	ls.rwMtx.Lock()
-	defer ls.rwMtx.Unlock()
-
-	iter := ls.ldb.NewIterator(nil, nil)
-	defer iter.Release()
-	if iter.First() {
-		return bytesToUint64(iter.Key()), nil
+	defer observeOp("first_index", time.Now())
+	if err := ls.indexes(); err != nil {
+		return 0, err
 	}
-	return 0, nil
+	return atomic.LoadUint64(&ls.firstIndex), nil
 }
 
 // LastIndex returns the last index written. 0 for no entries.
 func (ls *LevelDBStore) LastIndex() (uint64, error) {
-	ls.rwMtx.Lock()
-	defer ls.rwMtx.Unlock()
-	iter := ls.ldb.NewIterator(nil, nil)
+	defer observeOp("last_index", time.Now())
+	if err := ls.indexes(); err != nil {
+		return 0, err
+	}
+	return atomic.LoadUint64(&ls.lastIndex), nil
+}
+
+// indexes loads the first and last index once.
+func (ls *LevelDBStore) indexes() error {
+	ls.indexOnce.Do(func() {
+		ls.logMtx.Lock()
+		defer ls.logMtx.Unlock()
+		ls.indexErr = ls.loadIndexes()
+	})
+	return ls.indexErr
+}
+
+// Stats are statistics of a store.
+type Stats struct {
+	Compression string `json:"compression"`
+	// RawLogBytes and StoredLogBytes are the size of the logs written
+	// since open, before and after compression.
+	RawLogBytes    uint64 `json:"raw_log_bytes"`
+	StoredLogBytes uint64 `json:"stored_log_bytes"`
+	// CompressionRatio is RawLogBytes over StoredLogBytes, 0 if no log was
+	// written.
+	CompressionRatio float64 `json:"compression_ratio"`
+	// DiskBytes is the size of the db files.
+	DiskBytes int64 `json:"disk_bytes"`
+}
+
+// Stats returns statistics of the store.
+func (ls *LevelDBStore) Stats() Stats {
+	stats := Stats{
+		Compression:    ls.compression.String(),
+		RawLogBytes:    atomic.LoadUint64(&ls.rawLogBytes),
+		StoredLogBytes: atomic.LoadUint64(&ls.storedLogBytes),
+		DiskBytes:      ls.diskBytes(),
+	}
+	if stats.StoredLogBytes > 0 {
+		stats.CompressionRatio = float64(stats.RawLogBytes) / float64(stats.StoredLogBytes)
+	}
+	return stats
+}
+
+// loadIndexes reads the first and last index from the db, ls.logMtx must be
+// held.
+func (ls *LevelDBStore) loadIndexes() error {
+	iter := ls.ldb.NewIterator(ls.logRange(), nil)
 	defer iter.Release()
+	var first, last uint64
+	if iter.First() {
+		first = bytesToUint64(iter.Key()[len(ls.logPrefix):])
+	}
 	if iter.Last() {
-		key := iter.Key()
-		return bytesToUint64(key), nil
+		last = bytesToUint64(iter.Key()[len(ls.logPrefix):])
 	}
-	return 0, nil
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&ls.firstIndex, first)
+	atomic.StoreUint64(&ls.lastIndex, last)
+	return nil
 }
 
-// GetLog gets a log entry at a given index.
+// GetLog gets a log entry at a given index, a *CorruptionError if the
+// stored entry is damaged.
 func (ls *LevelDBStore) GetLog(index uint64, log *raft.Log) error {
-	ls.rwMtx.Lock()
-	defer ls.rwMtx.Unlock()
-	val, err := ls.ldb.Get(uint64ToBytes(index), nil)
+	defer observeOp("get_log", time.Now())
+	if ls.cache.get(index, log) {
+		return nil
+	}
+	val, err := ls.ldb.Get(ls.logKey(index), nil)
 	if err != nil {
 		if err == leveldb.ErrNotFound {
 			return raft.ErrLogNotFound
 		}
 		return err
 	}
-	return decodeMsgPack(val, log)
+	if err := decodeLog(index, val, log, ls.keys); err != nil {
+		var corruption *CorruptionError
+		if errors.As(err, &corruption) {
+			logCorruptions.Inc()
+		}
+		return err
+	}
+	return nil
 }
 
 // StoreLog stores a log entry.
@@ -155,29 +378,99 @@ func (ls *LevelDBStore) StoreLog(log *raft.Log) error {
 
 // StoreLogs stores multiple log entries.
 func (ls *LevelDBStore) StoreLogs(logs []*raft.Log) error {
-	ls.rwMtx.Lock()
-	defer ls.rwMtx.Unlock()
-	b := leveldb.Batch{}
+	defer observeOp("store_logs", time.Now())
+	if len(logs) == 0 {
+		return nil
+	}
+	if err := ls.indexes(); err != nil {
+		return err
+	}
+	b := new(leveldb.Batch)
+	var raw, stored int
 	for _, log := range logs {
-		key := uint64ToBytes(log.Index)
-		val, err := encodeMsgPack(log)
+		key := ls.logKey(log.Index)
+		val, n, err := encodeLog(log, ls.codec, ls.compression, ls.keys)
 		if err != nil {
 			return err
 		}
-		b.Put(key, val.Bytes())
+		b.Put(key, val)
+		raw += n
+		stored += len(val)
 	}
 
-	return ls.ldb.Write(&b, nil)
+	// cached with the write, a DeleteRange in between would be undone
+	written := func() { ls.cache.add(logs) }
+	var err error
+	if ls.sync {
+		err = ls.committer.commit(b, written, ls.writeLogs)
+	} else {
+		err = ls.writeLogs(b, written)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&ls.rawLogBytes, uint64(raw))
+	atomic.AddUint64(&ls.storedLogBytes, uint64(stored))
+	logBytes.WithLabelValues("raw").Add(float64(raw))
+	logBytes.WithLabelValues("stored").Add(float64(stored))
+	return nil
+}
+
+// writeLogs writes a batch of logs, extends the indexes to them and calls
+// written, all under ls.logMtx.
+func (ls *LevelDBStore) writeLogs(b *leveldb.Batch, written func()) error {
+	ls.logMtx.Lock()
+	defer ls.logMtx.Unlock()
+	if err := ls.ldb.Write(b, ls.writeOptions()); err != nil {
+		return err
+	}
+
+	r := indexRange{prefixLen: len(ls.logPrefix)}
+	b.Replay(&r)
+	if first := atomic.LoadUint64(&ls.firstIndex); first == 0 || r.first < first {
+		atomic.StoreUint64(&ls.firstIndex, r.first)
+	}
+	if r.last > atomic.LoadUint64(&ls.lastIndex) {
+		atomic.StoreUint64(&ls.lastIndex, r.last)
+	}
+	written()
+	return nil
+}
+
+// indexRange collects the lowest and highest log index put by a batch.
+type indexRange struct {
+	prefixLen   int
+	first, last uint64
+}
+
+func (r *indexRange) Put(key, value []byte) {
+	index := bytesToUint64(key[r.prefixLen:])
+	if r.first == 0 || index < r.first {
+		r.first = index
+	}
+	if index > r.last {
+		r.last = index
+	}
 }
 
+func (r *indexRange) Delete(key []byte) {}
+
 // DeleteRange deletes a range of log entries. The range is inclusive.
 // LogStore
 func (ls *LevelDBStore) DeleteRange(min uint64, max uint64) error {
-	ls.rwMtx.Lock()
-	defer ls.rwMtx.Unlock()
+	defer observeOp("delete_range", time.Now())
+	if err := ls.indexes(); err != nil {
+		return err
+	}
+	ls.logMtx.Lock()
+	defer ls.logMtx.Unlock()
 	r := &util.Range{
-		Start: uint64ToBytes(min),
-		Limit: uint64ToBytes(max + 1),
+		Start: ls.logKey(min),
+		Limit: ls.logKey(max + 1),
+	}
+	if max == math.MaxUint64 {
+		// max+1 wraps around, range to the end of the logs
+		r.Limit = ls.logRange().Limit
 	}
 
 	iter := ls.ldb.NewIterator(r, nil)
@@ -188,5 +481,18 @@ func (ls *LevelDBStore) DeleteRange(min uint64, max uint64) error {
 		batch.Delete(iter.Key())
 	}
 
-	return ls.ldb.Write(batch, nil)
+	// not synced: truncated logs are either compacted away, or replaced by
+	// a synced append, which flushes the journal up to it
+	if err := ls.ldb.Write(batch, nil); err != nil {
+		return err
+	}
+	ls.cache.remove(min, max)
+	ls.truncated(min, max, batch.Len())
+	// truncating the log after a snapshot is the time to move the logs
+	// left to the current key
+	ls.rekeyAsync()
+	if min <= atomic.LoadUint64(&ls.firstIndex) || max >= atomic.LoadUint64(&ls.lastIndex) {
+		return ls.loadIndexes()
+	}
+	return nil
 }
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"time"
+
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
@@ -8,6 +10,24 @@ import (
 type options struct {
 	path       string
 	ldbOptions *opt.Options
+	sync       bool
+	// logCacheSize is the number of recent logs kept in memory
+	logCacheSize int
+	// codec and compression of the logs written
+	codec       Codec
+	compression Compression
+	// keys encrypt logs, stable keys and snapshots if set
+	keys KeyProvider
+	// truncated logs are compacted once compactTombstones were deleted, or
+	// every compactInterval, 0 disables either
+	compactTombstones int
+	compactInterval   time.Duration
+	// whether the db holds logs and stable keys
+	holdsLogs   bool
+	holdsStable bool
+	// key prefixes of logs and stable keys in a single db
+	logPrefix    []byte
+	stablePrefix []byte
 }
 
 func defaultOptions() options {
@@ -15,6 +35,10 @@ func defaultOptions() options {
 		ldbOptions: &opt.Options{
 			Filter: filter.NewBloomFilter(10),
 		},
+		sync:        true,
+		codec:       msgpackCodec{},
+		holdsLogs:   true,
+		holdsStable: true,
 	}
 }
 
@@ -31,3 +55,56 @@ func WithLevelDBConf(leveldbConf *opt.Options) option {
 		o.ldbOptions = leveldbConf
 	}
 }
+
+// WithSync sets whether log appends and stable keys are fsynced before
+// returning, true by default. Without sync a power loss can lose
+// acknowledged entries and votes.
+func WithSync(sync bool) option {
+	return func(o *options) {
+		o.sync = sync
+	}
+}
+
+// WithLogCache keeps the last size logs stored in memory, serving GetLog
+// without a db read. 0, the default, disables the cache.
+func WithLogCache(size int) option {
+	return func(o *options) {
+		o.logCacheSize = size
+	}
+}
+
+// WithCompression compresses the logs written with c, none by default.
+// Logs are read whatever their compression.
+func WithCompression(c Compression) option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// WithCodec encodes the logs written with codec, msgpack by default. Logs
+// are read whatever their codec.
+func WithCodec(codec Codec) option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithKeyProvider encrypts the logs and stable keys written, and the
+// snapshots of an FSM, with AES-GCM under the current key of keys.
+// Plaintext data written before stays readable.
+func WithKeyProvider(keys KeyProvider) option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithCompaction compacts the logs truncated by DeleteRange, reclaiming
+// their space, once tombstones logs were deleted since the last compaction
+// or every interval if any were. 0 disables either trigger, both are
+// disabled by default.
+func WithCompaction(tombstones int, interval time.Duration) option {
+	return func(o *options) {
+		o.compactTombstones = tombstones
+		o.compactInterval = interval
+	}
+}
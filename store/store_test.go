@@ -0,0 +1,799 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/00arthur00/leveldbraft/store/storetest"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// tempFactory returns a factory of single db stores opened with opts in a
+// temporary dir.
+func tempFactory(tb testing.TB, opts ...option) storetest.Factory {
+	dir := tempDir(tb)
+	return func() (storetest.Store, error) {
+		return NewLevelDBStore(append([]option{WithPath(dir)}, opts...)...)
+	}
+}
+
+// splitFactory returns a factory of logs and conf dbs opened with opts in
+// a temporary dir.
+func splitFactory(tb testing.TB, opts ...option) storetest.Factory {
+	dir := tempDir(tb)
+	opts = append([]option{WithPath(dir)}, opts...)
+	return func() (storetest.Store, error) {
+		logs, err := NewLevelDBCommitLogStore(opts...)
+		if err != nil {
+			return nil, err
+		}
+		stable, err := NewLevelDBStableLogStore(opts...)
+		if err != nil {
+			logs.Close()
+			return nil, err
+		}
+		return storetest.Split(logs, stable), nil
+	}
+}
+
+// tempDir returns a temporary dir removed when the test ends.
+func tempDir(tb testing.TB) string {
+	dir, err := ioutil.TempDir("", "leveldbstore")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestLevelDBStoreConformance(t *testing.T) {
+	storetest.Conformance(t, func(t *testing.T) storetest.Factory { return splitFactory(t) })
+}
+
+func TestLevelDBStoreSingleDBConformance(t *testing.T) {
+	storetest.Conformance(t, func(t *testing.T) storetest.Factory { return tempFactory(t) })
+}
+
+func TestLevelDBStoreLogCacheConformance(t *testing.T) {
+	// smaller than the logs generated, so that logs are evicted
+	storetest.Conformance(t, func(t *testing.T) storetest.Factory { return tempFactory(t, WithLogCache(16)) })
+}
+
+func TestLevelDBStoreCompressionConformance(t *testing.T) {
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd} {
+		opt := WithCompression(c)
+		t.Run(c.String(), func(t *testing.T) {
+			storetest.Conformance(t, func(t *testing.T) storetest.Factory { return tempFactory(t, opt) })
+		})
+	}
+}
+
+func TestLevelDBStoreCodecConformance(t *testing.T) {
+	for _, f := range []Format{FormatMsgpack, FormatJSON, FormatBinary} {
+		codec, _ := CodecOf(f)
+		opt := WithCodec(codec)
+		t.Run(f.String(), func(t *testing.T) {
+			storetest.Conformance(t, func(t *testing.T) storetest.Factory { return tempFactory(t, opt) })
+		})
+	}
+}
+
+func TestLevelDBStoreEncryptionConformance(t *testing.T) {
+	keys := WithKeyProvider(NewMemKeyProvider())
+	storetest.Conformance(t, func(t *testing.T) storetest.Factory {
+		return splitFactory(t, keys, WithCompression(CompressionSnappy))
+	})
+}
+
+func TestLevelDBStoreMixedFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldbstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each run appends logs encoded and compressed differently, all read
+	// back by the next runs
+	data := bytes.Repeat([]byte(`{"name":"leveldbraft","tags":["raft","leveldb"]}`), 32)
+	var index uint64
+	for _, run := range []struct {
+		f Format
+		c Compression
+	}{
+		{FormatMsgpack, CompressionNone},
+		{FormatBinary, CompressionSnappy},
+		{FormatJSON, CompressionZstd},
+		{FormatMsgpack, CompressionZstd},
+		{FormatBinary, CompressionNone},
+	} {
+		c := run.c
+		codec, _ := CodecOf(run.f)
+		ls, err := NewLevelDBStore(WithPath(dir), WithCodec(codec), WithCompression(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint64(1); i <= index; i++ {
+			var l raft.Log
+			if err := ls.GetLog(i, &l); err != nil || !bytes.Equal(l.Data, data) {
+				t.Fatalf("%s: GetLog(%d) returned %v", c, i, err)
+			}
+		}
+		var logs []*raft.Log
+		for i := 0; i < 10; i++ {
+			index++
+			logs = append(logs, &raft.Log{Index: index, Term: 1, Data: data})
+		}
+		if err := ls.StoreLogs(logs); err != nil {
+			t.Fatal(err)
+		}
+		stats := ls.Stats()
+		if c == CompressionNone && stats.CompressionRatio >= 1.01 || c != CompressionNone && stats.CompressionRatio < 5 {
+			t.Fatalf("%s: compression ratio %.2f", c, stats.CompressionRatio)
+		}
+		ls.Close()
+	}
+}
+
+func TestDecodeCommand(t *testing.T) {
+	cmd := LogEntryData{Op: OPCAS, Key: "k", Value: "v", Prev: "p"}
+	batch := LogEntryData{Op: OPBatch, Batch: []LogEntryData{
+		{Op: OPSet, Key: "a", Value: "1"},
+		{Op: OPAdd, Key: "b", Value: "2"},
+	}}
+	encoded := [][]byte{[]byte(`{"Op":"cas","Key":"k","Value":"v","Prev":"p"}`)}
+	for _, f := range []Format{FormatMsgpack, FormatJSON, FormatBinary} {
+		b, err := EncodeCommand(f, &cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, b)
+	}
+	for _, b := range encoded {
+		var got LogEntryData
+		if err := DecodeCommand(b, &got); err != nil || !reflect.DeepEqual(got, cmd) {
+			t.Fatalf("DecodeCommand(%q) returned %+v, %v, want %+v", b, got, err, cmd)
+		}
+	}
+	for _, f := range []Format{FormatMsgpack, FormatJSON, FormatBinary} {
+		b, err := EncodeCommand(f, &batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got LogEntryData
+		if err := DecodeCommand(b, &got); err != nil || !reflect.DeepEqual(got, batch) {
+			t.Fatalf("DecodeCommand(%q) of a %s batch returned %+v, %v, want %+v", b, f, got, err, batch)
+		}
+	}
+	for _, b := range [][]byte{nil, {0x7f}, {byte(FormatBinary), 1}} {
+		var got LogEntryData
+		if err := DecodeCommand(b, &got); err == nil {
+			t.Fatalf("DecodeCommand(%q) returned %+v, want an error", b, got)
+		}
+	}
+}
+
+func TestFSMApply(t *testing.T) {
+	c := NewCache()
+	fsm := NewFSM(c, hclog.NewNullLogger())
+	apply := func(cmd LogEntryData) interface{} {
+		b, err := EncodeCommand(FormatJSON, &cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsm.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: b})
+	}
+
+	if ret := apply(LogEntryData{Op: OPSet, Key: "a", Value: "1"}); ret != nil {
+		t.Fatalf("set returned %v", ret)
+	}
+	ret := apply(LogEntryData{Op: OPBatch, Batch: []LogEntryData{
+		{Op: OPAdd, Key: "a", Value: "2"},
+		{Op: OPAdd, Key: "b", Value: "2"},
+		{Op: OPCAS, Key: "a", Value: "3", Prev: "1"},
+	}})
+	if result, ok := ret.(*BatchResult); !ok || *result != (BatchResult{Applied: 2, Skipped: 1}) {
+		t.Fatalf("batch returned %#v, want 2 applied and 1 skipped", ret)
+	}
+
+	// commands of a newer version fail and change nothing
+	for _, cmd := range []LogEntryData{
+		{Op: "incr", Key: "a"},
+		{Op: OPBatch, Batch: []LogEntryData{{Op: OPSet, Key: "c", Value: "4"}, {Op: "incr", Key: "a"}}},
+		{Op: OPBatch, Batch: []LogEntryData{{Op: OPSet, Key: "c", Value: "4"}, {Op: OPBatch}}},
+	} {
+		if err, ok := apply(cmd).(error); !ok || !errors.Is(err, ErrUnknownOp) {
+			t.Fatalf("Apply(%+v) returned %v, want ErrUnknownOp", cmd, err)
+		}
+	}
+	for k, want := range map[string]string{"a": "3", "b": "2"} {
+		if v, _ := c.Get(k); v != want {
+			t.Fatalf("%s = %q, want %q", k, v, want)
+		}
+	}
+	if _, ok := c.Get("c"); ok {
+		t.Fatal("a batch failing on an unknown op was partly applied")
+	}
+}
+
+func BenchmarkStoreLogs(b *testing.B) {
+	storetest.BenchmarkStoreLogs(b, tempFactory(b))
+}
+
+func BenchmarkGetLogParallel(b *testing.B) {
+	storetest.BenchmarkGetLogParallel(b, tempFactory(b))
+}
+
+func BenchmarkIndexesParallel(b *testing.B) {
+	storetest.BenchmarkIndexesParallel(b, tempFactory(b))
+}
+
+func BenchmarkReplication(b *testing.B) {
+	storetest.BenchmarkReplication(b, tempFactory(b))
+}
+
+func BenchmarkReplicationLogCache(b *testing.B) {
+	storetest.BenchmarkReplication(b, tempFactory(b, WithLogCache(512)))
+}
+
+func TestLevelDBStoreCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldbstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ls, err := NewLevelDBStore(WithPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: []byte("data")})
+	}
+	if err := ls.StoreLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a payload bit of 4, drop 6, write 5 in version 2, 7 in version
+	// 1, 8 unversioned as before checksums and 9 with an unknown version
+	val, _ := ls.ldb.Get(ls.logKey(4), nil)
+	val[len(val)-1] ^= 1
+	ls.ldb.Put(ls.logKey(4), val, nil)
+	ls.ldb.Delete(ls.logKey(6), nil)
+	legacy, _ := encodeMsgPack(logs[4])
+	v2 := []byte{entryVersion2, byte(CompressionNone), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(v2[2:], crc32.Checksum(legacy.Bytes(), castagnoli))
+	ls.ldb.Put(ls.logKey(5), append(v2, legacy.Bytes()...), nil)
+	legacy, _ = encodeMsgPack(logs[6])
+	v1 := []byte{entryVersion1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(v1[1:], crc32.Checksum(legacy.Bytes(), castagnoli))
+	ls.ldb.Put(ls.logKey(7), append(v1, legacy.Bytes()...), nil)
+	legacy, _ = encodeMsgPack(logs[7])
+	ls.ldb.Put(ls.logKey(8), legacy.Bytes(), nil)
+	ls.ldb.Put(ls.logKey(9), []byte{0x7f, 0, 0, 0, 0}, nil)
+
+	var l raft.Log
+	var corruption *CorruptionError
+	if err := ls.GetLog(4, &l); !errors.As(err, &corruption) || corruption.Index != 4 || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("GetLog(4) returned %v, want a checksum mismatch of log 4", err)
+	}
+	if err := ls.GetLog(9, &l); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("GetLog(9) returned %v, want an unknown version", err)
+	}
+	for _, index := range []uint64{5, 7, 8} {
+		if err := ls.GetLog(index, &l); err != nil || l.Index != index || string(l.Data) != "data" {
+			t.Fatalf("GetLog(%d) returned %v, %+v, want the legacy entry", index, err, l)
+		}
+	}
+
+	want := &ScrubReport{
+		FirstIndex: 1,
+		LastIndex:  10,
+		Checked:    9,
+		Corrupted:  2,
+		Missing:    1,
+		Damaged:    []IndexRange{{4, 4}, {6, 6}, {9, 9}},
+	}
+	report, err := ls.Scrub(context.Background())
+	if err != nil || !reflect.DeepEqual(report, want) {
+		t.Fatalf("Scrub returned %+v, %v, want %+v", report, err, want)
+	}
+	if err := ls.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err = ScrubDir(context.Background(), WithPath(dir))
+	if err != nil || !reflect.DeepEqual(report, want) {
+		t.Fatalf("ScrubDir returned %+v, %v, want %+v", report, err, want)
+	}
+}
+
+func TestLevelDBStoreRekey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldbstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logs := func(first, last uint64) []*raft.Log {
+		var logs []*raft.Log
+		for i := first; i <= last; i++ {
+			logs = append(logs, &raft.Log{Index: i, Term: 1, Data: []byte("secret")})
+		}
+		return logs
+	}
+
+	// plaintext written before encryption, then logs of key 1
+	ls, err := NewLevelDBStore(WithPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.StoreLogs(logs(1, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Set([]byte("plain"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	ls.Close()
+	keys := NewMemKeyProvider()
+	ls, err = NewLevelDBStore(WithPath(dir), WithKeyProvider(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+	if err := ls.StoreLogs(logs(11, 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.SetUint64([]byte("term"), 7); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := keys.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ls.Rekey(context.Background()); err != nil || n != 22 {
+		t.Fatalf("Rekey returned %d, %v, want 22 rewritten", n, err)
+	}
+	keys.Remove(current - 1)
+
+	iter := ls.ldb.NewIterator(nil, nil)
+	for iter.Next() {
+		if bytes.Contains(iter.Value(), []byte("secret")) {
+			t.Errorf("key %q holds plaintext", iter.Key())
+		}
+		if bytes.HasPrefix(iter.Key(), ls.stablePrefix) {
+			if !encryptedStable(iter.Value()) || sealedKeyID(iter.Value()[len(stableMagic):]) != current {
+				t.Errorf("stable key %q not encrypted with key %d", iter.Key(), current)
+			}
+		} else if id, ok := entryKeyID(iter.Value()); !ok || id != current {
+			t.Errorf("log %q not encrypted with key %d", iter.Key(), current)
+		}
+	}
+	iter.Release()
+
+	var l raft.Log
+	for i := uint64(1); i <= 20; i++ {
+		if err := ls.GetLog(i, &l); err != nil || string(l.Data) != "secret" {
+			t.Fatalf("GetLog(%d) returned %v, %+v", i, err, l)
+		}
+	}
+	if v, err := ls.Get([]byte("plain")); err != nil || string(v) != "secret" {
+		t.Fatalf("Get returned %q, %v", v, err)
+	}
+	if v, err := ls.GetUint64([]byte("term")); err != nil || v != 7 {
+		t.Fatalf("GetUint64 returned %d, %v", v, err)
+	}
+	if n, err := ls.Rekey(context.Background()); err != nil || n != 0 {
+		t.Fatalf("second Rekey returned %d, %v, want nothing rewritten", n, err)
+	}
+
+	// a store without keys cannot read the logs
+	ls.Close()
+	ls, err = NewLevelDBStore(WithPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.GetLog(1, &l); !errors.Is(err, ErrNoKeys) {
+		t.Fatalf("GetLog without keys returned %v, want ErrNoKeys", err)
+	}
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	keys := NewMemKeyProvider()
+	c := NewCache()
+	// larger than a stream chunk
+	big := string(bytes.Repeat([]byte("v"), 3*streamChunkSize))
+	c.Set("key", big)
+	fsm := NewFSM(c, hclog.NewNullLogger(), WithKeyProvider(keys))
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sink.Bytes(), streamMagic) || bytes.Contains(sink.Bytes(), []byte("vvvv")) {
+		t.Fatal("snapshot not encrypted")
+	}
+
+	restored := NewCache()
+	if err := NewFSM(restored, hclog.NewNullLogger(), WithKeyProvider(keys)).Restore(sink.reader()); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := restored.Get("key"); v != big {
+		t.Fatal("restored snapshot differs")
+	}
+	if err := NewFSM(NewCache(), hclog.NewNullLogger()).Restore(sink.reader()); err != ErrNoKeys {
+		t.Fatalf("Restore without keys returned %v, want ErrNoKeys", err)
+	}
+	// truncated and plain snapshots
+	truncated := &memSink{}
+	truncated.Write(sink.Bytes()[:sink.Len()-streamChunkSize])
+	if err := NewFSM(NewCache(), hclog.NewNullLogger(), WithKeyProvider(keys)).Restore(truncated.reader()); err == nil {
+		t.Fatal("Restore of a truncated snapshot succeeded")
+	}
+	plain := &memSink{}
+	plain.WriteString(`{"key":"value"}`)
+	if err := NewFSM(restored, hclog.NewNullLogger(), WithKeyProvider(keys)).Restore(plain.reader()); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := restored.Get("key"); v != "value" {
+		t.Fatal("plain snapshot not restored")
+	}
+}
+
+// memSink is a raft.SnapshotSink in memory.
+type memSink struct {
+	bytes.Buffer
+}
+
+func (s *memSink) ID() string    { return "mem" }
+func (s *memSink) Cancel() error { return nil }
+func (s *memSink) Close() error  { return nil }
+
+func (s *memSink) reader() io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(s.Bytes()))
+}
+
+func TestLevelDBStoreCompaction(t *testing.T) {
+	dir := tempDir(t)
+	open := func() *LevelDBStore {
+		t.Helper()
+		ls, err := NewLevelDBStore(WithPath(dir), WithSync(false), WithCompaction(1000, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ls
+	}
+	ran := compactions.WithLabelValues(triggerTombstones, "ok")
+	runs := testutil.ToFloat64(ran)
+
+	ls := open()
+	// incompressible, leveldb compresses its tables
+	data := make([]byte, 4096)
+	rand.Read(data)
+	for first := uint64(1); first <= 2000; first += 100 {
+		var logs []*raft.Log
+		for i := first; i < first+100; i++ {
+			logs = append(logs, &raft.Log{Index: i, Term: 1, Data: data})
+		}
+		if err := ls.StoreLogs(logs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// below the threshold, Close waits for any background compaction
+	if err := ls.DeleteRange(1, 999); err != nil {
+		t.Fatal(err)
+	}
+	ls.Close()
+	if n := testutil.ToFloat64(ran) - runs; n != 0 {
+		t.Fatalf("%v compactions below the threshold, want 0", n)
+	}
+
+	// past it
+	ls = open()
+	before := ls.diskBytes()
+	if err := ls.DeleteRange(1000, 1999); err != nil {
+		t.Fatal(err)
+	}
+	ls.Close()
+	if n := testutil.ToFloat64(ran) - runs; n != 1 {
+		t.Fatalf("%v compactions past the threshold, want 1", n)
+	}
+	if after := ls.diskBytes(); before-after < 900*int64(len(data)) {
+		t.Fatalf("compaction of 1000 logs went from %d to %d bytes", before, after)
+	}
+
+	ls = open()
+	defer ls.Close()
+	report, err := ls.Compact()
+	if err != nil || report.Trigger != triggerManual {
+		t.Fatalf("Compact returned %+v, %v", report, err)
+	}
+	var l raft.Log
+	if err := ls.GetLog(2000, &l); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := ls.FirstIndex(); first != 2000 {
+		t.Fatalf("FirstIndex returned %d, want 2000", first)
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshotstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// snapshots of raft.FileSnapshotStore are read
+	legacy, err := raft.NewFileSnapshotStore(dir, 1, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(s raft.SnapshotStore, index uint64, state string) string {
+		sink, err := s.Create(1, index, 1, raft.Configuration{}, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.Write([]byte(state))
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return sink.ID()
+	}
+	open := func(s raft.SnapshotStore, id string) (string, error) {
+		_, rc, err := s.Open(id)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+	create(legacy, 10, "state 10")
+
+	s, err := NewSnapshotStore(filepath.Join(dir, "snapshots"), 2, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.List()
+	if err != nil || len(list) != 1 || list[0].Index != 10 {
+		t.Fatalf("List returned %v, %v, want the legacy snapshot", list, err)
+	}
+	if state, err := open(s, list[0].ID); err != nil || state != "state 10" {
+		t.Fatalf("Open returned %q, %v", state, err)
+	}
+
+	sink, err := s.Create(1, 15, 1, raft.Configuration{}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write([]byte("cancelled"))
+	sink.Cancel()
+	create(s, 20, "state 20")
+	latest := create(s, 30, "state 30")
+	entries, _ := ioutil.ReadDir(filepath.Join(dir, "snapshots"))
+	list, err = s.List()
+	if err != nil || len(list) != 2 || list[0].ID != latest || list[1].Index != 20 || len(entries) != 2 {
+		t.Fatalf("List returned %v, %v with %d dirs, want the snapshots of 30 and 20", list, err, len(entries))
+	}
+
+	// corrupt the latest, which is set aside
+	path := filepath.Join(dir, "snapshots", latest, snapshotStateFile)
+	if err := ioutil.WriteFile(path, []byte("state 31"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(s, latest); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("Open of a corrupt snapshot returned %v, want ErrSnapshotCorrupt", err)
+	}
+	list, err = s.List()
+	if err != nil || len(list) != 1 || list[0].Index != 20 {
+		t.Fatalf("List returned %v, %v, want the snapshot of 20", list, err)
+	}
+	if state, err := open(s, list[0].ID); err != nil || state != "state 20" {
+		t.Fatalf("Open returned %q, %v", state, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "snapshots", latest+snapshotCorruptSuffix)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a read only store leaves corrupt snapshots in place
+	path = filepath.Join(dir, "snapshots", list[0].ID, snapshotStateFile)
+	if err := ioutil.WriteFile(path, []byte("state 21"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := OpenSnapshotStore(filepath.Join(dir, "snapshots"), hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(ro, list[0].ID); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("Open of a corrupt snapshot returned %v, want ErrSnapshotCorrupt", err)
+	}
+	if roList, err := ro.List(); err != nil || len(roList) != 1 {
+		t.Fatalf("List returned %v, %v, want the corrupt snapshot kept", roList, err)
+	}
+	if _, err := ro.Create(1, 40, 1, raft.Configuration{}, 1, nil); err == nil {
+		t.Fatal("Create on a read only store succeeded")
+	}
+}
+
+func TestOpenDataDir(t *testing.T) {
+	for _, single := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "datadir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		var logs, stable *LevelDBStore
+		if single {
+			logs, err = NewLevelDBStore(WithPath(dir))
+			stable = logs
+		} else if logs, err = NewLevelDBCommitLogStore(WithPath(dir)); err == nil {
+			stable, err = NewLevelDBStableLogStore(WithPath(dir))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint64(1); i <= 5; i++ {
+			if err := logs.StoreLog(&raft.Log{Index: i, Term: 3, Type: raft.LogCommand, Data: []byte("data")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stable.SetUint64(keyCurrentTerm, 3)
+		stable.SetUint64(keyLastVoteTerm, 3)
+		stable.Set(keyLastVoteCand, []byte("node1"))
+		logs.Close()
+		stable.Close()
+
+		logs, stable, err = OpenDataDir(true, WithPath(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := RaftState{CurrentTerm: 3, LastVoteTerm: 3, LastVoteCandidate: "node1"}
+		if state, err := stable.RaftState(); err != nil || *state != want {
+			t.Fatalf("single db %v: RaftState returned %+v, %v, want %+v", single, state, err, want)
+		}
+		if last, err := logs.LastIndex(); err != nil || last != 5 {
+			t.Fatalf("single db %v: LastIndex returned %d, %v, want 5", single, last, err)
+		}
+		if err := logs.DeleteRange(4, 5); err == nil {
+			t.Fatalf("single db %v: DeleteRange on a read only store succeeded", single)
+		}
+		logs.Close()
+		if stable != logs {
+			stable.Close()
+		}
+
+		logs, stable, err = OpenDataDir(false, WithPath(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stable.ResetVote(); err != nil {
+			t.Fatal(err)
+		}
+		want = RaftState{CurrentTerm: 3}
+		if state, err := stable.RaftState(); err != nil || *state != want {
+			t.Fatalf("single db %v: RaftState after ResetVote returned %+v, %v, want %+v", single, state, err, want)
+		}
+		logs.Close()
+		if stable != logs {
+			stable.Close()
+		}
+	}
+}
+
+func TestMigrateToSingleDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logsPath, confPath := filepath.Join(dir, dbLogs), filepath.Join(dir, dbConf)
+	raftPath := filepath.Join(dir, dbRaft)
+	marker := filepath.Join(raftPath, migratedMarker)
+
+	logs, err := NewLevelDBCommitLogStore(WithPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stable, err := NewLevelDBStableLogStore(WithPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 5; i++ {
+		if err := logs.StoreLog(&raft.Log{Index: i, Term: 3, Data: []byte("data")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stable.SetUint64(keyCurrentTerm, 3)
+	logs.Close()
+	stable.Close()
+
+	// a copy left by an interrupted migration is redone
+	partial, err := NewLevelDBStore(WithPath(raftPath + ".migrating"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial.StoreLog(&raft.Log{Index: 9, Term: 9})
+	partial.Close()
+
+	migrated, err := MigrateToSingleDB(WithPath(dir))
+	if err != nil || !migrated {
+		t.Fatalf("MigrateToSingleDB returned %v, %v, want true", migrated, err)
+	}
+	for _, path := range []string{logsPath, confPath, raftPath + ".migrating", marker} {
+		if exists(path) {
+			t.Fatalf("%s left after the migration", path)
+		}
+	}
+	checkMigrated := func() {
+		t.Helper()
+		db, err := NewLevelDBStore(WithPath(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if last, err := db.LastIndex(); err != nil || last != 5 {
+			t.Fatalf("LastIndex returned %d, %v, want 5", last, err)
+		}
+		if term, err := db.GetUint64(keyCurrentTerm); err != nil || term != 3 {
+			t.Fatalf("GetUint64 returned %d, %v, want 3", term, err)
+		}
+	}
+	checkMigrated()
+	if migrated, err := MigrateToSingleDB(WithPath(dir)); err != nil || migrated {
+		t.Fatalf("second MigrateToSingleDB returned %v, %v, want false", migrated, err)
+	}
+
+	// old dbs left by a migration interrupted after the rename are removed
+	for _, path := range []string{logsPath, confPath} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeSynced(marker); err != nil {
+		t.Fatal(err)
+	}
+	if migrated, err := MigrateToSingleDB(WithPath(dir)); err != nil || migrated {
+		t.Fatalf("MigrateToSingleDB of leftovers returned %v, %v, want false", migrated, err)
+	}
+	for _, path := range []string{logsPath, confPath, marker} {
+		if exists(path) {
+			t.Fatalf("%s left after finishing the migration", path)
+		}
+	}
+	checkMigrated()
+
+	// old dbs written after the migration are neither opened nor removed
+	if _, err := NewLevelDBCommitLogStore(WithPath(dir)); !errors.Is(err, ErrMixedLayout) {
+		t.Fatalf("NewLevelDBCommitLogStore of a migrated dir returned %v, want ErrMixedLayout", err)
+	}
+	if _, err := NewLevelDBStableLogStore(WithPath(dir)); !errors.Is(err, ErrMixedLayout) {
+		t.Fatalf("NewLevelDBStableLogStore of a migrated dir returned %v, want ErrMixedLayout", err)
+	}
+	if err := os.MkdirAll(logsPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateToSingleDB(WithPath(dir)); !errors.Is(err, ErrMixedLayout) {
+		t.Fatalf("MigrateToSingleDB with both layouts returned %v, want ErrMixedLayout", err)
+	}
+	if !exists(logsPath) {
+		t.Fatal("MigrateToSingleDB removed logs written after the migration")
+	}
+}
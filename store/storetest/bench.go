@@ -0,0 +1,157 @@
+package storetest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// preload is the number of logs stored before read benchmarks start.
+const preload = 10000
+
+// BenchmarkStoreLogs measures appends of batches of 16 logs.
+func BenchmarkStoreLogs(b *testing.B, open Factory) {
+	s := openBench(b, open)
+	index := uint64(1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch := benchLogs(index, 16)
+		index += 16
+		if err := s.StoreLogs(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetLogParallel measures concurrent random reads of logs.
+func BenchmarkGetLogParallel(b *testing.B, open Factory) {
+	s := openBench(b, open)
+	store(b, s, benchLogs(1, preload))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		var l raft.Log
+		for pb.Next() {
+			if err := s.GetLog(uint64(rng.Intn(preload)+1), &l); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkIndexesParallel measures concurrent FirstIndex and LastIndex
+// calls.
+func BenchmarkIndexesParallel(b *testing.B, open Factory) {
+	s := openBench(b, open)
+	store(b, s, benchLogs(1, preload))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.FirstIndex(); err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := s.LastIndex(); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkReplication mimics a leader: one goroutine appends logs and
+// compacts the head of the log, while parallel replication goroutines read
+// the last index and the logs behind it. An op is one read.
+func BenchmarkReplication(b *testing.B, open Factory) {
+	s := openBench(b, open)
+	store(b, s, benchLogs(1, preload))
+
+	var last uint64 = preload
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			next := atomic.LoadUint64(&last) + 1
+			if err := s.StoreLogs(benchLogs(next, 16)); err != nil {
+				b.Error(err)
+				return
+			}
+			atomic.StoreUint64(&last, next+15)
+			if next%1024 == 1 {
+				// keep the last preload logs, like raft after a snapshot
+				if err := s.DeleteRange(0, next-preload); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		var l raft.Log
+		for pb.Next() {
+			lastIndex, err := s.LastIndex()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			index := lastIndex - uint64(rng.Intn(64))
+			if err := s.GetLog(index, &l); err != nil {
+				b.Errorf("GetLog(%d): %v", index, err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func openBench(b *testing.B, open Factory) Store {
+	b.Helper()
+	s, err := open()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+func store(b *testing.B, s Store, logs []*raft.Log) {
+	b.Helper()
+	for len(logs) > 0 {
+		n := 1024
+		if n > len(logs) {
+			n = len(logs)
+		}
+		if err := s.StoreLogs(logs[:n]); err != nil {
+			b.Fatal(err)
+		}
+		logs = logs[n:]
+	}
+}
+
+// benchLogs returns n logs from first, with 128 byte payloads.
+func benchLogs(first uint64, n int) []*raft.Log {
+	logs := make([]*raft.Log, n)
+	for i := range logs {
+		index := first + uint64(i)
+		data := []byte(fmt.Sprintf("%0128d", index))
+		logs[i] = &raft.Log{Index: index, Term: 1, Type: raft.LogCommand, Data: data}
+	}
+	return logs
+}
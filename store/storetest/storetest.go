@@ -0,0 +1,370 @@
+// Package storetest checks raft log and stable stores against
+// raft.InmemStore, the reference implementation shipped with raft.
+package storetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// Store is a raft log and stable store under test.
+type Store interface {
+	logStableStore
+	io.Closer
+}
+
+type logStableStore interface {
+	raft.LogStore
+	raft.StableStore
+}
+
+// Factory opens a store. Stores opened by the same factory after Close must
+// find the data written before, as if the process restarted.
+type Factory func() (Store, error)
+
+// Split pairs a log store and a stable store kept apart, as nodes do.
+func Split(logs, stable Store) Store {
+	return &split{LogStore: logs, StableStore: stable, closers: []io.Closer{logs, stable}}
+}
+
+type split struct {
+	raft.LogStore
+	raft.StableStore
+	closers []io.Closer
+}
+
+func (s *split) Close() error {
+	var err error
+	for _, c := range s.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// maxIndex bounds the indexes of generated logs so that operations collide.
+const maxIndex = 64
+
+// Conformance runs fixed and randomized operation sequences against the
+// stores made by fresh and against raft.InmemStore, failing t on the first
+// result that differs. fresh returns the factory of a new empty store.
+//
+// Stable keys and uint64 stable keys are kept apart, as InmemStore holds
+// them in separate namespaces. FirstIndex and LastIndex must return the
+// lowest and highest index holding a log: InmemStore only tracks bounds,
+// which drift from its logs once they have gaps.
+func Conformance(t *testing.T, fresh func(t *testing.T) Factory) {
+	t.Run("Empty", func(t *testing.T) {
+		c := newChecker(t, fresh(t))
+		c.compare()
+		c.do(getLog{1})
+		c.do(get{"k0"})
+		c.do(getUint64{"u0"})
+		c.do(deleteRange{1, 10})
+		c.compare()
+	})
+
+	t.Run("Gaps", func(t *testing.T) {
+		c := newChecker(t, fresh(t))
+		c.do(storeLogs{logs(1, 3)})
+		c.do(storeLogs{logs(7, 9)})
+		c.compare()
+		c.do(deleteRange{1, 3})
+		c.compare()
+		c.do(storeLogs{logs(12, 12)})
+		c.do(deleteRange{8, 12})
+		c.compare()
+	})
+
+	t.Run("DeleteRange", func(t *testing.T) {
+		for _, r := range []deleteRange{
+			{0, 0},
+			{5, 3},
+			{1, 1},
+			{10, 10},
+			{4, 6},
+			{11, 20},
+			{0, 5},
+			{8, math.MaxUint64},
+			{1, 10},
+			{0, math.MaxUint64},
+		} {
+			c := newChecker(t, fresh(t))
+			c.do(storeLogs{logs(1, 10)})
+			c.do(r)
+			c.compare()
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		c := newChecker(t, fresh(t))
+		c.do(storeLogs{logs(1, 20)})
+		c.do(deleteRange{1, 5})
+		c.do(set{"k0", []byte("v0")})
+		c.do(setUint64{"u0", 42})
+		c.do(reopen{})
+		c.compare()
+		c.do(deleteRange{15, 20})
+		c.do(reopen{})
+		c.compare()
+	})
+
+	t.Run("Randomized", func(t *testing.T) {
+		for seed := int64(1); seed <= 20; seed++ {
+			c := newChecker(t, fresh(t))
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				c.do(randomOp(rng))
+				if i%20 == 0 {
+					c.compare()
+				}
+			}
+			c.compare()
+		}
+	})
+}
+
+// op is an operation run on both stores. run returns a description of its
+// result, compared between the stores.
+type op interface {
+	run(s logStableStore) string
+	String() string
+}
+
+type storeLogs struct{ logs []*raft.Log }
+type getLog struct{ index uint64 }
+type deleteRange struct{ min, max uint64 }
+type set struct {
+	key   string
+	value []byte
+}
+type get struct{ key string }
+type setUint64 struct {
+	key   string
+	value uint64
+}
+type getUint64 struct{ key string }
+
+// reopen closes and reopens the store under test, the reference store is
+// kept as is.
+type reopen struct{}
+
+func (o storeLogs) String() string {
+	var b bytes.Buffer
+	for _, l := range o.logs {
+		fmt.Fprintf(&b, " {%s}", formatLog(l))
+	}
+	return "StoreLogs" + b.String()
+}
+
+func (o getLog) String() string      { return fmt.Sprintf("GetLog(%d)", o.index) }
+func (o deleteRange) String() string { return fmt.Sprintf("DeleteRange(%d, %d)", o.min, o.max) }
+func (o set) String() string         { return fmt.Sprintf("Set(%s, %x)", o.key, o.value) }
+func (o get) String() string         { return fmt.Sprintf("Get(%s)", o.key) }
+func (o setUint64) String() string   { return fmt.Sprintf("SetUint64(%s, %d)", o.key, o.value) }
+func (o getUint64) String() string   { return fmt.Sprintf("GetUint64(%s)", o.key) }
+func (o reopen) String() string      { return "reopen" }
+
+func (o storeLogs) run(s logStableStore) string {
+	// stores may keep the logs given, pass copies
+	copies := make([]*raft.Log, len(o.logs))
+	for i, l := range o.logs {
+		c := *l
+		copies[i] = &c
+	}
+	return errString(s.StoreLogs(copies))
+}
+
+func (o getLog) run(s logStableStore) string {
+	var l raft.Log
+	if err := s.GetLog(o.index, &l); err != nil {
+		return errString(err)
+	}
+	return formatLog(&l)
+}
+
+func (o deleteRange) run(s logStableStore) string {
+	if _, ok := s.(*raft.InmemStore); ok && o.max > maxIndex+16 {
+		// InmemStore visits every index of the range
+		o.max = maxIndex + 16
+	}
+	return errString(s.DeleteRange(o.min, o.max))
+}
+
+func (o set) run(s logStableStore) string {
+	return errString(s.Set([]byte(o.key), o.value))
+}
+
+func (o get) run(s logStableStore) string {
+	v, err := s.Get([]byte(o.key))
+	if err != nil {
+		return errString(err)
+	}
+	return fmt.Sprintf("%x", v)
+}
+
+func (o setUint64) run(s logStableStore) string {
+	return errString(s.SetUint64([]byte(o.key), o.value))
+}
+
+func (o getUint64) run(s logStableStore) string {
+	v, err := s.GetUint64([]byte(o.key))
+	return fmt.Sprintf("%d %s", v, errString(err))
+}
+
+func (o reopen) run(s logStableStore) string {
+	return ""
+}
+
+// errString returns the message of err, as raft compares stable store
+// errors by message.
+func errString(err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	return err.Error()
+}
+
+func formatLog(l *raft.Log) string {
+	return fmt.Sprintf("index=%d term=%d type=%d data=%x extensions=%x", l.Index, l.Term, l.Type, l.Data, l.Extensions)
+}
+
+// logs returns logs first to last, inclusive.
+func logs(first, last uint64) []*raft.Log {
+	var ls []*raft.Log
+	for i := first; i <= last; i++ {
+		ls = append(ls, &raft.Log{Index: i, Term: i / 4, Type: raft.LogCommand, Data: []byte(fmt.Sprintf("data%d", i))})
+	}
+	return ls
+}
+
+func randomOp(rng *rand.Rand) op {
+	switch rng.Intn(12) {
+	case 0, 1, 2:
+		first := uint64(rng.Intn(maxIndex) + 1)
+		ls := logs(first, first+uint64(rng.Intn(6)))
+		for _, l := range ls {
+			l.Term = uint64(rng.Intn(5))
+			l.Type = raft.LogType(rng.Intn(4))
+			if rng.Intn(4) == 0 {
+				l.Data = nil
+			}
+			if rng.Intn(4) == 0 {
+				l.Extensions = []byte{byte(rng.Intn(256))}
+			}
+		}
+		return storeLogs{ls}
+	case 3, 4:
+		return getLog{uint64(rng.Intn(maxIndex + 8))}
+	case 5, 6:
+		min := uint64(rng.Intn(maxIndex + 8))
+		max := min + uint64(rng.Intn(10))
+		if rng.Intn(10) == 0 {
+			max = math.MaxUint64
+		}
+		return deleteRange{min, max}
+	case 7:
+		value := make([]byte, rng.Intn(8)+1)
+		rng.Read(value)
+		return set{fmt.Sprintf("k%d", rng.Intn(4)), value}
+	case 8:
+		return get{fmt.Sprintf("k%d", rng.Intn(4))}
+	case 9:
+		return setUint64{fmt.Sprintf("u%d", rng.Intn(4)), rng.Uint64()}
+	case 10:
+		return getUint64{fmt.Sprintf("u%d", rng.Intn(4))}
+	}
+	return reopen{}
+}
+
+// checker runs operations on a store and on a raft.InmemStore.
+type checker struct {
+	t     *testing.T
+	open  Factory
+	store Store
+	ref   *raft.InmemStore
+	ops   []op
+}
+
+func newChecker(t *testing.T, open Factory) *checker {
+	t.Helper()
+	store, err := open()
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	c := &checker{t: t, open: open, store: store, ref: raft.NewInmemStore()}
+	t.Cleanup(func() {
+		c.store.Close()
+	})
+	return c
+}
+
+// do runs o on both stores and compares their results.
+func (c *checker) do(o op) {
+	c.t.Helper()
+	c.ops = append(c.ops, o)
+	if _, ok := o.(reopen); ok {
+		if err := c.store.Close(); err != nil {
+			c.fatalf("close: %v", err)
+		}
+		store, err := c.open()
+		if err != nil {
+			c.fatalf("reopen: %v", err)
+		}
+		c.store = store
+		return
+	}
+	if got, want := o.run(c.store), o.run(c.ref); got != want {
+		c.fatalf("%s returned %q, InmemStore returned %q", o, got, want)
+	}
+}
+
+// compare checks that both stores hold the same logs and stable values.
+func (c *checker) compare() {
+	c.t.Helper()
+	var first, last uint64
+	for i := uint64(0); i <= maxIndex+16; i++ {
+		var want raft.Log
+		if c.ref.GetLog(i, &want) == nil {
+			if first == 0 {
+				first = i
+			}
+			last = i
+		}
+		if got, want := (getLog{i}).run(c.store), (getLog{i}).run(c.ref); got != want {
+			c.fatalf("GetLog(%d) returned %q, InmemStore returned %q", i, got, want)
+		}
+	}
+
+	if got, err := c.store.FirstIndex(); err != nil || got != first {
+		c.fatalf("FirstIndex returned %d, %v, want %d", got, err, first)
+	}
+	if got, err := c.store.LastIndex(); err != nil || got != last {
+		c.fatalf("LastIndex returned %d, %v, want %d", got, err, last)
+	}
+
+	for i := 0; i < 4; i++ {
+		for _, o := range []op{get{fmt.Sprintf("k%d", i)}, getUint64{fmt.Sprintf("u%d", i)}} {
+			if got, want := o.run(c.store), o.run(c.ref); got != want {
+				c.fatalf("%s returned %q, InmemStore returned %q", o, got, want)
+			}
+		}
+	}
+}
+
+// fatalf fails the test, reporting the operations run so far.
+func (c *checker) fatalf(format string, args ...interface{}) {
+	c.t.Helper()
+	var b bytes.Buffer
+	for _, o := range c.ops {
+		fmt.Fprintf(&b, "\t%s\n", o)
+	}
+	c.t.Fatalf("%s\nafter:\n%s", fmt.Sprintf(format, args...), b.String())
+}